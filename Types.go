@@ -1,17 +1,28 @@
 package main
 
-import "time"
+import (
+	"os"
+	"sync"
+	"time"
+)
 
 type File struct {
 	Name             string
-	Content          string
+	Content          string // only used by version 1 images
 	Size             int
+	Blocks           []string
+	Versions         []Version
+	Compression      string
 	CreatedAt        time.Time
 	UpdatedAt        time.Time
+	ChangedAt        time.Time
+	AccessedAt       time.Time
+	ModifiedBy       string
 	ReadPermission   []int
 	WritePermission  []int
 	ModifyPermission []int
 	Executable       bool
+	Owner            string
 }
 
 type CommandMap map[string]func([]string)
@@ -24,10 +35,24 @@ type Directory struct {
 	Parent           string
 	Path             string
 	CreatedAt        time.Time
-	History          []string
+	UpdatedAt        time.Time
+	ChangedAt        time.Time
+	AccessedAt       time.Time
 	ModifyPermission []int
 	ReadPermission   []int
 	WritePermission  []int
+	Compression      string
+	Vault            *Vault
+	Owner            string
+}
+
+// Vault marks a directory whose contents are encrypted with a key of their
+// own. They are only saved sealed, and while the vault is locked that is
+// the only form they exist in.
+type Vault struct {
+	Salt       []byte
+	Iterations int
+	Sealed     []byte
 }
 
 type User struct {
@@ -35,16 +60,87 @@ type User struct {
 	GroupPerms []int
 }
 
+// VFS is a shell session on a mounted image. Everything that comes from the
+// image is in imageState, so that mount can swap it as a whole.
 type VFS struct {
+	imageState
+
+	CommandMap CommandMap
+	Status     int
+	Aliases    map[string]string
+	Functions  map[string]string
+
+	AutosaveOnChange  bool
+	AutosaveInterval  time.Duration
+	CheckpointRecords int
+
+	expanding  map[string]bool
+	depth      int
+	nesting    int
+	mu         sync.Mutex
+	saveMu     sync.Mutex
+	auditing   bool
+	sourcingRC bool
+	stdin      []byte
+	piped      bool
+}
+
+// imageState is the mounted image: what is saved in it, and what is kept
+// about it while it is mounted.
+type imageState struct {
 	Root        *Directory
 	CurrentDir  *Directory
 	CurrentUser *User
+	Users       map[string]*User
 	MachineName string
-	CommandMap  CommandMap
+	Env         map[string]string
+	ImagePath   string
+	StoreName   string
+	ReadOnly    bool
+
+	Snapshots map[string]*Snapshot
+	Trash     map[string][]*TrashEntry
+	Index     *SearchIndex
+
+	UserQuotas map[string]*Quota
+	DirQuotas  map[string]*Quota
+
+	// Generation counts the saves of the image, to tell which journal
+	// records it already contains.
+	Generation int
+
+	dirty          bool
+	journal        *os.File
+	journalRecords int
+	replaying      bool
+	blobs          *blobStore
+	imageKey       *sealKey
+	vaultKeys      map[*Directory]*sealKey
+	checkpointNow  bool
+	snapshotView   *Directory
+	lastUndo       *undoAction
+	quotaCounts    *quotaCounters
 }
 
 type HelperVFS struct {
 	Root        *Directory
 	CurrentDir  *Directory
 	CurrentUser *User
+	CurrentPath string
+	Users       map[string]*User
+	MachineName string
+	Env         map[string]string
+	Blobs       map[string][]byte
+	Compressed  map[string]compressedBlob
+	Snapshots   map[string]*Snapshot
+	Trash       map[string][]*TrashEntry
+	Index       *SearchIndex
+	UserQuotas  map[string]*Quota
+	DirQuotas   map[string]*Quota
+	Generation  int
+
+	blobs  *blobStore
+	codecs map[string]string
+	store  string
+	key    *sealKey
 }
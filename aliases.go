@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const maxFunctionDepth = 64
+
+var funcDefPattern = regexp.MustCompile(`(?s)^\s*([A-Za-z_][A-Za-z0-9_-]*)\s*\(\)\s*\{(.*)\}\s*$`)
+
+func (vfs *VFS) initAliases() {
+	if vfs.Aliases == nil {
+		vfs.Aliases = make(map[string]string)
+	}
+	if vfs.Functions == nil {
+		vfs.Functions = make(map[string]string)
+	}
+	if vfs.expanding == nil {
+		vfs.expanding = make(map[string]bool)
+	}
+}
+
+// defineFunction handles `name() { body }` lines. It reports whether the
+// input was a function definition.
+func (vfs *VFS) defineFunction(input string) bool {
+	match := funcDefPattern.FindStringSubmatch(input)
+	if match == nil {
+		return false
+	}
+	name, body := match[1], strings.TrimSpace(match[2])
+	vfs.Functions[name] = strings.TrimSuffix(body, ";")
+	vfs.saveRC()
+	return true
+}
+
+// expandAlias runs the alias for commandName, if there is one that is not
+// already being expanded, and reports whether it did.
+func (vfs *VFS) expandAlias(commands CommandMap, commandName string, args []string) bool {
+	value, ok := vfs.Aliases[commandName]
+	if !ok || vfs.expanding[commandName] {
+		return false
+	}
+	vfs.expanding[commandName] = true
+	defer delete(vfs.expanding, commandName)
+
+	line := value
+	if len(args) > 0 {
+		line += " " + shellQuote(args)
+	}
+	executeLine(vfs, commands, line)
+	return true
+}
+
+func (vfs *VFS) callFunction(commands CommandMap, name string, args []string) bool {
+	body, ok := vfs.Functions[name]
+	if !ok {
+		return false
+	}
+	if vfs.depth >= maxFunctionDepth {
+		vfs.fail("Maximum function nesting depth exceeded in", name)
+		return true
+	}
+	vfs.depth++
+	defer func() { vfs.depth-- }()
+
+	executeLine(vfs, commands, expandPositional(body, name, args))
+	return true
+}
+
+// expandPositional substitutes the arguments of a call to the function name
+// into its body. Outside quotes each argument is quoted as a word of its
+// own; inside double quotes it is inserted as it is, and inside single
+// quotes nothing is expanded, as in sh.
+func expandPositional(body string, name string, args []string) string {
+	var out strings.Builder
+	var quote byte
+	insert := func(args []string, separator string) {
+		if quote == 0 {
+			out.WriteString(shellQuote(args))
+			return
+		}
+		escaped := make([]string, len(args))
+		for i, arg := range args {
+			escaped[i] = doubleQuoteEscaper.Replace(arg)
+		}
+		out.WriteString(strings.Join(escaped, separator))
+	}
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case c == '\\' && quote != '\'' && i+1 < len(body):
+			out.WriteString(body[i : i+2])
+			i++
+			continue
+		case c == '\'' || c == '"':
+			if quote == 0 {
+				quote = c
+			} else if quote == c {
+				quote = 0
+			}
+		}
+		if c != '$' || quote == '\'' || i+1 >= len(body) {
+			out.WriteByte(c)
+			continue
+		}
+		next := body[i+1]
+		switch {
+		case next == '@':
+			// "$@" gives each argument as a word of its own.
+			insert(args, `" "`)
+		case next == '*':
+			insert(args, " ")
+		case next == '#':
+			out.WriteString(strconv.Itoa(len(args)))
+		case next == '0':
+			out.WriteString(name)
+		case next >= '1' && next <= '9':
+			index := int(next - '1')
+			if index < len(args) {
+				insert(args[index:index+1], "")
+			}
+		default:
+			out.WriteByte('$')
+			continue
+		}
+		i++
+	}
+	return out.String()
+}
+
+// doubleQuoteEscaper escapes what would end or change a double-quoted word.
+var doubleQuoteEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+func shellQuote(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+func (vfs *VFS) alias(args []string) {
+	if len(args) == 0 {
+		for _, name := range sortedKeys(vfs.Aliases) {
+			fmt.Printf("alias %s=%s\n", name, shellQuote([]string{vfs.Aliases[name]}))
+		}
+		return
+	}
+	changed := false
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			if value, exists := vfs.Aliases[name]; exists {
+				fmt.Printf("alias %s=%s\n", name, shellQuote([]string{value}))
+			} else {
+				vfs.fail("alias:", name, "not found")
+			}
+			continue
+		}
+		vfs.Aliases[name] = value
+		changed = true
+	}
+	if changed {
+		vfs.saveRC()
+	}
+}
+
+func (vfs *VFS) unalias(args []string) {
+	if len(args) == 1 && args[0] == "-a" {
+		if len(vfs.Aliases) == 0 {
+			return
+		}
+		vfs.Aliases = make(map[string]string)
+		vfs.saveRC()
+		return
+	}
+	changed := false
+	for _, name := range args {
+		if _, exists := vfs.Aliases[name]; !exists {
+			vfs.fail("unalias:", name, "not found")
+			continue
+		}
+		delete(vfs.Aliases, name)
+		changed = true
+	}
+	if changed {
+		vfs.saveRC()
+	}
+}
+
+func (vfs *VFS) listFunctions() {
+	for _, name := range sortedKeys(vfs.Functions) {
+		fmt.Printf("%s() { %s; }\n", name, vfs.Functions[name])
+	}
+}
+
+// saveRC rewrites the current user's rc file from the alias and function
+// tables so that they survive a restart. It leaves the file alone while it
+// is being sourced and when it already holds the same definitions, and it
+// never creates the home directory or writes into one the user does not own.
+func (vfs *VFS) saveRC() {
+	if vfs.CurrentUser == nil || vfs.sourcingRC {
+		return
+	}
+	var lines []string
+	for _, name := range sortedKeys(vfs.Aliases) {
+		lines = append(lines, "alias "+shellQuote([]string{name + "=" + vfs.Aliases[name]}))
+	}
+	for _, name := range sortedKeys(vfs.Functions) {
+		lines = append(lines, name+"() { "+vfs.Functions[name]+"; }")
+	}
+
+	content := []byte(strings.Join(lines, "\n"))
+
+	homePath := "/home/" + vfs.CurrentUser.Name
+	home := vfs.findDirectoryByPath(homePath)
+	if home == nil {
+		fmt.Println("Warning:", homePath, "does not exist, so aliases and functions last only for this session")
+		return
+	}
+	rcPath := joinPath(homePath, ".vshrc")
+	user := vfs.userName()
+	file, exists := home.Files[".vshrc"]
+	if exists {
+		if current, err := vfs.readFile(file); err == nil && bytes.Equal(current, content) {
+			return
+		}
+	}
+	switch {
+	case vfs.isLocked(home):
+		vfs.fail("Cannot save", rcPath+":", homePath, "is a locked vault")
+		return
+	case home.Owner != user || exists && file.Owner != user:
+		vfs.deny("write", rcPath, "Cannot save", rcPath+": it belongs to someone else")
+		return
+	case exists && !checkOverlap(file.WritePermission, vfs.CurrentUser.GroupPerms):
+		vfs.deny("write", rcPath, "You do not have write permissions for", rcPath)
+		return
+	case !exists && !checkOverlap(home.WritePermission, vfs.CurrentUser.GroupPerms):
+		vfs.deny("create", rcPath, "You do not have write permissions for", homePath)
+		return
+	}
+	if !vfs.writable(home, ".vshrc", len(content)) {
+		return
+	}
+	if !exists {
+		file = vfs.newFile(".vshrc")
+		home.Files[".vshrc"] = file
+		vfs.logFileCreate(home, file)
+	}
+	vfs.keepVersion(file, vfs.userName())
+	if err := vfs.writeFile(file, content); err != nil {
+		vfs.fail("Error writing", file.Name+":", err)
+		return
+	}
+	vfs.logFileWrite(home, file)
+}
+
+// sourceRC replaces the alias and function tables with whatever the current
+// user's rc file defines.
+func (vfs *VFS) sourceRC(commands CommandMap) {
+	vfs.Aliases = make(map[string]string)
+	vfs.Functions = make(map[string]string)
+	if vfs.CurrentUser == nil {
+		return
+	}
+	home := vfs.findDirectoryByPath("/home/" + vfs.CurrentUser.Name)
+	if home == nil {
+		return
+	}
+	if file, exists := home.Files[".vshrc"]; exists {
+		content, err := vfs.readFile(file)
+		if err != nil {
+			vfs.fail("Error reading", file.Name+":", err)
+			return
+		}
+		vfs.sourcingRC = true
+		defer func() { vfs.sourcingRC = false }()
+		vfs.runScript(commands, string(content), file.Name, nil)
+	}
+}
+
+func (vfs *VFS) source(commands CommandMap, name string) {
+	file, exists := vfs.CurrentDir.Files[name]
+	if !exists {
+		vfs.fail("File not found:", name)
+		return
+	}
+	if !checkOverlap(file.ReadPermission, vfs.CurrentUser.GroupPerms) {
+		vfs.fail("You do not have read permissions for", name)
+		return
+	}
+	content, err := vfs.readFile(file)
+	if err != nil {
+		vfs.fail("Error reading", name+":", err)
+		return
+	}
+	vfs.runScript(commands, string(content), file.Name, nil)
+}
+
+// runScript executes every statement of script, substituting $1, $@ and
+// friends from args outside of function definitions.
+func (vfs *VFS) runScript(commands CommandMap, script string, name string, args []string) {
+	for _, statement := range splitStatements(script) {
+		trimmed := strings.TrimSpace(statement)
+		if strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if !funcDefPattern.MatchString(statement) {
+			statement = expandPositional(statement, name, args)
+		}
+		executeLine(vfs, commands, statement)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
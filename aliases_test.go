@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSaveRCChecksHome(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(vfs *VFS, home *Directory)
+		saved bool
+	}{
+		{"own home", func(vfs *VFS, home *Directory) {}, true},
+		{"someone else's home", func(vfs *VFS, home *Directory) { home.Owner = "bob" }, false},
+		{"home not writable", func(vfs *VFS, home *Directory) { home.WritePermission = []int{1} }, false},
+		{"over quota", func(vfs *VFS, home *Directory) { run(vfs, "setquota -d /home 0 1 0 0") }, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vfs := newTestVFS(t)
+			run(vfs, "mkdir /home")
+			run(vfs, "mkdir /home/"+vfs.CurrentUser.Name)
+			home := vfs.findDirectoryByPath("/home/" + vfs.CurrentUser.Name)
+			test.setup(vfs, home)
+
+			run(vfs, "alias ll='ls -l'")
+			if vfs.Aliases["ll"] != "ls -l" {
+				t.Fatalf("aliases are %v", vfs.Aliases)
+			}
+			if _, saved := home.Files[".vshrc"]; saved != test.saved {
+				t.Errorf("saved: %v, want %v", saved, test.saved)
+			}
+			if !test.saved && vfs.Status == 0 {
+				t.Error("a refused save did not fail")
+			}
+		})
+	}
+}
+
+func TestSaveRCWithoutHome(t *testing.T) {
+	vfs := newTestVFS(t)
+	output := run(vfs, "alias ll='ls -l'")
+	if !strings.Contains(output, "last only for this session") {
+		t.Errorf("alias printed %q", output)
+	}
+	if vfs.findDirectoryByPath("/home") != nil {
+		t.Error("saving aliases made /home")
+	}
+}
+
+func TestUnaliasUnchangedDoesNotSave(t *testing.T) {
+	vfs := newTestVFS(t)
+	run(vfs, "mkdir /home")
+	run(vfs, "mkdir /home/"+vfs.CurrentUser.Name)
+	home := vfs.findDirectoryByPath("/home/" + vfs.CurrentUser.Name)
+	for _, line := range []string{"unalias nope", "unalias -a"} {
+		run(vfs, line)
+		if _, saved := home.Files[".vshrc"]; saved {
+			t.Errorf("%q wrote the rc file", line)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// The audit log records every change to the tree, and every change that was
+// refused, as tab separated lines in auditLogDir. Once auditLogName grows past
+// maxAuditSize it is rotated to auditLogName.1 and so on, keeping
+// auditRotations old logs.
+const (
+	auditLogDir    = "/var/log/audit"
+	auditLogName   = "audit.log"
+	maxAuditSize   = 64 * 1024
+	auditRotations = 3
+)
+
+type auditEntry struct {
+	Time   time.Time
+	User   string
+	Op     string
+	Path   string
+	To     string
+	Denied bool
+}
+
+func (entry auditEntry) line() string {
+	result := "ok"
+	if entry.Denied {
+		result = "denied"
+	}
+	return strings.Join([]string{entry.Time.Format(time.RFC3339), entry.User, result, entry.Op, entry.Path, entry.To}, "\t") + "\n"
+}
+
+func parseAuditLine(line string) (auditEntry, bool) {
+	fields := strings.Split(line, "\t")
+	if len(fields) != 6 {
+		return auditEntry{}, false
+	}
+	at, err := time.Parse(time.RFC3339, fields[0])
+	if err != nil {
+		return auditEntry{}, false
+	}
+	return auditEntry{Time: at, User: fields[1], Denied: fields[2] == "denied", Op: fields[3], Path: fields[4], To: fields[5]}, true
+}
+
+// audit adds a journaled change to the audit log. Paths inside an unlocked
+// vault are logged as the vault itself, since the log is not encrypted with
+// it.
+func (vfs *VFS) audit(rec journalRecord, denied bool) {
+	// Vaults are journaled as a whole after every change in them, which is
+	// already logged as the change itself.
+	if vfs.auditing || vfs.replaying || rec.Op == "vault" {
+		return
+	}
+	entry := auditEntry{Time: rec.Time, User: vfs.userName(), Op: rec.Op, Path: rec.Path, To: rec.To, Denied: denied}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if vault := vfs.unlockedVault(entry.Path); vault != nil {
+		entry.Path = vault.Path
+	}
+	if vault := vfs.unlockedVault(entry.To); vault != nil {
+		entry.To = vault.Path
+	}
+	line := entry.line()
+	vfs.dirty = true
+	vfs.appendAudit(line)
+	vfs.appendJournal(journalRecord{Op: "audit", Content: line})
+}
+
+// deny reports that the current user may not perform op on target, and
+// logs the attempt.
+func (vfs *VFS) deny(op string, target string, a ...any) {
+	vfs.fail(a...)
+	if !strings.HasPrefix(target, "/") {
+		target = joinPath(vfs.CurrentDir.Path, target)
+	}
+	vfs.audit(journalRecord{Op: op, Path: target}, true)
+}
+
+// appendAudit writes line to the audit log, rotating it first if it is full.
+func (vfs *VFS) appendAudit(line string) {
+	vfs.auditing = true
+	defer func() { vfs.auditing = false }()
+
+	dir := vfs.mkdirAll(auditLogDir)
+	dir.ReadPermission, dir.WritePermission, dir.ModifyPermission = []int{0}, []int{0}, []int{0}
+	file, exists := dir.Files[auditLogName]
+	if exists && file.Size+len(line) > maxAuditSize {
+		if oldest, exists := dir.Files[fmt.Sprintf("%s.%d", auditLogName, auditRotations)]; exists {
+			vfs.releaseFile(oldest)
+		}
+		for n := auditRotations - 1; n >= 1; n-- {
+			if older, exists := dir.Files[fmt.Sprintf("%s.%d", auditLogName, n)]; exists {
+				older.Name = fmt.Sprintf("%s.%d", auditLogName, n+1)
+				dir.Files[older.Name] = older
+			}
+		}
+		file.Name = auditLogName + ".1"
+		dir.Files[file.Name] = file
+		exists = false
+	}
+	if !exists {
+		file = vfs.newFile(auditLogName)
+		file.ReadPermission, file.WritePermission, file.ModifyPermission = []int{0}, []int{0}, []int{0}
+		dir.Files[auditLogName] = file
+	}
+	if err := vfs.appendFile(file, []byte(line)); err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing audit log:", err)
+	}
+}
+
+// auditEntries reads the audit log back, oldest entry first.
+func (vfs *VFS) auditEntries() []auditEntry {
+	dir := vfs.findDirectoryByPath(auditLogDir)
+	if dir == nil {
+		return nil
+	}
+	var entries []auditEntry
+	for n := auditRotations; n >= 0; n-- {
+		name := auditLogName
+		if n > 0 {
+			name = fmt.Sprintf("%s.%d", auditLogName, n)
+		}
+		file, exists := dir.Files[name]
+		if !exists {
+			continue
+		}
+		content, err := vfs.readFile(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading", name+":", err)
+			continue
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			if entry, ok := parseAuditLine(line); ok {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries
+}
+
+type auditFilter struct {
+	user   string
+	path   string
+	since  time.Time
+	until  time.Time
+	denied bool
+	within bool
+}
+
+func (filter auditFilter) matches(entry auditEntry) bool {
+	switch {
+	case filter.user != "" && entry.User != filter.user:
+		return false
+	case !filter.since.IsZero() && entry.Time.Before(filter.since):
+		return false
+	case !filter.until.IsZero() && entry.Time.After(filter.until):
+		return false
+	case filter.denied && !entry.Denied:
+		return false
+	case filter.path == "":
+		return true
+	}
+	for _, entryPath := range []string{entry.Path, entry.To} {
+		switch {
+		case entryPath == filter.path:
+			return true
+		case filter.within && entryPath != "" && joinPath(entryPath, "..") == filter.path:
+			return true
+		case !filter.within && strings.HasPrefix(entryPath, strings.TrimSuffix(filter.path, "/")+"/"):
+			return true
+		}
+	}
+	return false
+}
+
+func printAudit(entries []auditEntry, filter auditFilter) {
+	for _, entry := range entries {
+		if !filter.matches(entry) {
+			continue
+		}
+		target := entry.Path
+		if entry.To != "" {
+			target += " -> " + entry.To
+		}
+		result := ""
+		if entry.Denied {
+			result = "  DENIED"
+		}
+		fmt.Printf("%s  %-10s %-16s %s%s\n", entry.Time.Local().Format("2006-01-02 15:04:05"), entry.User, entry.Op, target, result)
+	}
+}
+
+// parseAuditTime accepts a full RFC 3339 time or a local date with an
+// optional time of day.
+func parseAuditTime(value string) (time.Time, error) {
+	if at, err := time.Parse(time.RFC3339, value); err == nil {
+		return at, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if at, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return at, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected YYYY-MM-DD[ HH:MM[:SS]]", value)
+}
+
+// auditQuery prints the audit log entries that match the options in args.
+func (vfs *VFS) auditQuery(args []string) {
+	if !vfs.isAdmin() {
+		vfs.fail("Only an administrator can read the audit log")
+		return
+	}
+	var filter auditFilter
+	for i := 0; i < len(args); i++ {
+		option := args[i]
+		if option == "-denied" {
+			filter.denied = true
+			continue
+		}
+		if i+1 >= len(args) {
+			vfs.fail("audit: missing value for", option)
+			return
+		}
+		value := args[i+1]
+		i++
+		var err error
+		switch option {
+		case "-u":
+			filter.user = value
+		case "-p":
+			if !strings.HasPrefix(value, "/") {
+				value = joinPath(vfs.CurrentDir.Path, value)
+			}
+			filter.path = joinPath(value, "")
+		case "-since":
+			filter.since, err = parseAuditTime(value)
+		case "-until":
+			filter.until, err = parseAuditTime(value)
+		default:
+			err = fmt.Errorf("audit: unknown option %s", option)
+		}
+		if err != nil {
+			vfs.fail(err)
+			return
+		}
+	}
+	printAudit(vfs.auditEntries(), filter)
+}
+
+// history prints the audit log entries for dir and the entries directly in
+// it.
+func (vfs *VFS) history(dir *Directory) {
+	if !checkOverlap(dir.ReadPermission, vfs.CurrentUser.GroupPerms) {
+		vfs.fail("You do not have read permissions for", dir.Path)
+		return
+	}
+	printAudit(vfs.auditEntries(), auditFilter{path: dir.Path, within: true})
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// blobStore holds every distinct chunk of file data once, keyed by the hex
+// SHA-256 of its contents. Files refer to chunks by hash, so identical
+// content and copies made with cp share storage; a chunk is copied only when
+// one of the files sharing it is written to.
+//
+// Chunks read from an image stay in the form they were saved in, compressed
+// or not, until something needs their contents.
+type blobStore struct {
+	data   map[string][]byte
+	packed map[string]packedBlob
+	lazy   map[string]lazyBlob
+	refs   map[string]int
+}
+
+// compressedBlob records how a chunk in an image was compressed.
+type compressedBlob struct {
+	Codec string
+	Size  int
+}
+
+// packedBlob is a chunk as it is stored in an image.
+type packedBlob struct {
+	compressedBlob
+	data []byte
+}
+
+// lazyBlob is a chunk a store has not read yet.
+type lazyBlob struct {
+	compressedBlob
+	source string
+	extent pageExtent
+}
+
+func newBlobStore(data map[string][]byte, compressed map[string]compressedBlob) *blobStore {
+	b := &blobStore{
+		data:   make(map[string][]byte),
+		packed: make(map[string]packedBlob),
+		lazy:   make(map[string]lazyBlob),
+		refs:   make(map[string]int),
+	}
+	for hash, chunk := range data {
+		if info, ok := compressed[hash]; ok {
+			b.packed[hash] = packedBlob{compressedBlob: info, data: chunk}
+		} else {
+			b.data[hash] = chunk
+		}
+	}
+	return b
+}
+
+func blobHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// get returns the chunk stored under hash. The empty hash is a hole.
+func (b *blobStore) get(hash string) ([]byte, error) {
+	if hash == "" {
+		return nil, nil
+	}
+	if data, ok := b.data[hash]; ok {
+		return data, nil
+	}
+	if lazy, ok := b.lazy[hash]; ok {
+		data, err := loadPageBlob(lazy.source, lazy.extent)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load chunk %s: %w", hash, err)
+		}
+		if lazy.Codec == "" {
+			b.data[hash] = data
+			delete(b.lazy, hash)
+			return data, nil
+		}
+		b.packed[hash] = packedBlob{compressedBlob: lazy.compressedBlob, data: data}
+		delete(b.lazy, hash)
+	}
+	packed, ok := b.packed[hash]
+	if !ok {
+		return nil, fmt.Errorf("chunk %s is missing from the image", hash)
+	}
+	codec, err := getCodec(packed.Codec)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s: %w", hash, err)
+	}
+	data, err := codec.Decompress(packed.data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress chunk %s: %w", hash, err)
+	}
+	if blobHash(data) != hash {
+		return nil, fmt.Errorf("chunk %s does not match its hash, the image is corrupt", hash)
+	}
+	b.data[hash] = data
+	return data, nil
+}
+
+// pack returns the chunk stored under hash as it should be saved with the
+// named codec, or as it is when codec is empty.
+func (b *blobStore) pack(hash string, codec string) ([]byte, error) {
+	if packed, ok := b.packed[hash]; ok && packed.Codec == codec {
+		return packed.data, nil
+	}
+	data, err := b.get(hash)
+	if err != nil || codec == "" {
+		return data, err
+	}
+	compressor, err := getCodec(codec)
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := compressor.Compress(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress chunk %s: %w", hash, err)
+	}
+	b.packed[hash] = packedBlob{compressedBlob: compressedBlob{Codec: codec, Size: len(data)}, data: compressed}
+	return compressed, nil
+}
+
+func (b *blobStore) has(hash string) bool {
+	_, loaded := b.data[hash]
+	_, packed := b.packed[hash]
+	_, lazy := b.lazy[hash]
+	return loaded || packed || lazy
+}
+
+// put stores data, unless an identical chunk is already stored, and takes a
+// reference to it. All-zero chunks are stored as holes.
+func (b *blobStore) put(data []byte) string {
+	if isZero(data) {
+		return ""
+	}
+	hash := blobHash(data)
+	if !b.has(hash) {
+		b.data[hash] = bytes.Clone(data)
+	}
+	b.refs[hash]++
+	return hash
+}
+
+func (b *blobStore) retain(hash string) {
+	if hash != "" {
+		b.refs[hash]++
+	}
+}
+
+// release drops a reference to hash and forgets the chunk once nothing
+// refers to it.
+func (b *blobStore) release(hash string) {
+	if hash == "" {
+		return
+	}
+	b.refs[hash]--
+	if b.refs[hash] <= 0 {
+		delete(b.refs, hash)
+		delete(b.data, hash)
+		delete(b.packed, hash)
+		delete(b.lazy, hash)
+	}
+}
+
+// recount rebuilds the reference counts from the files under roots and drops
+// the chunks nothing refers to.
+func (b *blobStore) recount(roots ...*Directory) {
+	b.refs = make(map[string]int)
+	for _, root := range roots {
+		walkFiles(root, func(file *File) {
+			for _, hash := range fileHashes(file) {
+				b.retain(hash)
+			}
+		})
+	}
+	for hash := range b.data {
+		if b.refs[hash] == 0 {
+			delete(b.data, hash)
+		}
+	}
+	for hash := range b.packed {
+		if b.refs[hash] == 0 {
+			delete(b.packed, hash)
+		}
+	}
+	for hash := range b.lazy {
+		if b.refs[hash] == 0 {
+			delete(b.lazy, hash)
+		}
+	}
+}
+
+// treeHashes lists the chunks the files under roots refer to.
+func treeHashes(roots ...*Directory) []string {
+	seen := make(map[string]bool)
+	for _, root := range roots {
+		walkFiles(root, func(file *File) {
+			for _, hash := range fileHashes(file) {
+				if hash != "" {
+					seen[hash] = true
+				}
+			}
+		})
+	}
+	return sortedKeys(seen)
+}
+
+func (b *blobStore) size(hash string) int {
+	if data, ok := b.data[hash]; ok {
+		return len(data)
+	}
+	if packed, ok := b.packed[hash]; ok {
+		return packed.Size
+	}
+	if lazy, ok := b.lazy[hash]; ok && lazy.Codec != "" {
+		return lazy.Size
+	}
+	return int(b.lazy[hash].extent.Length)
+}
+
+// physicalSize is the number of bytes the distinct chunks take up.
+func (b *blobStore) physicalSize() int {
+	total := 0
+	for hash := range b.refs {
+		total += b.size(hash)
+	}
+	return total
+}
+
+// df reports the space the image uses, how many files and directories it
+// holds, how much of it each user owns, and how full the quotas are.
+func (vfs *VFS) df(human bool) {
+	files, dirs, logical, allocated := 0, 0, 0, 0
+	walkFiles(vfs.Root, func(file *File) {
+		files++
+		logical += file.Size
+		allocated += vfs.allocatedSize(file)
+	})
+	walkDirs(vfs.Root, func(dir *Directory) { dirs++ })
+	physical := vfs.blobs.physicalSize()
+	ratio := 1.0
+	if physical > 0 {
+		ratio = float64(allocated) / float64(physical)
+	}
+	fmt.Printf("%-24s %8s %8s %12s %12s %12s %8s %7s\n", "Image", "Files", "Dirs", "Logical", "Allocated", "Physical", "Chunks", "Dedup")
+	fmt.Printf("%-24s %8d %8d %12s %12s %12s %8d %6.2fx\n", vfs.ImagePath, files, dirs,
+		formatSize(logical, human), formatSize(allocated, human), formatSize(physical, human), len(vfs.blobs.refs), ratio)
+
+	fmt.Println()
+	fmt.Printf("%-16s %8s %8s %12s\n", "Owner", "Files", "Dirs", "Used")
+	for _, usage := range vfs.usageByOwner() {
+		fmt.Printf("%-16s %8d %8d %12s\n", ownerName(usage.owner), usage.files, usage.dirs, formatSize(usage.bytes, human))
+	}
+
+	if len(vfs.UserQuotas) > 0 {
+		used := vfs.usage().owners
+		fmt.Println()
+		printQuotaHeader("User")
+		for _, name := range sortedKeys(vfs.UserQuotas) {
+			printQuota(name, used[name], vfs.UserQuotas[name], human)
+		}
+	}
+	vfs.printDirQuotas(human)
+}
+
+// ownerUsage is what one user owns in the image.
+type ownerUsage struct {
+	owner string
+	files int
+	dirs  int
+	bytes int
+}
+
+// usageByOwner adds up what each user owns, ordered by name. The root
+// directory, which no one owns, is left out.
+func (vfs *VFS) usageByOwner() []ownerUsage {
+	usage := make(map[string]*ownerUsage)
+	of := func(owner string) *ownerUsage {
+		if usage[owner] == nil {
+			usage[owner] = &ownerUsage{owner: owner}
+		}
+		return usage[owner]
+	}
+	walkFiles(vfs.Root, func(file *File) {
+		of(file.Owner).files++
+		of(file.Owner).bytes += file.Size
+	})
+	walkDirs(vfs.Root, func(dir *Directory) { of(dir.Owner).dirs++ })
+	var owners []ownerUsage
+	for _, owner := range sortedKeys(usage) {
+		owners = append(owners, *usage[owner])
+	}
+	return owners
+}
+
+func loadPageBlob(filename string, extent pageExtent) ([]byte, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+	return readExtent(file, extent)
+}
+
+func walkFiles(dir *Directory, fn func(file *File)) {
+	for _, file := range dir.Files {
+		fn(file)
+	}
+	for _, sub := range dir.SubDirs {
+		walkFiles(sub, fn)
+	}
+}
+
+// walkDirs calls fn for each directory under dir, not counting dir itself.
+func walkDirs(dir *Directory, fn func(dir *Directory)) {
+	for _, sub := range dir.SubDirs {
+		fn(sub)
+		walkDirs(sub, fn)
+	}
+}
+
+// blobStore returns the chunks of a decoded image, building them from the
+// persisted Blobs the first time.
+func (state *HelperVFS) blobStore() *blobStore {
+	if state.blobs == nil {
+		state.blobs = newBlobStore(state.Blobs, state.Compressed)
+		state.Blobs, state.Compressed = nil, nil
+	}
+	return state.blobs
+}
+
+// codecFor is the codec the chunk stored under hash is saved with: the one
+// the files using it ask for, or when state was loaded rather than taken
+// from a running shell, the one it already has.
+func (state *HelperVFS) codecFor(hash string) string {
+	if state.codecs != nil {
+		return state.codecs[hash]
+	}
+	blobs := state.blobStore()
+	if packed, ok := blobs.packed[hash]; ok {
+		return packed.Codec
+	}
+	return blobs.lazy[hash].Codec
+}
+
+// packBlobs encodes every referenced chunk for saving, returning the chunks
+// and what was compressed.
+func (state *HelperVFS) packBlobs(each func(hash string, codec string) error) (map[string]compressedBlob, error) {
+	blobs := state.blobStore()
+	compressed := make(map[string]compressedBlob)
+	for _, hash := range treeHashes(state.roots()...) {
+		codec := state.codecFor(hash)
+		if codec != "" {
+			compressed[hash] = compressedBlob{Codec: codec, Size: blobs.size(hash)}
+		}
+		if err := each(hash, codec); err != nil {
+			return nil, err
+		}
+	}
+	return compressed, nil
+}
+
+// inlineBlobs fills in Blobs for the stores that write the chunks as part of
+// the image itself.
+func (state *HelperVFS) inlineBlobs() error {
+	blobs := state.blobStore()
+	data := make(map[string][]byte)
+	compressed, err := state.packBlobs(func(hash string, codec string) error {
+		packed, err := blobs.pack(hash, codec)
+		data[hash] = packed
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	state.Blobs, state.Compressed = data, compressed
+	return nil
+}
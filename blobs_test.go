@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"maps"
+	"slices"
+	"testing"
+)
+
+func TestBlobStoreRefs(t *testing.T) {
+	b := newBlobStore(nil, nil)
+	if hash := b.put(make([]byte, 100)); hash != "" || len(b.data) != 0 {
+		t.Errorf("an all-zero chunk was stored under %q", hash)
+	}
+	first := b.put([]byte("chunk"))
+	second := b.put([]byte("chunk"))
+	if first != second || len(b.data) != 1 || b.refs[first] != 2 {
+		t.Fatalf("two puts of one chunk stored %d chunks with %d references", len(b.data), b.refs[first])
+	}
+	b.retain(first)
+	b.release(first)
+	b.release(first)
+	if got, err := b.get(first); err != nil || string(got) != "chunk" {
+		t.Fatalf("a chunk still referred to is gone: %v", err)
+	}
+	b.release(first)
+	if b.has(first) || len(b.refs) != 0 {
+		t.Error("a chunk nothing refers to was kept")
+	}
+	if _, err := b.get(first); err == nil {
+		t.Error("a released chunk can still be read")
+	}
+}
+
+func TestCopySharesChunks(t *testing.T) {
+	tests := []struct {
+		name       string
+		line       string
+		shared     int  // chunks a.bin and b.bin still share
+		wantChunks int  // distinct chunks stored for the two
+		writeCopy  bool // whether to write to the start of b.bin afterwards
+	}{
+		{"copied", "cp a.bin b.bin", 3, 3, false},
+		{"copy changed", "cp a.bin b.bin", 2, 4, true},
+		{"original deleted", "cp a.bin b.bin; rm -f a.bin", 0, 3, false},
+		{"copy deleted", "cp a.bin b.bin; rm -f b.bin", 0, 3, false},
+		{"copied again", "cp a.bin b.bin; rm -f b.bin; cp a.bin b.bin", 3, 3, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vfs := newTestVFS(t)
+			data := pattern(3*chunkSize, 5)
+			writeTestFile(t, vfs, "/d/a.bin", string(data))
+			run(vfs, "cd /d; "+test.line)
+			if vfs.Status != 0 {
+				t.Fatalf("%s exited with status %d", test.line, vfs.Status)
+			}
+			// Deleted files hold on to their chunks until they can no
+			// longer be undone.
+			vfs.dropUndo()
+			a, b := vfs.findFileByPath("/d/a.bin"), vfs.findFileByPath("/d/b.bin")
+			if test.writeCopy {
+				if err := vfs.writeAt(b, []byte("changed"), 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			chunks := make(map[string]int)
+			for _, file := range []*File{a, b} {
+				if file == nil {
+					continue
+				}
+				for _, hash := range file.Blocks {
+					chunks[hash]++
+				}
+			}
+			shared := 0
+			for hash, n := range chunks {
+				if n == 2 {
+					shared++
+				}
+				if vfs.blobs.refs[hash] != n {
+					t.Errorf("chunk %.8s has %d references, want %d", hash, vfs.blobs.refs[hash], n)
+				}
+			}
+			if shared != test.shared || len(chunks) != test.wantChunks {
+				t.Errorf("the files share %d of %d chunks, want %d of %d", shared, len(chunks), test.shared, test.wantChunks)
+			}
+			if a != nil {
+				if got, _ := vfs.readFile(a); !bytes.Equal(got, data) {
+					t.Error("changing the copy changed the original")
+				}
+			}
+		})
+	}
+}
+
+func TestRemovedChunksKeptForUndo(t *testing.T) {
+	vfs := newTestVFS(t)
+	writeTestFile(t, vfs, "/a.txt", "contents")
+	hash := blobHash([]byte("contents"))
+	run(vfs, "rm -f /a.txt")
+	if vfs.blobs.refs[hash] != 1 {
+		t.Fatalf("a file rm could still undo has %d references", vfs.blobs.refs[hash])
+	}
+	run(vfs, "undo")
+	if got, _ := readTestFile(t, vfs, "/a.txt"); got != "contents" {
+		t.Fatalf("undo brought back %q", got)
+	}
+	run(vfs, "rm -f /a.txt")
+	vfs.dropUndo()
+	if vfs.blobs.has(hash) {
+		t.Error("the chunks of a deleted file outlived its undo")
+	}
+}
+
+func TestRecount(t *testing.T) {
+	vfs := newTestVFS(t)
+	writeTestFile(t, vfs, "/a.txt", "shared")
+	writeTestFile(t, vfs, "/b.txt", "shared")
+	want := maps.Clone(vfs.blobs.refs)
+	orphan := vfs.blobs.put([]byte("orphan"))
+	vfs.blobs.refs[blobHash([]byte("shared"))] = 9
+
+	vfs.blobs.recount(vfs.Root)
+	if !maps.Equal(vfs.blobs.refs, want) {
+		t.Errorf("recount gave %v, want %v", vfs.blobs.refs, want)
+	}
+	if vfs.blobs.has(orphan) {
+		t.Error("recount kept a chunk nothing refers to")
+	}
+	if hashes := treeHashes(vfs.Root); !slices.Contains(hashes, blobHash([]byte("shared"))) {
+		t.Errorf("treeHashes returned %v", hashes)
+	}
+}
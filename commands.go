@@ -1,10 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"os/exec"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -28,10 +30,13 @@ func GetUsage() UsageMap {
 			fmt.Println("Usage: pwd")
 		},
 		"rm": func() {
-			fmt.Println("Usage: rm <file-name>")
+			fmt.Println("Usage: rm [-r] [-f|--force] <path>")
+			fmt.Println("Removed files go to the trash unless --force is given, which files inside a vault need")
 		},
 		"ls": func() {
-			fmt.Println("Usage: ls")
+			fmt.Println("Usage: ls [-l] [-a] [-R] [-h] [-t] [-S] [-r] [<path> ...]")
+			fmt.Println("-l shows mode, owner, size and modification time; the mode is d for a directory,")
+			fmt.Println("then r, w, m and x for whether you may read, write, modify and execute it")
 		},
 		"fill": func() {
 			fmt.Println("Usage: fill <amount>")
@@ -40,10 +45,12 @@ func GetUsage() UsageMap {
 			fmt.Println("Usage: mkdir <dir-name>")
 		},
 		"touch": func() {
-			fmt.Println("Usage: touch <file-name>")
+			fmt.Println("Usage: touch [-t <[[CC]YY]MMDDhhmm[.ss]> | -d <date>] <file-name> ...")
+			fmt.Println("Creates the files that do not exist and sets the access and modification times")
+			fmt.Println("of those that do, to now unless -t or -d gives another time")
 		},
 		"echo": func() {
-			fmt.Println("Usage: echo <file-name> <content>")
+			fmt.Println("Usage: echo [-a] <file-name> <content>")
 		},
 		"cat": func() {
 			fmt.Println("Usage: cat <file-name> [>> <destination-file>]")
@@ -72,10 +79,188 @@ func GetUsage() UsageMap {
 		"sethost": func() {
 			fmt.Println("Usage: sethost <name>")
 		},
+		"export": func() {
+			fmt.Println("Usage: export [<name>=<value> ...]")
+		},
+		"unset": func() {
+			fmt.Println("Usage: unset [-f] <name> [<name> ...]")
+		},
+		"alias": func() {
+			fmt.Println("Usage: alias [<name>[=<value>] ...]")
+		},
+		"unalias": func() {
+			fmt.Println("Usage: unalias -a | unalias <name> [<name> ...]")
+		},
+		"functions": func() {
+			fmt.Println("Usage: functions")
+		},
+		"source": func() {
+			fmt.Println("Usage: source <file-name>")
+		},
+		"sync": func() {
+			fmt.Println("Usage: sync")
+		},
+		"truncate": func() {
+			fmt.Println("Usage: truncate -s <size> <file-name>")
+		},
+		"upload": func() {
+			fmt.Println("Usage: upload <host-path> <file-name>")
+		},
+		"download": func() {
+			fmt.Println("Usage: download <file-name> <host-path>")
+		},
+		"cp": func() {
+			fmt.Println("Usage: cp [-r] <source> <destination>")
+		},
+		"df": func() {
+			fmt.Println("Usage: df [-h]")
+		},
+		"du": func() {
+			fmt.Println("Usage: du [-s] [-h] [<path> ...]")
+			fmt.Println("Prints the bytes used under each directory; -s prints only the totals")
+		},
+		"quota": func() {
+			fmt.Println("Usage: quota [-h] [<user>]")
+			fmt.Println("A + after the name marks bytes, then files and directories, over the soft limit")
+		},
+		"repquota": func() {
+			fmt.Println("Usage: repquota [-h]")
+		},
+		"setquota": func() {
+			fmt.Println("Usage: setquota -u <user> <soft-bytes> <hard-bytes> <soft-inodes> <hard-inodes>")
+			fmt.Println("       setquota -d <directory> <soft-bytes> <hard-bytes> <soft-inodes> <hard-inodes>")
+			fmt.Println("Byte limits may end in K, M or G; 0 means no limit, and all zeros remove the quota")
+		},
+		"tree": func() {
+			fmt.Println("Usage: tree [-L <depth>] [-d] [-a] [<path> ...]")
+		},
+		"compress": func() {
+			fmt.Println("Usage: compress [-c <codec>] <path>")
+			fmt.Println("Codecs:", codecNames())
+		},
+		"decompress": func() {
+			fmt.Println("Usage: decompress <path>")
+		},
+		"stat": func() {
+			fmt.Println("Usage: stat <path>")
+		},
+		"log": func() {
+			fmt.Println("Usage: log <file-name>")
+		},
+		"show": func() {
+			fmt.Println("Usage: show <file-name>@<version>")
+		},
+		"revert": func() {
+			fmt.Println("Usage: revert <file-name> <version>")
+		},
+		"undo": func() {
+			fmt.Println("Usage: undo")
+			fmt.Println("Undoes the last rm, echo overwrite or mv of this session")
+		},
+		"trash": func() {
+			fmt.Println("Usage: trash list")
+			fmt.Println("       trash restore <id> [<path>]")
+			fmt.Println("       trash empty [<id>]")
+			fmt.Println("Entries older than $" + trashRetentionEnv + " (default 720h, 0 keeps them) are purged")
+		},
+		"audit": func() {
+			fmt.Println("Usage: audit [-u <user>] [-p <path>] [-since <time>] [-until <time>] [-denied]")
+			fmt.Println("Times are YYYY-MM-DD[ HH:MM[:SS]] or RFC 3339")
+		},
+		"snapshot": func() {
+			fmt.Println("Usage: snapshot create <name>")
+			fmt.Println("       snapshot list")
+			fmt.Println("       snapshot delete <name>")
+			fmt.Println("       snapshot restore <name> [<path> ...]")
+			fmt.Println("       snapshot diff <name> [<name>|current]")
+			fmt.Println("Snapshots can be browsed read-only under /" + snapshotsDirName)
+		},
+		"grep": func() {
+			fmt.Println("Usage: grep [-i] [-v] [-n] [-r] <regex> [<path> ...] [>> <destination-file>]")
+		},
+		"head": func() {
+			fmt.Println("Usage: head [-n <lines>] [<file> ...] [>> <destination-file>]")
+		},
+		"tail": func() {
+			fmt.Println("Usage: tail [-n [+]<lines>] [<file> ...] [>> <destination-file>]")
+		},
+		"wc": func() {
+			fmt.Println("Usage: wc [-l] [-w] [-c] [<file> ...] [>> <destination-file>]")
+		},
+		"sort": func() {
+			fmt.Println("Usage: sort [-n] [-r] [-u] [-k <field>] [-t <separator>] [<file> ...] [>> <destination-file>]")
+		},
+		"uniq": func() {
+			fmt.Println("Usage: uniq [-c] [-d] [<file> ...] [>> <destination-file>]")
+		},
+		"cut": func() {
+			fmt.Println("Usage: cut -f <list> [-d <delimiter>] [<file> ...] [>> <destination-file>]")
+			fmt.Println("       cut -c <list> [<file> ...] [>> <destination-file>]")
+			fmt.Println("A list is made of numbers and ranges such as 1,3-5,7-")
+		},
+		"tr": func() {
+			fmt.Println("Usage: tr [-d] [-s] <set> [<set>] [>> <destination-file>]")
+			fmt.Println("Reads the output piped into it; sets may hold ranges such as a-z")
+		},
+		"sed": func() {
+			fmt.Println("Usage: sed [-i] s/<regex>/<replacement>/[g][i][<n>] [<file> ...] [>> <destination-file>]")
+		},
+		"find": func() {
+			fmt.Println("Usage: find [<path> ...] [<expression>]")
+			fmt.Println("Tests:   -name <glob>  -iname <glob>  -type f|d|l  -size [+-]<n>[c|k|M|G]")
+			fmt.Println("         -mtime [+-]<days>  -mmin [+-]<minutes>  -newer <path>  -user <name>")
+			fmt.Println("         -perm read|write|modify[:<id>]  -perm executable  -true  -false")
+			fmt.Println("Options: -maxdepth <n>  -mindepth <n>  -depth")
+			fmt.Println("Actions: -print  -delete  -exec <command> {} \\;  -exec <command> {} +")
+			fmt.Println("Combine with \\( \\), ! or -not, -a or -and, -o or -or")
+		},
+		"index": func() {
+			fmt.Println("Usage: index on|off|rebuild|status")
+			fmt.Println("While on, the contents of files are indexed as they change so search can find them")
+		},
+		"search": func() {
+			fmt.Println("Usage: search [-n <results>] <query>")
+			fmt.Println("Finds the files holding every word of the query, best matches first.")
+			fmt.Println("Write word* to match words starting with word, and \"two words\" to match a phrase")
+		},
+		"diff": func() {
+			fmt.Println("Usage: diff [-u <lines>] [-r] [-N] <from> <to> [>> <destination-file>]")
+			fmt.Println("Prints a unified diff with 3 lines of context unless -u says otherwise;")
+			fmt.Println("-r compares directories, -N treats missing files as empty")
+		},
+		"patch": func() {
+			fmt.Println("Usage: patch [-p <strip>] [-F <fuzz>] [--dry-run] <patch-file> [<file>]")
+			fmt.Println("Hunks that do not apply are saved to <file>.rej; fuzz defaults to 2")
+		},
+		"vcs": func() {
+			fmt.Println("Usage: vcs init")
+			fmt.Println("       vcs add <path> ...")
+			fmt.Println("       vcs commit [-m <message>]")
+			fmt.Println("       vcs log")
+			fmt.Println("       vcs status")
+			fmt.Println("       vcs diff [--staged] [<path> ...]")
+			fmt.Println("       vcs branch [-d] [<name> [<start>]]")
+			fmt.Println("       vcs checkout [-b] <branch>|<commit>")
+			fmt.Println("       vcs merge <branch>|<commit>")
+			fmt.Println("History is kept in " + vcsDirName + " at the top of the repository")
+		},
+		"vault": func() {
+			fmt.Println("Usage: vault create <directory> [<key>]")
+			fmt.Println("       vault unlock <directory> [<key>]")
+			fmt.Println("       vault lock <directory>")
+			fmt.Println("       vault list")
+		},
+		"mount": func() {
+			fmt.Println("Usage: mount [-new] [-readonly] [<image-path>]")
+		},
+		"env": func() {
+			fmt.Println("Usage: env")
+		},
 	}
 }
 
 func GetCommands(vfs *VFS, usage UsageMap) CommandMap {
+	usage = vfs.usageStatus(usage)
 	return CommandMap{
 		"cd": func(args []string) {
 			if len(args) != 1 {
@@ -98,7 +283,7 @@ func GetCommands(vfs *VFS, usage UsageMap) CommandMap {
 				return
 			}
 
-			vfs.history()
+			vfs.history(vfs.CurrentDir)
 			fmt.Println("Displayed history")
 		},
 		"roothistory": func(args []string) {
@@ -106,7 +291,7 @@ func GetCommands(vfs *VFS, usage UsageMap) CommandMap {
 				usage["roothistory"]()
 				return
 			}
-			vfs.roothistory()
+			vfs.history(vfs.Root)
 			fmt.Println("Displayed root history")
 		},
 		"hostname": func(args []string) {
@@ -124,20 +309,44 @@ func GetCommands(vfs *VFS, usage UsageMap) CommandMap {
 			vfs.pwd()
 		},
 		"rm": func(args []string) {
+			recursive, force := false, false
+			for len(args) > 1 && strings.HasPrefix(args[0], "-") {
+				switch args[0] {
+				case "-r":
+					recursive = true
+				case "-f", "--force":
+					force = true
+				case "-rf", "-fr":
+					recursive, force = true, true
+				default:
+					usage["rm"]()
+					return
+				}
+				args = args[1:]
+			}
 			if len(args) != 1 {
 				usage["rm"]()
 				return
 			}
-			vfs.rm(args[0])
-			fmt.Println("Removed file", args[0])
+			vfs.atPath(args[0], func(name string) {
+				vfs.rm(name, recursive, force)
+			})
 		},
 		"ls": func(args []string) {
-			if len(args) != 0 {
+			flags, operands, err := parseTextFlags(args, "laRhtSr", "")
+			if err != nil {
 				usage["ls"]()
 				return
 			}
-			vfs.ls()
-			fmt.Println("Listed directory contents")
+			vfs.ls(operands, lsOptions{
+				long:      flags.has('l'),
+				all:       flags.has('a'),
+				recursive: flags.has('R'),
+				human:     flags.has('h'),
+				byTime:    flags.has('t'),
+				bySize:    flags.has('S'),
+				reverse:   flags.has('r'),
+			})
 		},
 		"fill": func(args []string) {
 			if len(args) != 1 {
@@ -146,7 +355,7 @@ func GetCommands(vfs *VFS, usage UsageMap) CommandMap {
 			}
 			amount, err := strconv.Atoi(args[0])
 			if err != nil {
-				fmt.Println("Error converting string to int:", err)
+				vfs.fail("Error converting string to int:", err)
 				return
 			}
 			vfs.fill(uint16(amount))
@@ -157,45 +366,73 @@ func GetCommands(vfs *VFS, usage UsageMap) CommandMap {
 				usage["mkdir"]()
 				return
 			}
-			vfs.mkdir(args[0])
-			fmt.Println("Created directory", args[0])
+			vfs.atPath(args[0], vfs.mkdir)
 		},
 		"touch": func(args []string) {
-			if len(args) != 1 {
+			flags, operands, err := parseTextFlags(args, "", "td")
+			if err != nil || len(operands) == 0 || (flags.has('t') && flags.has('d')) {
 				usage["touch"]()
 				return
 			}
-			vfs.touch(args[0])
+			var t time.Time
+			switch {
+			case flags.has('t'):
+				t, err = parseStamp(flags.values['t'])
+			case flags.has('d'):
+				t, err = parseDate(flags.values['d'])
+			}
+			if err != nil {
+				vfs.fail("touch:", err)
+				return
+			}
+			for _, target := range operands {
+				vfs.atPath(target, func(name string) { vfs.touchFile(name, t) })
+			}
 		},
 		"echo": func(args []string) {
+			appendToFile := len(args) > 0 && args[0] == "-a"
+			if appendToFile {
+				args = args[1:]
+			}
 			if len(args) < 2 {
 				usage["echo"]()
 				return
 			}
-			vfs.echo(args[0], strings.Join(args[1:], ""), false)
-			fmt.Println("Written to file", args[0])
+			vfs.atPath(args[0], func(name string) {
+				vfs.echo(name, strings.Join(args[1:], ""), appendToFile)
+			})
 		},
 		"cat": func(args []string) {
 			if len(args) == 1 {
-				contentPtr := vfs.cat(args[0])
-				fmt.Println("Content: ", *contentPtr)
+				vfs.atPath(args[0], func(name string) {
+					if content := vfs.cat(name); content != nil {
+						os.Stdout.Write(content)
+					}
+				})
 			} else if len(args) == 3 && args[1] == ">>" {
 				sourceFileName := args[0]
 				destFileName := args[2]
 
-				contentPtr := vfs.cat(sourceFileName)
+				content := vfs.cat(sourceFileName)
+				if content == nil {
+					return
+				}
 
 				destFile, exists := vfs.CurrentDir.Files[destFileName]
 				if !exists {
-					fmt.Println("Destination file not found:", destFileName)
+					vfs.fail("Destination file not found:", destFileName)
+					return
+				}
+				if !vfs.writable(vfs.CurrentDir, destFileName, len(content)) {
 					return
 				}
 
-				err := vfs.pipe(contentPtr, destFile)
+				err := vfs.pipe(content, destFile)
 				if err != nil {
-					fmt.Println(err)
+					vfs.fail(err)
 					return
 				}
+				vfs.logFileWrite(vfs.CurrentDir, destFile)
 				fmt.Println("Piped content to ", destFileName)
 
 			} else {
@@ -211,10 +448,12 @@ func GetCommands(vfs *VFS, usage UsageMap) CommandMap {
 			}
 			intstringconverted, err := strconv.Atoi(args[2])
 			if err != nil {
-				fmt.Println("Error:", err)
+				vfs.fail("Error:", err)
 				return
 			}
-			vfs.remPerms(args[0], args[1], intstringconverted)
+			vfs.atPath(args[0], func(name string) {
+				vfs.remPerms(name, args[1], intstringconverted)
+			})
 			fmt.Println("Removed permission", args[1], "from", args[0], "for ID", args[2])
 		},
 		"whoami": func(args []string) {
@@ -232,10 +471,12 @@ func GetCommands(vfs *VFS, usage UsageMap) CommandMap {
 			}
 			stringintconverted, err := strconv.Atoi(args[2])
 			if err != nil {
-				fmt.Println("Error:", err)
+				vfs.fail("Error:", err)
 				return
 			}
-			vfs.addPerms(args[0], args[1], stringintconverted)
+			vfs.atPath(args[0], func(name string) {
+				vfs.addPerms(name, args[1], stringintconverted)
+			})
 			fmt.Println("Added permission", args[1], "to", args[0], "for ID", args[2])
 		},
 		"nvim": func(args []string) {
@@ -243,7 +484,7 @@ func GetCommands(vfs *VFS, usage UsageMap) CommandMap {
 				usage["nvim"]()
 				return
 			}
-			vfs.nvim(args[0])
+			vfs.atPath(args[0], vfs.nvim)
 		},
 		"clear": func(args []string) {
 			if len(args) != 0 {
@@ -257,7 +498,7 @@ func GetCommands(vfs *VFS, usage UsageMap) CommandMap {
 				usage["call"]()
 				return
 			}
-			vfs.call(args[0])
+			vfs.atPath(args[0], vfs.call)
 		},
 		"time": func(args []string) {
 			vfs.date()
@@ -269,6 +510,549 @@ func GetCommands(vfs *VFS, usage UsageMap) CommandMap {
 			}
 			vfs.sethost(args[0])
 		},
+		"export": func(args []string) {
+			if len(args) == 0 {
+				vfs.env()
+				return
+			}
+			for _, arg := range args {
+				name, value, ok := strings.Cut(arg, "=")
+				if !ok || name == "" {
+					usage["export"]()
+					return
+				}
+				vfs.Env[name] = value
+				vfs.logMutation(journalRecord{Op: "setenv", Path: name, Content: value})
+			}
+		},
+		"unset": func(args []string) {
+			if len(args) == 0 {
+				usage["unset"]()
+				return
+			}
+			if args[0] == "-f" {
+				for _, name := range args[1:] {
+					delete(vfs.Functions, name)
+				}
+				vfs.saveRC()
+				return
+			}
+			for _, name := range args {
+				delete(vfs.Env, name)
+				vfs.logMutation(journalRecord{Op: "unsetenv", Path: name})
+			}
+		},
+		"alias": func(args []string) {
+			vfs.alias(args)
+		},
+		"unalias": func(args []string) {
+			if len(args) == 0 {
+				usage["unalias"]()
+				return
+			}
+			vfs.unalias(args)
+		},
+		"functions": func(args []string) {
+			if len(args) != 0 {
+				usage["functions"]()
+				return
+			}
+			vfs.listFunctions()
+		},
+		"truncate": func(args []string) {
+			if len(args) != 3 || args[0] != "-s" {
+				usage["truncate"]()
+				return
+			}
+			size, err := strconv.Atoi(args[1])
+			if err != nil {
+				vfs.fail("Error converting string to int:", err)
+				return
+			}
+			vfs.atPath(args[2], func(name string) {
+				vfs.truncateFile(name, size)
+			})
+		},
+		"upload": func(args []string) {
+			if len(args) != 2 {
+				usage["upload"]()
+				return
+			}
+			vfs.atPath(args[1], func(name string) {
+				vfs.upload(args[0], name)
+			})
+		},
+		"cp": func(args []string) {
+			recursive := len(args) > 0 && args[0] == "-r"
+			if recursive {
+				args = args[1:]
+			}
+			if len(args) != 2 {
+				usage["cp"]()
+				return
+			}
+			vfs.cp(args[0], args[1], recursive)
+		},
+		"df": func(args []string) {
+			flags, operands, err := parseTextFlags(args, "h", "")
+			if err != nil || len(operands) != 0 {
+				usage["df"]()
+				return
+			}
+			vfs.df(flags.has('h'))
+		},
+		"du": func(args []string) {
+			flags, operands, err := parseTextFlags(args, "sh", "")
+			if err != nil {
+				usage["du"]()
+				return
+			}
+			if len(operands) == 0 {
+				operands = []string{"."}
+			}
+			for _, target := range operands {
+				vfs.du(target, flags.has('s'), flags.has('h'))
+			}
+		},
+		"quota": func(args []string) {
+			flags, operands, err := parseTextFlags(args, "h", "")
+			if err != nil || len(operands) > 1 {
+				usage["quota"]()
+				return
+			}
+			user := vfs.userName()
+			if len(operands) == 1 {
+				user = operands[0]
+			}
+			vfs.quota(user, flags.has('h'))
+		},
+		"repquota": func(args []string) {
+			flags, operands, err := parseTextFlags(args, "h", "")
+			if err != nil || len(operands) != 0 {
+				usage["repquota"]()
+				return
+			}
+			vfs.repquota(flags.has('h'))
+		},
+		"setquota": func(args []string) {
+			if len(args) != 6 || (args[0] != "-u" && args[0] != "-d") {
+				usage["setquota"]()
+				return
+			}
+			vfs.setQuota(args[1], args[0] == "-d", args[2:])
+		},
+		"tree": func(args []string) {
+			flags, operands, err := parseTextFlags(args, "da", "L")
+			if err != nil {
+				usage["tree"]()
+				return
+			}
+			depth, err := flags.number('L', 0)
+			if err != nil || (flags.has('L') && depth == 0) {
+				vfs.fail("tree: the depth must be a positive number")
+				return
+			}
+			if len(operands) == 0 {
+				operands = []string{"."}
+			}
+			for _, target := range operands {
+				vfs.tree(target, treeOptions{maxDepth: depth, dirsOnly: flags.has('d'), all: flags.has('a')})
+			}
+		},
+		"compress": func(args []string) {
+			codec := defaultCodec
+			if len(args) == 3 && args[0] == "-c" {
+				codec, args = args[1], args[2:]
+			}
+			if len(args) != 1 {
+				usage["compress"]()
+				return
+			}
+			vfs.setCompression(args[0], codec)
+		},
+		"decompress": func(args []string) {
+			if len(args) != 1 {
+				usage["decompress"]()
+				return
+			}
+			vfs.setCompression(args[0], noCompression)
+		},
+		"stat": func(args []string) {
+			if len(args) != 1 {
+				usage["stat"]()
+				return
+			}
+			vfs.stat(args[0])
+		},
+		"log": func(args []string) {
+			if len(args) != 1 {
+				usage["log"]()
+				return
+			}
+			vfs.logVersions(args[0])
+		},
+		"show": func(args []string) {
+			if len(args) != 1 {
+				usage["show"]()
+				return
+			}
+			vfs.showVersion(args[0])
+		},
+		"revert": func(args []string) {
+			if len(args) != 2 {
+				usage["revert"]()
+				return
+			}
+			number, err := strconv.Atoi(args[1])
+			if err != nil {
+				vfs.fail("Error converting string to int:", err)
+				return
+			}
+			vfs.revert(args[0], number)
+		},
+		"undo": func(args []string) {
+			if len(args) != 0 {
+				usage["undo"]()
+				return
+			}
+			vfs.undo()
+		},
+		"trash": func(args []string) {
+			var id int
+			if len(args) >= 2 && (args[0] == "restore" || args[0] == "empty") {
+				var err error
+				if id, err = strconv.Atoi(args[1]); err != nil || id <= 0 {
+					vfs.fail("Invalid trash entry:", args[1])
+					return
+				}
+			}
+			switch {
+			case len(args) == 1 && args[0] == "list":
+				vfs.trashList()
+			case len(args) == 2 && args[0] == "restore":
+				vfs.trashRestore(id, "")
+			case len(args) == 3 && args[0] == "restore":
+				vfs.trashRestore(id, args[2])
+			case len(args) == 1 && args[0] == "empty":
+				vfs.trashEmpty(0)
+			case len(args) == 2 && args[0] == "empty":
+				vfs.trashEmpty(id)
+			default:
+				usage["trash"]()
+			}
+		},
+		"audit": func(args []string) {
+			vfs.auditQuery(args)
+		},
+		"snapshot": func(args []string) {
+			switch {
+			case len(args) == 1 && args[0] == "list":
+				vfs.snapshotList()
+			case len(args) == 2 && args[0] == "create":
+				vfs.snapshotCreate(args[1])
+			case len(args) == 2 && args[0] == "delete":
+				vfs.snapshotDelete(args[1])
+			case len(args) >= 2 && args[0] == "restore":
+				vfs.snapshotRestore(args[1], args[2:])
+			case len(args) == 2 && args[0] == "diff":
+				vfs.snapshotDiff(args[1], "current")
+			case len(args) == 3 && args[0] == "diff":
+				vfs.snapshotDiff(args[1], args[2])
+			default:
+				usage["snapshot"]()
+			}
+		},
+		"grep": func(args []string) {
+			args, destination := splitDestination(args)
+			flags, operands, err := parseTextFlags(args, "ivnr", "")
+			if err != nil || len(operands) == 0 {
+				usage["grep"]()
+				return
+			}
+			vfs.grep(operands[0], operands[1:], flags, destination)
+		},
+		"head": func(args []string) {
+			args, destination := splitDestination(args)
+			flags, operands, err := parseTextFlags(args, "", "n")
+			if err != nil {
+				usage["head"]()
+				return
+			}
+			vfs.headTail("head", operands, flags, destination)
+		},
+		"tail": func(args []string) {
+			args, destination := splitDestination(args)
+			flags, operands, err := parseTextFlags(args, "", "n")
+			if err != nil {
+				usage["tail"]()
+				return
+			}
+			vfs.headTail("tail", operands, flags, destination)
+		},
+		"wc": func(args []string) {
+			args, destination := splitDestination(args)
+			flags, operands, err := parseTextFlags(args, "lwc", "")
+			if err != nil {
+				usage["wc"]()
+				return
+			}
+			vfs.wc(operands, flags, destination)
+		},
+		"sort": func(args []string) {
+			args, destination := splitDestination(args)
+			flags, operands, err := parseTextFlags(args, "nru", "kt")
+			if err != nil {
+				usage["sort"]()
+				return
+			}
+			vfs.sortLines(operands, flags, destination)
+		},
+		"uniq": func(args []string) {
+			args, destination := splitDestination(args)
+			flags, operands, err := parseTextFlags(args, "cd", "")
+			if err != nil {
+				usage["uniq"]()
+				return
+			}
+			vfs.uniq(operands, flags, destination)
+		},
+		"cut": func(args []string) {
+			args, destination := splitDestination(args)
+			flags, operands, err := parseTextFlags(args, "", "fdc")
+			if err != nil || flags.has('f') == flags.has('c') {
+				usage["cut"]()
+				return
+			}
+			vfs.cut(operands, flags, destination)
+		},
+		"tr": func(args []string) {
+			args, destination := splitDestination(args)
+			flags, operands, err := parseTextFlags(args, "ds", "")
+			if err != nil || len(operands) == 0 || len(operands) > 2 || (len(operands) == 1 && !flags.has('d') && !flags.has('s')) {
+				usage["tr"]()
+				return
+			}
+			vfs.tr(operands, flags, destination)
+		},
+		"sed": func(args []string) {
+			args, destination := splitDestination(args)
+			flags, operands, err := parseTextFlags(args, "i", "")
+			if err != nil || len(operands) == 0 {
+				usage["sed"]()
+				return
+			}
+			vfs.sed(operands[0], operands[1:], flags, destination)
+		},
+		"find": func(args []string) {
+			starts := 0
+			for starts < len(args) && !strings.HasPrefix(args[starts], "-") && args[starts] != "!" && args[starts] != "(" {
+				starts++
+			}
+			vfs.find(args[:starts], args[starts:])
+		},
+		"index": func(args []string) {
+			if len(args) != 1 {
+				usage["index"]()
+				return
+			}
+			switch args[0] {
+			case "on", "off", "rebuild", "status":
+				vfs.indexCommand(args[0])
+			default:
+				usage["index"]()
+			}
+		},
+		"search": func(args []string) {
+			flags, operands, err := parseTextFlags(args, "", "n")
+			if err != nil || len(operands) == 0 {
+				usage["search"]()
+				return
+			}
+			limit, err := flags.number('n', defaultResults)
+			if err != nil {
+				vfs.fail("search:", err)
+				return
+			}
+			vfs.search(strings.Join(operands, " "), limit)
+		},
+		"diff": func(args []string) {
+			options := diffOptions{context: 3}
+			args, destination := splitDestination(args)
+			for len(args) > 2 && strings.HasPrefix(args[0], "-") {
+				switch args[0] {
+				case "-u", "-U":
+					if context, err := strconv.Atoi(args[1]); err == nil && context >= 0 {
+						options.context = context
+						args = args[1:]
+					}
+				case "-r":
+					options.recursive = true
+				case "-N":
+					options.newFiles = true
+				default:
+					usage["diff"]()
+					return
+				}
+				args = args[1:]
+			}
+			if len(args) != 2 {
+				usage["diff"]()
+				return
+			}
+			var out bytes.Buffer
+			differ := vfs.diff(&out, args[0], args[1], options)
+			if vfs.Status != 0 {
+				return
+			}
+			vfs.writeOutput(destination, out.Bytes())
+			if differ && vfs.Status == 0 {
+				vfs.Status = 1
+			}
+		},
+		"patch": func(args []string) {
+			options := patchOptions{fuzz: 2}
+			for len(args) > 1 && strings.HasPrefix(args[0], "-") {
+				option := args[0]
+				args = args[1:]
+				if option == "--dry-run" {
+					options.dryRun = true
+					continue
+				}
+				// The value may follow the flag directly, as in -p1.
+				flag, value := option[:min(2, len(option))], option[min(2, len(option)):]
+				if value == "" && len(args) > 1 {
+					value, args = args[0], args[1:]
+				}
+				number, err := strconv.Atoi(value)
+				if (flag != "-p" && flag != "-F") || err != nil || number < 0 {
+					usage["patch"]()
+					return
+				}
+				if flag == "-p" {
+					options.strip = number
+				} else {
+					options.fuzz = number
+				}
+			}
+			if len(args) != 1 && len(args) != 2 {
+				usage["patch"]()
+				return
+			}
+			vfs.patch(args[0], strings.Join(args[1:], ""), options)
+		},
+		"vcs": func(args []string) {
+			if len(args) == 0 {
+				usage["vcs"]()
+				return
+			}
+			switch sub, args := args[0], args[1:]; {
+			case sub == "init" && len(args) == 0:
+				vfs.vcsInit()
+			case sub == "add" && len(args) > 0:
+				vfs.vcsAdd(args)
+			case sub == "commit" && len(args) == 0:
+				vfs.vcsCommit("")
+			case sub == "commit" && len(args) >= 2 && args[0] == "-m":
+				vfs.vcsCommit(strings.Join(args[1:], " "))
+			case sub == "log" && len(args) == 0:
+				vfs.vcsLog()
+			case sub == "status" && len(args) == 0:
+				vfs.vcsStatus()
+			case sub == "diff" && len(args) > 0 && args[0] == "--staged":
+				vfs.vcsDiff(true, args[1:])
+			case sub == "diff":
+				vfs.vcsDiff(false, args)
+			case sub == "branch" && len(args) == 0:
+				vfs.vcsBranchList()
+			case sub == "branch" && len(args) == 2 && args[0] == "-d":
+				vfs.vcsBranchDelete(args[1])
+			case sub == "branch" && len(args) == 1:
+				vfs.vcsBranchCreate(args[0], "")
+			case sub == "branch" && len(args) == 2:
+				vfs.vcsBranchCreate(args[0], args[1])
+			case sub == "checkout" && len(args) == 1:
+				vfs.vcsCheckout(args[0], false)
+			case sub == "checkout" && len(args) == 2 && args[0] == "-b":
+				vfs.vcsCheckout(args[1], true)
+			case sub == "merge" && len(args) == 1:
+				vfs.vcsMerge(args[0])
+			default:
+				usage["vcs"]()
+			}
+		},
+		"vault": func(args []string) {
+			switch {
+			case len(args) == 1 && args[0] == "list":
+				vfs.vaultList()
+			case len(args) == 2 && args[0] == "lock":
+				vfs.vaultLock(args[1])
+			case (len(args) == 2 || len(args) == 3) && args[0] == "create":
+				vfs.vaultCreate(args[1], strings.Join(args[2:], ""))
+			case (len(args) == 2 || len(args) == 3) && args[0] == "unlock":
+				vfs.vaultUnlock(args[1], strings.Join(args[2:], ""))
+			default:
+				usage["vault"]()
+			}
+		},
+		"download": func(args []string) {
+			if len(args) != 2 {
+				usage["download"]()
+				return
+			}
+			vfs.atPath(args[0], func(name string) {
+				vfs.download(name, args[1])
+			})
+		},
+		"sync": func(args []string) {
+			if len(args) != 0 {
+				usage["sync"]()
+				return
+			}
+			vfs.sync()
+		},
+		"mount": func(args []string) {
+			fresh, readOnly := false, false
+			var imagePath string
+			for _, arg := range args {
+				switch arg {
+				case "-new":
+					fresh = true
+				case "-readonly":
+					readOnly = true
+				default:
+					if imagePath != "" {
+						usage["mount"]()
+						return
+					}
+					imagePath = arg
+				}
+			}
+			if imagePath == "" {
+				if fresh || readOnly {
+					usage["mount"]()
+					return
+				}
+				vfs.showMount()
+				return
+			}
+			vfs.mount(imagePath, fresh, readOnly)
+		},
+		"source": func(args []string) {
+			if len(args) != 1 {
+				usage["source"]()
+				return
+			}
+			vfs.atPath(args[0], func(name string) {
+				vfs.source(vfs.CommandMap, name)
+			})
+		},
+		"env": func(args []string) {
+			if len(args) != 0 {
+				usage["env"]()
+				return
+			}
+			vfs.env()
+		},
 	}
 }
 
@@ -278,6 +1062,10 @@ func (vfs *VFS) initAdmin() {
 		GroupPerms: []int{0, -1},
 	}
 	vfs.CurrentUser = user
+	if vfs.Users == nil {
+		vfs.Users = make(map[string]*User)
+	}
+	vfs.Users[user.Name] = user
 }
 func (vfs *VFS) clear() {
 	cmd := exec.Command("cmd", "/c", "cls") //Windows example, its tested
@@ -293,71 +1081,84 @@ func (vfs *VFS) mv(target string, destination string) {
 	dir, dirExists := vfs.CurrentDir.SubDirs[destination]
 
 	if !fileExists {
-		fmt.Println("File not found:", target)
+		vfs.fail("File not found:", target)
 		return
 	}
 
 	if !dirExists {
-		fmt.Println("Destination directory not found:", destination)
+		vfs.fail("Destination directory not found:", destination)
 		return
 	}
 
 	if !checkOverlap(vfs.CurrentDir.SubDirs[destination].WritePermission, vfs.CurrentUser.GroupPerms) {
-		fmt.Println("You do not have write permissions in the destination directory.")
+		vfs.deny("rename", target, "You do not have write permissions in the destination directory.")
+		return
+	}
+	if vfs.isLocked(dir) {
+		vfs.fail("Destination directory", destination, "is a locked vault")
 		return
 	}
 	if !checkOverlap(file.WritePermission, vfs.CurrentUser.GroupPerms) {
-		fmt.Println("You do not have write permissions to move this file.")
+		vfs.deny("rename", target, "You do not have write permissions to move this file.")
 		return
 	}
 
 	if _, exists := dir.Files[file.Name]; exists {
-		fmt.Printf("File %s already exists in %s\n", file.Name, destination)
+		vfs.fail("File", file.Name, "already exists in", destination)
+		return
+	}
+	if !vfs.movable(vfs.CurrentDir.Path, dir.Path, file) {
 		return
 	}
 
 	dir.Files[file.Name] = file
 	delete(vfs.CurrentDir.Files, target)
+	from, to := joinPath(vfs.CurrentDir.Path, target), joinPath(dir.Path, file.Name)
+	vfs.setUndo(vfs.undoMove(from, to))
+	vfs.logMutation(journalRecord{Op: "rename", Path: from, To: to})
 	fmt.Printf("File %s moved to %s\n", target, destination)
 }
 
 func (vfs *VFS) sethost(name string) {
 	vfs.MachineName = name
-}
-
-func (vfs *VFS) roothistory() {
-	for value := range vfs.Root.History {
-		fmt.Println("Value:", vfs.Root.History[value])
-	}
-}
-func (vfs *VFS) history() {
-	for value := range vfs.CurrentDir.History {
-		fmt.Println("Value:", vfs.CurrentDir.History[value])
-	}
+	vfs.logMutation(journalRecord{Op: "sethost", Content: name})
 }
 
 func (vfs *VFS) cd(directory string) {
+	if strings.Contains(directory, "/") {
+		dir, err := vfs.resolveDir(directory)
+		if err != nil {
+			vfs.fail(err)
+			return
+		}
+		vfs.CurrentDir = dir
+		return
+	}
 	if directory == ".." {
 		if vfs.CurrentDir.Parent == "" {
-			fmt.Println("Cannot backtrack, currently at root")
+			vfs.fail("Cannot backtrack, currently at root")
 			return
 		} else {
 			parentDir := vfs.findDirectoryByPath(vfs.CurrentDir.Parent)
 			if parentDir != nil {
 				vfs.CurrentDir = parentDir
 			} else {
-				fmt.Println("Error: Parent directory not found!")
+				vfs.fail("Error: Parent directory not found!")
 				return
 			}
 		}
 	} else {
-		dir, exists := vfs.CurrentDir.SubDirs[directory]
+		dir, exists := vfs.subDir(vfs.CurrentDir, directory)
 		if !exists {
-			fmt.Println("Directory", directory, "does not exist")
+			vfs.fail("Directory", directory, "does not exist")
 			return
 		}
 		if !checkOverlap(dir.ReadPermission, vfs.CurrentUser.GroupPerms) {
-			fmt.Println("You do not have read permissions to access this directory.")
+			vfs.fail("You do not have read permissions to access this directory.")
+			return
+		}
+		if vfs.isLocked(dir) {
+			vfs.fail("Directory", directory, "is a locked vault")
 			return
 		}
 		vfs.CurrentDir = dir
@@ -367,11 +1168,11 @@ func (vfs *VFS) cd(directory string) {
 func (vfs *VFS) call(name string) {
 	file, exists := vfs.CurrentDir.Files[name]
 	if !exists {
-		fmt.Println("File ", name, "Dose not exist")
+		vfs.fail("File ", name, "Dose not exist")
 		return
 	}
 	if !file.Executable {
-		fmt.Println("File", file.Name, "Dose not have Executable permissions")
+		vfs.fail("File", file.Name, "Dose not have Executable permissions")
 		return
 	}
 	parts := strings.Split(file.Name, ".")
@@ -380,58 +1181,35 @@ func (vfs *VFS) call(name string) {
 	}
 }
 
-func (vfs *VFS) ls() (filearray []string, dirarray []string) {
-	if !checkOverlap(vfs.CurrentDir.ReadPermission, vfs.CurrentUser.GroupPerms) {
-		fmt.Println("You do not have read permissions to list this directory.")
-		return filearray, dirarray
-	}
-
-	for _, file := range vfs.CurrentDir.Files {
-		filearray = append(filearray, file.Name)
-		fmt.Println("file:", file.Name)
-	}
-	for _, dir := range vfs.CurrentDir.SubDirs {
-		dirarray = append(dirarray, dir.Name)
-		fmt.Println("dir:", dir.Name)
-	}
-	return filearray, dirarray
-}
-
 func (vfs *VFS) touch(name string) {
 	if !checkOverlap(vfs.CurrentDir.WritePermission, vfs.CurrentUser.GroupPerms) {
-		fmt.Println("You do not have write permissions to create files in this directory.")
+		vfs.deny("create", name, "You do not have write permissions to create files in this directory.")
 		return
 	}
 	if _, exists := vfs.CurrentDir.Files[name]; exists {
-		fmt.Println("File", name, "already exists")
+		vfs.fail("File", name, "already exists")
 		return
 	}
 	pattern := regexp.MustCompile(`^[a-z0-9]+(?:-[a-z0-9]+)*\.[a-z0-9]+$`)
 	isvalid := pattern.MatchString(name)
 	if !isvalid {
-		fmt.Println("Name dose not match expected format <1-9,a-z.1-9.a-z")
+		vfs.fail("Name dose not match expected format <1-9,a-z.1-9.a-z")
 		return
 	}
-
-	file := &File{
-		Name:             name,
-		Content:          "",
-		Size:             0,
-		CreatedAt:        time.Now(),
-		UpdatedAt:        time.Now(),
-		ReadPermission:   []int{1, -1},
-		WritePermission:  []int{1, -1},
-		ModifyPermission: []int{1, -1},
-		Executable:       false,
+	if !vfs.chargeable(vfs.CurrentDir.Path, vfs.userName(), 0, 1) {
+		return
 	}
+
+	file := vfs.newFile(name)
 	vfs.CurrentDir.Files[name] = file
+	vfs.logFileCreate(vfs.CurrentDir, file)
 	fmt.Println("Created file", name)
 }
 
 func (vfs *VFS) nvim(name string) {
 
 	if name == "." && checkOverlap(vfs.CurrentUser.GroupPerms, vfs.CurrentDir.ReadPermission) {
-		arr1, arr2 := vfs.ls()
+		arr1, arr2 := entries(vfs.CurrentDir)
 		arr1 = append([]string{"Files: "}, arr1...)
 		arr1 = append(arr1, "\n")
 		arr2 = append([]string{"Directories: "}, arr2...)
@@ -439,54 +1217,80 @@ func (vfs *VFS) nvim(name string) {
 		combined := append(arr1, arr2...)
 		_, err := openInEditor(strings.Join(combined, "\n"), false)
 		if err != nil {
-			fmt.Println("Error has occured whilst open nvim %w", err)
+			vfs.fail("Error has occured whilst open nvim:", err)
 		}
 		return
 	}
 
 	if _, exists := vfs.CurrentDir.Files[name]; !exists {
 		vfs.touch(name)
+		if _, exists := vfs.CurrentDir.Files[name]; !exists {
+			return
+		}
 	}
 	if !checkOverlap(vfs.CurrentUser.GroupPerms, vfs.CurrentDir.Files[name].ReadPermission) {
-		fmt.Println("You do not have the apropriate Read permissions")
+		vfs.fail("You do not have the apropriate Read permissions")
+		return
+	}
+	content, err := vfs.readFile(vfs.CurrentDir.Files[name])
+	if err != nil {
+		vfs.fail("Error reading", name+":", err)
 		return
 	}
-	editedText, err := openInEditor(vfs.CurrentDir.Files[name].Content, true)
+	vfs.accessed(vfs.CurrentDir.Files[name])
+	editedText, err := openInEditor(string(content), true)
 	if err != nil {
-		fmt.Println("Error has occured whilst open nvim %w", err)
+		vfs.fail("Error has occured whilst open nvim:", err)
 		return
 	}
 
 	if !checkOverlap(vfs.CurrentUser.GroupPerms, vfs.CurrentDir.Files[name].WritePermission) {
-		fmt.Println("You do not have the apropriate Write permissions")
+		vfs.deny("write", name, "You do not have the apropriate Write permissions")
 		return
 	}
-	vfs.CurrentDir.Files[name].Content = *editedText
+	if !vfs.chargeable(vfs.CurrentDir.Path, vfs.CurrentDir.Files[name].Owner, len(*editedText)-vfs.CurrentDir.Files[name].Size, 0) {
+		return
+	}
+	vfs.keepVersion(vfs.CurrentDir.Files[name], vfs.userName())
+	if err := vfs.writeFile(vfs.CurrentDir.Files[name], []byte(*editedText)); err != nil {
+		vfs.fail("Error writing", name+":", err)
+		return
+	}
+	vfs.logFileWrite(vfs.CurrentDir, vfs.CurrentDir.Files[name])
 }
 
 func (vfs *VFS) mkdir(name string) {
 	if !checkOverlap(vfs.CurrentDir.WritePermission, vfs.CurrentUser.GroupPerms) {
-		fmt.Println("You do not have write permissions to create directories in this directory.")
+		vfs.deny("mkdir", name, "You do not have write permissions to create directories in this directory.")
 		return
 	}
 	if _, exists := vfs.CurrentDir.SubDirs[name]; exists {
-		fmt.Println("Directory", name, "already exists")
+		vfs.fail("Directory", name, "already exists")
+		return
+	}
+	if !vfs.chargeable(vfs.CurrentDir.Path, vfs.userName(), 0, 1) {
 		return
 	}
 
+	now := time.Now()
 	dir := &Directory{
 		Name:             name,
 		Files:            make(map[string]*File),
 		SubDirs:          make(map[string]*Directory),
 		Parent:           vfs.CurrentDir.Path,
-		CreatedAt:        time.Now(),
-		Path:             vfs.CurrentDir.Path + "/" + name,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+		ChangedAt:        now,
+		AccessedAt:       now,
+		Path:             joinPath(vfs.CurrentDir.Path, name),
 		ReadPermission:   []int{1, -1},
 		WritePermission:  []int{1, -1},
 		ModifyPermission: []int{1, -1},
+		Owner:            vfs.userName(),
 	}
 
 	vfs.CurrentDir.SubDirs[name] = dir
+	vfs.logDirCreate(dir)
 	fmt.Println("Directory created:", name)
 }
 
@@ -494,7 +1298,7 @@ func (vfs *VFS) addPerms(name string, permission string, id int) {
 	permission = strings.ToLower(permission)
 	file, exists := vfs.CurrentDir.Files[name]
 	if !exists {
-		fmt.Println("File not found:", name)
+		vfs.fail("File not found:", name)
 		return
 	} else {
 		if checkOverlap(vfs.CurrentUser.GroupPerms, vfs.CurrentDir.Files[name].ModifyPermission) {
@@ -510,12 +1314,16 @@ func (vfs *VFS) addPerms(name string, permission string, id int) {
 				} else if id == 1 {
 					vfs.CurrentDir.Files[name].Executable = true
 				} else {
-					fmt.Println("For executable permission, value must be between 0-1")
+					vfs.fail("For executable permission, value must be between 0-1")
 					return
 				}
 			} else {
-				fmt.Println("Permission dose not exist")
+				vfs.fail("Permission dose not exist")
+				return
 			}
+			vfs.logFileChmod(vfs.CurrentDir, file)
+		} else {
+			vfs.deny("chmod", name, "You do not have modify permissions for this file.")
 		}
 	}
 }
@@ -524,7 +1332,7 @@ func (vfs *VFS) remPerms(name string, permission string, id int) {
 	permission = strings.ToLower(permission)
 	file, exists := vfs.CurrentDir.Files[name]
 	if !exists {
-		fmt.Println("File not found:", name)
+		vfs.fail("File not found:", name)
 		return
 	} else {
 		if checkOverlap(vfs.CurrentUser.GroupPerms, vfs.CurrentDir.Files[name].ModifyPermission) {
@@ -535,7 +1343,8 @@ func (vfs *VFS) remPerms(name string, permission string, id int) {
 					file.WritePermission = temp
 					temp = nil
 				} else {
-					fmt.Println("Permission ID dose not exist in writePermissions[]")
+					vfs.fail("Permission ID dose not exist in writePermissions[]")
+					return
 				}
 			} else if permission == "read" {
 				exists, index := getIndex(file.ReadPermission, []int{id})
@@ -544,7 +1353,8 @@ func (vfs *VFS) remPerms(name string, permission string, id int) {
 					file.ReadPermission = temp
 					temp = nil
 				} else {
-					fmt.Println("Permission ID dose not exist in ReadPermissions[]")
+					vfs.fail("Permission ID dose not exist in ReadPermissions[]")
+					return
 				}
 			} else if permission == "modify" {
 				exists, index := getIndex(file.ModifyPermission, []int{id})
@@ -553,9 +1363,16 @@ func (vfs *VFS) remPerms(name string, permission string, id int) {
 					file.ModifyPermission = temp
 					temp = nil
 				} else {
-					fmt.Println("Permission ID dose not exist in ModifyPermissions[]")
+					vfs.fail("Permission ID dose not exist in ModifyPermissions[]")
+					return
 				}
+			} else {
+				vfs.fail("Permission dose not exist")
+				return
 			}
+			vfs.logFileChmod(vfs.CurrentDir, file)
+		} else {
+			vfs.deny("chmod", name, "You do not have modify permissions for this file.")
 		}
 	}
 }
@@ -564,23 +1381,31 @@ func (vfs *VFS) pwd() {
 	fmt.Println("CWD:", vfs.CurrentDir.Name)
 }
 
-func (vfs *VFS) cat(name string) *string {
+// cat returns the contents of name, or nil if it cannot be read. An empty
+// file gives an empty, non-nil slice.
+func (vfs *VFS) cat(name string) []byte {
 	file, exists := vfs.CurrentDir.Files[name]
 	if !exists {
-		fmt.Println("File not found:", name)
+		vfs.fail("File not found:", name)
 		return nil
 	}
 	if checkOverlap(vfs.CurrentDir.Files[name].ReadPermission, vfs.CurrentUser.GroupPerms) {
-		return &file.Content
+		content, err := vfs.readFile(file)
+		if err != nil {
+			vfs.fail("Error reading", name+":", err)
+			return nil
+		}
+		vfs.accessed(file)
+		return content
 	} else {
-		fmt.Println("You do not share any permission ID's with this file. READ==FALSE")
+		vfs.fail("You do not share any permission ID's with this file. READ==FALSE")
 	}
 	return nil
 }
 
 func (vfs *VFS) fill(amount uint16) {
 	if !checkOverlap(vfs.CurrentDir.WritePermission, vfs.CurrentUser.GroupPerms) {
-		fmt.Println("You do not have write permissions to fill this directory.")
+		vfs.fail("You do not have write permissions to fill this directory.")
 		return
 	}
 	for i := uint16(0); i < amount; i++ {
@@ -594,27 +1419,49 @@ func (vfs *VFS) echo(name string, content string, appendToFile bool) {
 	file, exists := vfs.CurrentDir.Files[name]
 	if exists {
 		if !checkOverlap(file.WritePermission, vfs.CurrentUser.GroupPerms) {
-			fmt.Println("You do not share any group permissions to WRITE to this file.")
+			vfs.deny("write", name, "You do not share any group permissions to WRITE to this file.")
 			return
 		}
 	} else {
 		if !checkOverlap(vfs.CurrentDir.WritePermission, vfs.CurrentUser.GroupPerms) {
-			fmt.Println("You do not have write permissions to create files in this directory.")
+			vfs.deny("create", name, "You do not have write permissions to create files in this directory.")
 			return
 		}
+	}
+	size := len(content)
+	if exists && appendToFile {
+		size += file.Size
+	}
+	if !vfs.writable(vfs.CurrentDir, name, size) {
+		return
+	}
+	if !exists {
 		vfs.touch(name)
 		file = vfs.CurrentDir.Files[name]
 		if file == nil {
-			fmt.Println("Error creating file")
+			vfs.fail("Error creating file")
 			return
 		}
 	}
 
+	vfs.keepVersion(file, vfs.userName())
 	if appendToFile {
-		file.Content += content
+		offset := file.Size
+		if err := vfs.appendFile(file, []byte(content)); err != nil {
+			vfs.fail("Error writing", name+":", err)
+			return
+		}
+		vfs.logFileWriteAt(vfs.CurrentDir, file, []byte(content), offset)
 		fmt.Println("Content appended to file:", name)
 	} else {
-		file.Content = content
+		if exists {
+			vfs.setUndo(vfs.undoOverwrite("echo", vfs.CurrentDir, file))
+		}
+		if err := vfs.writeFile(file, []byte(content)); err != nil {
+			vfs.fail("Error writing", name+":", err)
+			return
+		}
+		vfs.logFileWrite(vfs.CurrentDir, file)
 		fmt.Println("Content written to file:", name)
 	}
 }
@@ -623,18 +1470,85 @@ func (vfs *VFS) whoami() *string {
 	return &vfs.CurrentUser.Name
 }
 
-func (vfs *VFS) rm(name string) {
-	file, exists := vfs.CurrentDir.Files[name]
-	if !exists {
-		fmt.Println("File not found:", name)
+// rm moves a file, or with recursive a directory, to the trash. With force
+// it is deleted for good instead.
+func (vfs *VFS) rm(name string, recursive bool, force bool) {
+	target := joinPath(vfs.CurrentDir.Path, name)
+	file, isFile := vfs.CurrentDir.Files[name]
+	dir, isDir := vfs.CurrentDir.SubDirs[name]
+	switch {
+	case isFile:
+		if !checkOverlap(file.WritePermission, vfs.CurrentUser.GroupPerms) {
+			vfs.deny("delete", name, "You do not have write permissions to delete this file.")
+			return
+		}
+	case isDir:
+		if !recursive {
+			vfs.fail("rm: cannot remove", name+": is a directory, use -r")
+			return
+		}
+		if !checkOverlap(dir.WritePermission, vfs.CurrentUser.GroupPerms) || !checkOverlap(vfs.CurrentDir.WritePermission, vfs.CurrentUser.GroupPerms) {
+			vfs.deny("delete", name, "You do not have write permissions to delete this directory.")
+			return
+		}
+	default:
+		vfs.fail("File not found:", name)
 		return
 	}
-	if !checkOverlap(file.WritePermission, vfs.CurrentUser.GroupPerms) {
-		fmt.Println("You do not have write permissions to delete this file.")
+
+	if !force {
+		// The trash is saved in the clear, so nothing inside a vault may
+		// go there.
+		if vault := vfs.unlockedVault(target); vault != nil {
+			vfs.fail("rm: cannot move", name, "to the trash from inside the vault", vault.Path+", use -f to delete it")
+			return
+		}
+		vfs.trashRemove(target)
+		fmt.Println("Moved to trash:", name)
 		return
 	}
-	delete(vfs.CurrentDir.Files, name)
-	fmt.Println("File deleted:", name)
+	vfs.detach(target)
+	if isFile {
+		vfs.setUndo(vfs.undoRemove(vfs.CurrentDir, file))
+	} else {
+		vfs.dropUndo()
+		vfs.releaseDir(dir)
+	}
+	vfs.logMutation(journalRecord{Op: "delete", Path: target})
+	if isFile {
+		fmt.Println("File deleted:", name)
+	} else {
+		fmt.Println("Directory deleted:", name)
+	}
+}
+
+func (vfs *VFS) env() {
+	names := make([]string, 0, len(vfs.Env))
+	for name := range vfs.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s=%q\n", name, vfs.Env[name])
+	}
+}
+
+// usageStatus wraps every usage message so that printing it also marks the
+// command as failed with status 2.
+func (vfs *VFS) usageStatus(usage UsageMap) UsageMap {
+	wrapped := make(UsageMap, len(usage))
+	for name, print := range usage {
+		wrapped[name] = func() {
+			print()
+			vfs.Status = 2
+		}
+	}
+	return wrapped
+}
+
+func (vfs *VFS) fail(a ...any) {
+	fmt.Println(a...)
+	vfs.Status = 1
 }
 
 func (vfs *VFS) date() {
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Codec compresses chunks of file data as they are written to the image and
+// restores them when they are read back.
+type Codec interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+const defaultCodec = "gzip"
+
+// noCompression is the Compression attribute that turns off compression a
+// parent directory would otherwise apply. An empty attribute inherits it.
+const noCompression = "none"
+
+var codecs = map[string]Codec{
+	"gzip":  gzipCodec{},
+	"flate": flateCodec{},
+}
+
+func codecNames() string {
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func getCodec(name string) (Codec, error) {
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q, expected one of: %s", name, codecNames())
+	}
+	return codec, nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Compress(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+type flateCodec struct{}
+
+func (flateCodec) Compress(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer, err := flate.NewWriter(&buffer, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (flateCodec) Decompress(data []byte) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+func effectiveCodec(own string, inherited string) string {
+	switch own {
+	case "":
+		return inherited
+	case noCompression:
+		return ""
+	default:
+		return own
+	}
+}
+
+// dirCodec returns the codec files in dir are compressed with, and the
+// directory the setting comes from.
+func (vfs *VFS) dirCodec(dir *Directory) (string, string) {
+	for dir != nil {
+		if dir.Compression != "" {
+			return effectiveCodec(dir.Compression, ""), dir.Path
+		}
+		if dir.Parent == "" {
+			break
+		}
+		dir = vfs.findDirectoryByPath(dir.Parent)
+	}
+	return "", ""
+}
+
+// blobCodecs decides which codec each chunk is saved with. A chunk shared
+// by files with different settings is compressed if any of them asks for it.
+func (vfs *VFS) blobCodecs() map[string]string {
+	chosen := make(map[string]string)
+	var walk func(dir *Directory, inherited string)
+	walk = func(dir *Directory, inherited string) {
+		inherited = effectiveCodec(dir.Compression, inherited)
+		for _, file := range dir.Files {
+			codec := effectiveCodec(file.Compression, inherited)
+			if codec == "" {
+				continue
+			}
+			for _, hash := range fileHashes(file) {
+				if current, ok := chosen[hash]; hash != "" && (!ok || codec < current) {
+					chosen[hash] = codec
+				}
+			}
+		}
+		for _, sub := range dir.SubDirs {
+			walk(sub, inherited)
+		}
+	}
+	for _, root := range vfs.roots() {
+		walk(root, "")
+	}
+	return chosen
+}
+
+// setCompression sets the Compression attribute of the file or directory at
+// target. Directories pass it on to everything below them that does not
+// have a setting of its own.
+func (vfs *VFS) setCompression(target string, codec string) {
+	if codec != noCompression {
+		if _, err := getCodec(codec); err != nil {
+			vfs.fail(err)
+			return
+		}
+	}
+	dir, file, err := vfs.lookup(target)
+	if err != nil {
+		vfs.fail(err)
+		return
+	}
+	var targetPath string
+	if file != nil {
+		if !checkOverlap(file.WritePermission, vfs.CurrentUser.GroupPerms) {
+			vfs.deny("compress", joinPath(dir.Path, file.Name), "You do not have write permissions for", target)
+			return
+		}
+		file.Compression = codec
+		targetPath = joinPath(dir.Path, file.Name)
+	} else {
+		if !checkOverlap(dir.WritePermission, vfs.CurrentUser.GroupPerms) {
+			vfs.deny("compress", dir.Path, "You do not have write permissions for", target)
+			return
+		}
+		dir.Compression = codec
+		targetPath = dir.Path
+	}
+	vfs.logMutation(journalRecord{Op: "compress", Path: targetPath, Content: codec})
+	if codec == noCompression {
+		fmt.Println("Compression disabled for", targetPath)
+	} else {
+		fmt.Println("Compression set to", codec, "for", targetPath)
+	}
+}
+
+// stat prints what is known about the file or directory at target,
+// including how well its data compresses.
+func (vfs *VFS) stat(target string) {
+	dir, file, err := vfs.lookup(target)
+	if err != nil {
+		vfs.fail(err)
+		return
+	}
+	if file == nil {
+		codec, from := vfs.dirCodec(dir)
+		fmt.Println("  Path:", dir.Path)
+		fmt.Println("  Type: directory")
+		fmt.Println("  Mode:", vfs.mode(findNode{dir: dir}))
+		fmt.Println("  Owner:", ownerName(dir.Owner))
+		printPermissions(dir.ReadPermission, dir.WritePermission, dir.ModifyPermission)
+		fmt.Printf("  Entries: %d files, %d directories\n", len(dir.Files), len(dir.SubDirs))
+		printCompression(codec, from, dir.Path)
+		printTimes(dir.AccessedAt, dir.UpdatedAt, dir.ChangedAt, dir.CreatedAt)
+		return
+	}
+
+	codec, from := vfs.dirCodec(dir)
+	if file.Compression != "" {
+		codec, from = effectiveCodec(file.Compression, ""), joinPath(dir.Path, file.Name)
+	}
+	allocated := vfs.allocatedSize(file)
+	stored := allocated
+	if codec != "" {
+		stored = 0
+		for _, hash := range file.Blocks {
+			packed, err := vfs.blobs.pack(hash, codec)
+			if err != nil {
+				vfs.fail("Error compressing", target+":", err)
+				return
+			}
+			stored += len(packed)
+		}
+	}
+
+	fmt.Println("  Path:", joinPath(dir.Path, file.Name))
+	fmt.Println("  Type: file")
+	fmt.Println("  Mode:", vfs.mode(findNode{file: file, dir: dir}))
+	fmt.Println("  Owner:", ownerName(file.Owner))
+	printPermissions(file.ReadPermission, file.WritePermission, file.ModifyPermission)
+	fmt.Printf("  Size: %d  Allocated: %d  Stored: %d  Chunks: %d\n", file.Size, allocated, stored, len(file.Blocks))
+	printCompression(codec, from, joinPath(dir.Path, file.Name))
+	if stored > 0 {
+		fmt.Printf("  Ratio: %.2fx\n", float64(allocated)/float64(stored))
+	}
+	if file.ModifiedBy != "" {
+		fmt.Println("  Modified by:", file.ModifiedBy)
+	}
+	fmt.Println("  Versions:", len(file.Versions))
+	printTimes(file.AccessedAt, file.UpdatedAt, file.ChangedAt, file.CreatedAt)
+}
+
+func printPermissions(read []int, write []int, modify []int) {
+	fmt.Printf("  Read: %v  Write: %v  Modify: %v\n", read, write, modify)
+}
+
+func printTimes(access time.Time, modify time.Time, change time.Time, birth time.Time) {
+	for _, stamp := range []struct {
+		label string
+		t     time.Time
+	}{{"Access", access}, {"Modify", modify}, {"Change", change}, {"Birth", birth}} {
+		fmt.Printf("  %s: %s\n", stamp.label, stamp.t.Local().Format(statTimeFormat))
+	}
+}
+
+func ownerName(owner string) string {
+	if owner == "" {
+		return "-"
+	}
+	return owner
+}
+
+func printCompression(codec string, from string, self string) {
+	switch {
+	case codec == "":
+		fmt.Println("  Compression: none")
+	case from == self:
+		fmt.Println("  Compression:", codec)
+	default:
+		fmt.Println("  Compression:", codec, "(from "+from+")")
+	}
+}
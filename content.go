@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+)
+
+// File data is kept in fixed size chunks, stored in the blob store and
+// listed by hash in Blocks. An empty hash is a hole that reads as zeros, and
+// the last chunk may be shorter than chunkSize; Size is the logical length of
+// the file either way.
+const chunkSize = 16 * 1024
+
+func (vfs *VFS) readFile(file *File) ([]byte, error) {
+	return vfs.readAt(file, 0, file.Size)
+}
+
+// readAt returns up to length bytes of file starting at offset.
+func (vfs *VFS) readAt(file *File, offset int, length int) ([]byte, error) {
+	offset = max(0, min(offset, file.Size))
+	end := min(file.Size, offset+max(0, length))
+
+	out := make([]byte, end-offset)
+	for pos := offset; pos < end; {
+		index, within := pos/chunkSize, pos%chunkSize
+		n := min(chunkSize-within, end-pos)
+		if index < len(file.Blocks) {
+			chunk, err := vfs.blobs.get(file.Blocks[index])
+			if err != nil {
+				return nil, err
+			}
+			if within < len(chunk) {
+				copy(out[pos-offset:pos-offset+n], chunk[within:])
+			}
+		}
+		pos += n
+	}
+	return out, nil
+}
+
+// writeAt writes data into file at offset, leaving a hole between the old
+// end of the file and offset if it lies past it. Chunks shared with other
+// files are copied rather than changed in place.
+func (vfs *VFS) writeAt(file *File, data []byte, offset int) error {
+	if offset < 0 {
+		return fmt.Errorf("negative offset %d", offset)
+	}
+	end := offset + len(data)
+	blocks := file.Blocks
+	for len(blocks)*chunkSize < end {
+		blocks = append(blocks, "")
+	}
+
+	for pos := offset; pos < end; {
+		index, within := pos/chunkSize, pos%chunkSize
+		n := min(chunkSize-within, end-pos)
+		piece := data[pos-offset : pos-offset+n]
+		pos += n
+		old := blocks[index]
+		if old == "" && isZero(piece) {
+			continue
+		}
+		chunk, err := vfs.blobs.get(old)
+		if err != nil {
+			return err
+		}
+		updated := make([]byte, max(len(chunk), within+n))
+		copy(updated, chunk)
+		copy(updated[within:], piece)
+		blocks[index] = vfs.blobs.put(updated)
+		vfs.blobs.release(old)
+	}
+
+	file.Blocks = blocks
+	file.Size = max(file.Size, end)
+	file.modified(time.Now())
+	return nil
+}
+
+func (vfs *VFS) appendFile(file *File, data []byte) error {
+	return vfs.writeAt(file, data, file.Size)
+}
+
+// writeFile replaces the whole contents of file with data.
+func (vfs *VFS) writeFile(file *File, data []byte) error {
+	if err := vfs.truncate(file, 0); err != nil {
+		return err
+	}
+	return vfs.writeAt(file, data, 0)
+}
+
+// truncate cuts file down to size, or extends it with a hole.
+func (vfs *VFS) truncate(file *File, size int) error {
+	if size < 0 {
+		return fmt.Errorf("negative size %d", size)
+	}
+	if size < file.Size {
+		keep := (size + chunkSize - 1) / chunkSize
+		if tail := size % chunkSize; tail != 0 && keep <= len(file.Blocks) {
+			old := file.Blocks[keep-1]
+			chunk, err := vfs.blobs.get(old)
+			if err != nil {
+				return err
+			}
+			if len(chunk) > tail {
+				file.Blocks[keep-1] = vfs.blobs.put(chunk[:tail])
+				vfs.blobs.release(old)
+			}
+		}
+		for keep < len(file.Blocks) {
+			last := len(file.Blocks) - 1
+			vfs.blobs.release(file.Blocks[last])
+			file.Blocks = file.Blocks[:last]
+		}
+		if len(file.Blocks) == 0 {
+			file.Blocks = nil
+		}
+	}
+	file.Size = size
+	file.modified(time.Now())
+	return nil
+}
+
+// releaseFile gives up the chunks of a file that is being deleted, along
+// with those of its history.
+func (vfs *VFS) releaseFile(file *File) {
+	for _, hash := range fileHashes(file) {
+		vfs.blobs.release(hash)
+	}
+	file.Blocks, file.Versions = nil, nil
+}
+
+// allocatedSize is the number of bytes of data file refers to, not counting
+// holes. Chunks shared with other files are counted in full.
+func (vfs *VFS) allocatedSize(file *File) int {
+	total := 0
+	for _, hash := range file.Blocks {
+		total += vfs.blobs.size(hash)
+	}
+	return total
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func splitChunks(data []byte) [][]byte {
+	var chunks [][]byte
+	for start := 0; start < len(data); start += chunkSize {
+		chunk := data[start:min(start+chunkSize, len(data))]
+		if isZero(chunk) {
+			chunks = append(chunks, nil)
+		} else {
+			chunks = append(chunks, bytes.Clone(chunk))
+		}
+	}
+	return chunks
+}
+
+// writableFile returns name in the current directory, creating it if needed,
+// provided the current user may write to it.
+func (vfs *VFS) writableFile(name string) *File {
+	file, exists := vfs.CurrentDir.Files[name]
+	if !exists {
+		vfs.touch(name)
+		file = vfs.CurrentDir.Files[name]
+		if file == nil {
+			return nil
+		}
+	}
+	if !checkOverlap(file.WritePermission, vfs.CurrentUser.GroupPerms) {
+		vfs.deny("write", name, "You do not have write permissions for", name)
+		return nil
+	}
+	return file
+}
+
+func (vfs *VFS) truncateFile(name string, size int) {
+	if !vfs.writable(vfs.CurrentDir, name, size) {
+		return
+	}
+	file := vfs.writableFile(name)
+	if file == nil {
+		return
+	}
+	vfs.keepVersion(file, vfs.userName())
+	if err := vfs.truncate(file, size); err != nil {
+		vfs.fail("Error truncating", name+":", err)
+		return
+	}
+	vfs.logFileTruncate(vfs.CurrentDir, file)
+}
+
+// storeFile writes data to name in dir, creating the file if needed, for
+// files the shell manages itself. It does not check permissions, and leaves
+// the file alone if it already holds data.
+func (vfs *VFS) storeFile(dir *Directory, name string, data []byte) (*File, error) {
+	file, exists := dir.Files[name]
+	if !exists {
+		file = vfs.newFile(name)
+		dir.Files[name] = file
+		vfs.logFileCreate(dir, file)
+	} else if content, err := vfs.readFile(file); err == nil && bytes.Equal(content, data) {
+		return file, nil
+	}
+	vfs.keepVersion(file, vfs.userName())
+	if err := vfs.writeFile(file, data); err != nil {
+		return nil, err
+	}
+	vfs.logFileWrite(dir, file)
+	return file, nil
+}
+
+// upload copies a file from the host into the VFS byte for byte.
+func (vfs *VFS) upload(hostPath string, name string) {
+	data, err := os.ReadFile(hostPath)
+	if err != nil {
+		vfs.fail("Error reading", hostPath+":", err)
+		return
+	}
+	if !vfs.writable(vfs.CurrentDir, name, len(data)) {
+		return
+	}
+	file := vfs.writableFile(name)
+	if file == nil {
+		return
+	}
+	vfs.keepVersion(file, vfs.userName())
+	if err := vfs.writeFile(file, data); err != nil {
+		vfs.fail("Error writing", name+":", err)
+		return
+	}
+	vfs.logFileWrite(vfs.CurrentDir, file)
+	fmt.Println("Uploaded", len(data), "bytes to", name)
+}
+
+// storeOutput replaces the contents of name in the current directory with
+// the output of a command, creating the file if needed.
+func (vfs *VFS) storeOutput(name string, output []byte) {
+	if !vfs.writable(vfs.CurrentDir, name, len(output)) {
+		return
+	}
+	file := vfs.writableFile(name)
+	if file == nil {
+		return
+	}
+	vfs.keepVersion(file, vfs.userName())
+	if err := vfs.writeFile(file, output); err != nil {
+		vfs.fail("Error writing", name+":", err)
+		return
+	}
+	vfs.logFileWrite(vfs.CurrentDir, file)
+	fmt.Println("Output written to", name)
+}
+
+func (vfs *VFS) download(name string, hostPath string) {
+	content := vfs.cat(name)
+	if content == nil {
+		return
+	}
+	if err := os.WriteFile(hostPath, content, 0o644); err != nil {
+		vfs.fail("Error writing", hostPath+":", err)
+		return
+	}
+	fmt.Println("Downloaded", len(content), "bytes to", hostPath)
+}
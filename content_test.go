@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// pattern returns n bytes that differ from chunk to chunk, so that no two
+// chunks of it are shared.
+func pattern(n int, seed byte) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = seed + byte(i/chunkSize) + byte(i%251)
+	}
+	return data
+}
+
+func TestWriteAtAndReadAt(t *testing.T) {
+	tests := []struct {
+		name       string
+		initial    int // bytes of pattern written first
+		offset     int
+		data       []byte
+		wantSize   int
+		wantBlocks int
+		wantHoles  int
+	}{
+		{"empty", 0, 0, nil, 0, 0, 0},
+		{"within one chunk", 10, 3, []byte("abc"), 10, 1, 0},
+		{"exactly one chunk", 0, 0, pattern(chunkSize, 1), chunkSize, 1, 0},
+		{"across a boundary", chunkSize, chunkSize - 2, []byte("abcd"), chunkSize + 2, 2, 0},
+		{"appended", 5, 5, pattern(2*chunkSize, 2), 2*chunkSize + 5, 3, 0},
+		{"past the end leaves a hole", 10, 3 * chunkSize, []byte("x"), 3*chunkSize + 1, 4, 2},
+		{"zeros stay a hole", 0, 0, make([]byte, 2*chunkSize), 2 * chunkSize, 2, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vfs := newTestVFS(t)
+			file := vfs.newFile("f")
+			want := pattern(test.initial, 7)
+			if err := vfs.writeAt(file, want, 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := vfs.writeAt(file, test.data, test.offset); err != nil {
+				t.Fatal(err)
+			}
+			if end := test.offset + len(test.data); end > len(want) {
+				want = append(want, make([]byte, end-len(want))...)
+			}
+			copy(want[test.offset:], test.data)
+
+			holes := 0
+			for _, hash := range file.Blocks {
+				if hash == "" {
+					holes++
+				}
+			}
+			if file.Size != test.wantSize || len(file.Blocks) != test.wantBlocks || holes != test.wantHoles {
+				t.Errorf("file has size %d in %d blocks with %d holes, want %d in %d with %d",
+					file.Size, len(file.Blocks), holes, test.wantSize, test.wantBlocks, test.wantHoles)
+			}
+			got, err := vfs.readFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Error("file does not read back what was written")
+			}
+			// A read that starts and ends mid-chunk.
+			if got, _ := vfs.readAt(file, test.wantSize/3, test.wantSize/2); !bytes.Equal(got, want[test.wantSize/3:test.wantSize/3+test.wantSize/2]) {
+				t.Error("readAt does not return the middle of the file")
+			}
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       int
+		wantBlocks int
+	}{
+		{"to zero", 0, 0},
+		{"mid-chunk", chunkSize + 100, 2},
+		{"on a boundary", chunkSize, 1},
+		{"unchanged", 3 * chunkSize, 3},
+		{"extended with a hole", 5 * chunkSize, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vfs := newTestVFS(t)
+			file := vfs.newFile("f")
+			data := pattern(3*chunkSize, 1)
+			if err := vfs.writeFile(file, data); err != nil {
+				t.Fatal(err)
+			}
+			if err := vfs.truncate(file, test.size); err != nil {
+				t.Fatal(err)
+			}
+			if file.Size != test.size || len(file.Blocks) != test.wantBlocks {
+				t.Errorf("file has size %d in %d blocks, want %d in %d", file.Size, len(file.Blocks), test.size, test.wantBlocks)
+			}
+			want := append(data[:min(test.size, len(data))], make([]byte, max(0, test.size-len(data)))...)
+			if got, _ := vfs.readFile(file); !bytes.Equal(got, want) {
+				t.Error("truncated file does not read back its first bytes")
+			}
+			// Growing it again reads zeros, not the bytes cut off.
+			if err := vfs.truncate(file, 3*chunkSize); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := vfs.readAt(file, test.size, chunkSize); test.size < 3*chunkSize && !isZero(got) {
+				t.Error("bytes cut off by truncate came back")
+			}
+		})
+	}
+}
+
+func TestChunksLoadLazily(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "image.vpg")
+	vfs := newTestVFS(t)
+	vfs.ImagePath, vfs.StoreName = imagePath, "page"
+	data := pattern(3*chunkSize+10, 3)
+	writeTestFile(t, vfs, "/big.bin", string(data))
+	if err := vfs.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := openImage(imagePath, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := loaded.findFileByPath("/big.bin")
+	lazy := func() int {
+		n := 0
+		for _, hash := range file.Blocks {
+			if _, ok := loaded.blobs.lazy[hash]; ok {
+				n++
+			}
+		}
+		return n
+	}
+	if n := lazy(); n != 4 {
+		t.Fatalf("the page store left %d of the file's 4 chunks to load later", n)
+	}
+	if got, err := loaded.readAt(file, chunkSize, 10); err != nil || !bytes.Equal(got, data[chunkSize:chunkSize+10]) {
+		t.Fatalf("reading the second chunk returned %v, %v", got, err)
+	}
+	if n := lazy(); n != 3 {
+		t.Errorf("reading one chunk loaded %d", 4-n)
+	}
+	if got, _ := loaded.readFile(file); !bytes.Equal(got, data) {
+		t.Error("the file does not read back from the page store")
+	}
+}
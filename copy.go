@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// cp copies source to destination, or into it when it is a directory. The
+// copy shares its chunks with the original until either of them is written
+// to, so copying takes the same time whatever the size of the data.
+func (vfs *VFS) cp(source string, destination string, recursive bool) {
+	srcDirPath, srcName := path.Split(source)
+	srcDir, err := vfs.resolveDir(srcDirPath)
+	if err != nil {
+		vfs.fail(err)
+		return
+	}
+	file, isFile := srcDir.Files[srcName]
+	var dir *Directory
+	if !isFile {
+		if dir, err = vfs.resolveDir(source); err != nil {
+			// Locked vaults cannot be entered, but can be copied as they are.
+			if dir, err = vfs.resolveVault(source); err != nil {
+				vfs.fail("File not found:", source)
+				return
+			}
+		}
+		if !recursive {
+			vfs.fail("cp: -r not specified; omitting directory", source)
+			return
+		}
+	}
+
+	var destDir *Directory
+	var destName string
+	if target, err := vfs.resolveDir(destination); err == nil {
+		destDir = target
+		if isFile {
+			destName = file.Name
+		} else {
+			destName = dir.Name
+		}
+	} else {
+		destDirPath, name := path.Split(destination)
+		if destDir, err = vfs.resolveDir(destDirPath); err != nil {
+			vfs.fail(err)
+			return
+		}
+		destName = name
+	}
+	if destName == "" || destName == "/" {
+		vfs.fail("cp: invalid destination", destination)
+		return
+	}
+	if !checkOverlap(destDir.WritePermission, vfs.CurrentUser.GroupPerms) {
+		vfs.deny("copy", joinPath(destDir.Path, destName), "You do not have write permissions in the destination directory.")
+		return
+	}
+
+	srcPath := joinPath(srcDir.Path, srcName)
+	destPath := joinPath(destDir.Path, destName)
+	if isFile {
+		if !checkOverlap(file.ReadPermission, vfs.CurrentUser.GroupPerms) {
+			vfs.fail("You do not have read permissions for", source)
+			return
+		}
+		if srcPath == destPath {
+			vfs.fail("cp:", source, "and", destination, "are the same file")
+			return
+		}
+		if _, exists := destDir.SubDirs[destName]; exists {
+			vfs.fail("cp: cannot overwrite directory", destPath, "with a file")
+			return
+		}
+		if existing, exists := destDir.Files[destName]; exists && !checkOverlap(existing.WritePermission, vfs.CurrentUser.GroupPerms) {
+			vfs.deny("copy", destPath, "You do not have write permissions for", destPath)
+			return
+		}
+	} else {
+		srcPath = dir.Path
+		if !checkOverlap(dir.ReadPermission, vfs.CurrentUser.GroupPerms) {
+			vfs.fail("You do not have read permissions for", source)
+			return
+		}
+		if destPath == srcPath || strings.HasPrefix(destPath, srcPath+"/") || srcPath == "/" {
+			vfs.fail("cp: cannot copy a directory,", source+", into itself")
+			return
+		}
+		if _, exists := destDir.SubDirs[destName]; exists {
+			vfs.fail("Directory", destPath, "already exists")
+			return
+		}
+		if _, exists := destDir.Files[destName]; exists {
+			vfs.fail("cp: cannot overwrite file", destPath, "with a directory")
+			return
+		}
+	}
+
+	if !vfs.withinQuota(destDir.Path, copyCharges(file, dir, destDir.Files[destName])) {
+		return
+	}
+	vfs.copyPath(srcPath, destPath)
+	vfs.logMutation(journalRecord{Op: "copy", Path: srcPath, To: destPath})
+	fmt.Println("Copied", source, "to", destPath)
+}
+
+// copyPath replaces whatever is at to with a copy of the file or directory
+// at from, without checking permissions.
+func (vfs *VFS) copyPath(from string, to string) {
+	destDirPath, destName := path.Split(to)
+	if file := vfs.findFileByPath(from); file != nil {
+		dest := vfs.mkdirAll(destDirPath)
+		if existing, exists := dest.Files[destName]; exists {
+			vfs.releaseFile(existing)
+		}
+		dest.Files[destName] = vfs.copyFile(file, destName)
+		return
+	}
+	if dir := vfs.findDirectoryByPath(from); dir != nil && from != "/" {
+		dest := vfs.mkdirAll(destDirPath)
+		if existing, exists := dest.SubDirs[destName]; exists {
+			vfs.releaseDir(existing)
+		}
+		dest.SubDirs[destName] = vfs.copyDir(dir, destName, dest.Path)
+	}
+}
+
+func (vfs *VFS) copyFile(file *File, name string) *File {
+	copied := *file
+	copied.Name = name
+	copied.CreatedAt = time.Now()
+	copied.UpdatedAt, copied.ChangedAt, copied.AccessedAt = copied.CreatedAt, copied.CreatedAt, copied.CreatedAt
+	copied.ReadPermission = slices.Clone(file.ReadPermission)
+	copied.WritePermission = slices.Clone(file.WritePermission)
+	copied.ModifyPermission = slices.Clone(file.ModifyPermission)
+	copied.Blocks = slices.Clone(file.Blocks)
+	for _, hash := range copied.Blocks {
+		vfs.blobs.retain(hash)
+	}
+	copied.Versions = vfs.copyVersions(file)
+	return &copied
+}
+
+// copyDir copies the tree under dir. Vaults are copied locked, with the
+// same key.
+func (vfs *VFS) copyDir(dir *Directory, name string, parentPath string) *Directory {
+	copied := *dir
+	copied.Name = name
+	copied.Parent = parentPath
+	copied.Path = joinPath(parentPath, name)
+	copied.CreatedAt = time.Now()
+	copied.UpdatedAt, copied.ChangedAt, copied.AccessedAt = copied.CreatedAt, copied.CreatedAt, copied.CreatedAt
+	copied.ReadPermission = slices.Clone(dir.ReadPermission)
+	copied.WritePermission = slices.Clone(dir.WritePermission)
+	copied.ModifyPermission = slices.Clone(dir.ModifyPermission)
+	copied.Files = make(map[string]*File, len(dir.Files))
+	copied.SubDirs = make(map[string]*Directory, len(dir.SubDirs))
+	if dir.Vault != nil {
+		if !vfs.isLocked(dir) {
+			if err := vfs.resealVault(dir); err != nil {
+				fmt.Fprintln(os.Stderr, "Error sealing", dir.Path+":", err)
+			}
+		}
+		vault := *dir.Vault
+		copied.Vault = &vault
+		return &copied
+	}
+	for fileName, file := range dir.Files {
+		copied.Files[fileName] = vfs.copyFile(file, fileName)
+	}
+	for subName, sub := range dir.SubDirs {
+		copied.SubDirs[subName] = vfs.copyDir(sub, subName, copied.Path)
+	}
+	return &copied
+}
+
+// releaseDir gives up the chunks of every file under a directory that is
+// being deleted.
+func (vfs *VFS) releaseDir(dir *Directory) {
+	walkFiles(dir, vfs.releaseFile)
+}
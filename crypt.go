@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Encrypted images are wrapped in an envelope:
+//
+//	magic      [8]byte  "VFSCRYPT"
+//	iterations uint32   PBKDF2-HMAC-SHA256 iterations
+//	salt       [16]byte
+//	nonce      [12]byte
+//	ciphertext          AES-256-GCM of the image, with the fields above as
+//	                    additional data
+const (
+	cryptMagic       = "VFSCRYPT"
+	passphraseEnv    = "VFS_PASSPHRASE"
+	pbkdf2Iterations = 600_000
+	saltSize         = 16
+	keySize          = 32
+	cryptHeaderSize  = len(cryptMagic) + 4 + saltSize
+)
+
+// sealKey is a key derived from a passphrase, along with what is needed to
+// derive it again.
+type sealKey struct {
+	salt       []byte
+	iterations int
+	aead       cipher.AEAD
+}
+
+func newSealKey(passphrase string) (*sealKey, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	return deriveKey(passphrase, salt, pbkdf2Iterations)
+}
+
+func deriveKey(passphrase string, salt []byte, iterations int) (*sealKey, error) {
+	if iterations <= 0 {
+		return nil, fmt.Errorf("invalid key derivation iterations %d", iterations)
+	}
+	block, err := aes.NewCipher(pbkdf2SHA256([]byte(passphrase), salt, iterations, keySize))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealKey{salt: salt, iterations: iterations, aead: aead}, nil
+}
+
+// pbkdf2SHA256 is PBKDF2 (RFC 8018) with HMAC-SHA256 as the PRF.
+func pbkdf2SHA256(password []byte, salt []byte, iterations int, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, block))
+		u := prf.Sum(nil)
+		t := bytes.Clone(u)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// seal encrypts plaintext under a fresh nonce, which it prepends.
+func (k *sealKey) seal(plaintext []byte, additional []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return k.aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func (k *sealKey) open(sealed []byte, additional []byte) ([]byte, error) {
+	size := k.aead.NonceSize()
+	if len(sealed) < size {
+		return nil, fmt.Errorf("encrypted data is truncated")
+	}
+	plaintext, err := k.aead.Open(nil, sealed[:size], sealed[size:], additional)
+	if err != nil {
+		return nil, fmt.Errorf("wrong key or corrupt data")
+	}
+	return plaintext, nil
+}
+
+func (k *sealKey) header() []byte {
+	header := make([]byte, 0, cryptHeaderSize)
+	header = append(header, cryptMagic...)
+	header = binary.BigEndian.AppendUint32(header, uint32(k.iterations))
+	return append(header, k.salt...)
+}
+
+func (k *sealKey) sealEnvelope(plaintext []byte) ([]byte, error) {
+	header := k.header()
+	sealed, err := k.seal(plaintext, header)
+	if err != nil {
+		return nil, err
+	}
+	return append(header, sealed...), nil
+}
+
+func isEnvelope(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(cryptMagic))
+}
+
+// openEnvelope decrypts an envelope with the key derived from passphrase,
+// returning the key too so the image can be sealed again with it.
+func openEnvelope(data []byte, passphrase string) ([]byte, *sealKey, error) {
+	if len(data) < cryptHeaderSize || !isEnvelope(data) {
+		return nil, nil, fmt.Errorf("not an encrypted image")
+	}
+	header := data[:cryptHeaderSize]
+	iterations := int(binary.BigEndian.Uint32(header[len(cryptMagic):]))
+	salt := bytes.Clone(header[len(cryptMagic)+4:])
+	key, err := deriveKey(passphrase, salt, iterations)
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, err := key.open(data[cryptHeaderSize:], header)
+	if err != nil {
+		return nil, nil, fmt.Errorf("wrong passphrase or corrupt image")
+	}
+	return plaintext, key, nil
+}
+
+// imagePassphrase returns the passphrase for the image from the
+// environment, or asks for it on the terminal. confirm asks twice, for a
+// passphrase that is being set.
+func imagePassphrase(confirm bool) (string, error) {
+	if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+	passphrase, err := readNewSecret("Image passphrase: ", confirm)
+	if err != nil {
+		return "", fmt.Errorf("%w (or set %s)", err, passphraseEnv)
+	}
+	return passphrase, nil
+}
+
+func readNewSecret(prompt string, confirm bool) (string, error) {
+	secret, err := readSecret(prompt)
+	if err != nil || !confirm {
+		return secret, err
+	}
+	again, err := readSecret("Repeat " + strings.ToLower(prompt[:1]) + prompt[1:])
+	if err != nil {
+		return "", err
+	}
+	if again != secret {
+		return "", fmt.Errorf("the passphrases do not match")
+	}
+	return secret, nil
+}
+
+// readSecret reads a line from the terminal with echo turned off. It uses
+// the terminal rather than standard input so that it works while a script
+// is being read from stdin.
+func readSecret(prompt string) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("no terminal to read the passphrase from")
+	}
+	defer tty.Close()
+
+	stty := func(args ...string) error {
+		cmd := exec.Command("stty", args...)
+		cmd.Stdin = tty
+		return cmd.Run()
+	}
+	if stty("-echo") == nil {
+		defer func() {
+			stty("echo")
+			fmt.Fprintln(tty)
+		}()
+	}
+	fmt.Fprint(tty, prompt)
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	secret := strings.TrimRight(line, "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("the passphrase is empty")
+	}
+	return secret, nil
+}
+
+// encryptImage turns encryption of the whole image on or off and saves it.
+// Turning it on removes the backup, which still holds the plaintext image.
+func (vfs *VFS) encryptImage(enable bool) error {
+	if vfs.ReadOnly {
+		return fmt.Errorf("image %s is mounted read-only", vfs.ImagePath)
+	}
+	var key *sealKey
+	if enable {
+		if vfs.StoreName == "page" {
+			return fmt.Errorf("the page store cannot encrypt images, save with the gob or json store")
+		}
+		passphrase, err := imagePassphrase(true)
+		if err != nil {
+			return err
+		}
+		if key, err = newSealKey(passphrase); err != nil {
+			return err
+		}
+	}
+	// Keep the old key until the image has been saved with the new one.
+	previous := vfs.imageKey
+	vfs.imageKey = key
+	if err := vfs.save(); err != nil {
+		vfs.imageKey = previous
+		return err
+	}
+	if enable {
+		if err := os.Remove(vfs.ImagePath + ".bak"); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove the plaintext backup: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// Test vectors from RFC 7914, section 11, and the commonly used ones
+	// for "password" and "salt".
+	tests := []struct {
+		password, salt string
+		iterations     int
+		keyLen         int
+		want           string
+	}{
+		{"password", "salt", 1, 32, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, 32, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, 32, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwd", "salt", 1, 64, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, 64, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+	for _, test := range tests {
+		got := hex.EncodeToString(pbkdf2SHA256([]byte(test.password), []byte(test.salt), test.iterations, test.keyLen))
+		if got != test.want {
+			t.Errorf("pbkdf2SHA256(%q, %q, %d) = %s, want %s", test.password, test.salt, test.iterations, got, test.want)
+		}
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	key, err := deriveKey("secret", []byte("0123456789abcdef"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := deriveKey("other", []byte("0123456789abcdef"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := key.seal([]byte("plaintext"), []byte("header"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := key.seal([]byte("plaintext"), []byte("header"))
+	if bytes.Equal(sealed, again) {
+		t.Error("sealing twice reused the nonce")
+	}
+	flipped := bytes.Clone(sealed)
+	flipped[len(flipped)-1] ^= 1
+
+	tests := []struct {
+		name       string
+		key        *sealKey
+		sealed     []byte
+		additional string
+		wantErr    bool
+	}{
+		{"round trip", key, sealed, "header", false},
+		{"wrong key", other, sealed, "header", true},
+		{"wrong additional data", key, sealed, "HEADER", true},
+		{"tampered", key, flipped, "header", true},
+		{"truncated", key, sealed[:5], "header", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plaintext, err := test.key.open(test.sealed, []byte(test.additional))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("open returned error %v", err)
+			}
+			if !test.wantErr && string(plaintext) != "plaintext" {
+				t.Errorf("open returned %q", plaintext)
+			}
+		})
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	key, err := deriveKey("secret", []byte("0123456789abcdef"), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := key.sealEnvelope([]byte("image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEnvelope(envelope) {
+		t.Fatal("the envelope does not start with its magic")
+	}
+	lowered := bytes.Clone(envelope)
+	lowered[len(cryptMagic)+3]-- // fewer iterations derive another key
+
+	tests := []struct {
+		name       string
+		data       []byte
+		passphrase string
+		wantErr    bool
+	}{
+		{"round trip", envelope, "secret", false},
+		{"wrong passphrase", envelope, "Secret", true},
+		{"iterations changed", lowered, "secret", true},
+		{"not an envelope", []byte("VFSIMAGE and more"), "secret", true},
+		{"header only", envelope[:cryptHeaderSize], "secret", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plaintext, opened, err := openEnvelope(test.data, test.passphrase)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("openEnvelope returned error %v", err)
+			}
+			if test.wantErr {
+				return
+			}
+			if string(plaintext) != "image" || opened.iterations != 1000 || !bytes.Equal(opened.salt, key.salt) {
+				t.Errorf("openEnvelope returned %q with %d iterations", plaintext, opened.iterations)
+			}
+		})
+	}
+}
+
+func TestEncryptedImageRoundTrip(t *testing.T) {
+	t.Setenv(passphraseEnv, "image passphrase")
+	imagePath := filepath.Join(t.TempDir(), "image.gob")
+	vfs, err := openImage(imagePath, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vfs.CommandMap = GetCommands(vfs, GetUsage())
+	writeTestFile(t, vfs, "/secret.txt", "topsecretcontent")
+	if err := vfs.encryptImage(true); err != nil {
+		t.Fatal(err)
+	}
+	vfs.closeJournal()
+
+	image, err := os.ReadFile(imagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEnvelope(image) || bytes.Contains(image, []byte("topsecretcontent")) {
+		t.Fatal("the saved image is not encrypted")
+	}
+	loaded, err := openImage(imagePath, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := readTestFile(t, loaded, "/secret.txt"); got != "topsecretcontent" {
+		t.Errorf("the decrypted image holds %q", got)
+	}
+
+	t.Setenv(passphraseEnv, "wrong passphrase")
+	if _, err := openImage(imagePath, false, true); err == nil {
+		t.Error("the image opened with the wrong passphrase")
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+// diffOp is one line of an edit script: kept (' '), deleted ('-') or
+// inserted ('+').
+type diffOp struct {
+	Kind byte
+	Line string
+}
+
+// splitLines splits text into lines that keep their "\n", so that a last
+// line without one can be told apart.
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns the shortest edit script that turns a into b, found with
+// Myers' O(ND) algorithm. Each step only saves the diagonals it can reach,
+// so the trace takes O(D²) memory rather than O((N+M)D).
+func diffLines(a []string, b []string) []diffOp {
+	n, m := len(a), len(b)
+	limit := n + m
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	var trace [][]int
+
+	for d := 0; d <= limit; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(a, b, trace)
+			}
+		}
+	}
+	return nil
+}
+
+// backtrack walks the saved frontiers of diffLines back from the end to
+// recover the edit script. The frontier saved at step d holds diagonals -d-1
+// to d+1.
+func backtrack(a []string, b []string, trace [][]int) []diffOp {
+	var ops []diffOp
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		offset := d + 1
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, diffOp{' ', a[x]})
+		}
+		if d == 0 {
+			break
+		}
+		if x == prevX {
+			y--
+			ops = append(ops, diffOp{'+', b[y]})
+		} else {
+			x--
+			ops = append(ops, diffOp{'-', a[x]})
+		}
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// hunk is a run of changes with the lines of context around them. Starts
+// are 1-based, as in unified diffs.
+type hunk struct {
+	OldStart, OldLines int
+	NewStart, NewLines int
+	Ops                []diffOp
+}
+
+// diffHunks groups an edit script into hunks with up to context unchanged
+// lines before and after each change. Changes closer than twice that share a
+// hunk.
+func diffHunks(ops []diffOp, context int) []hunk {
+	var hunks []hunk
+	oldLine, newLine := 1, 1
+	for i := 0; i < len(ops); {
+		if ops[i].Kind == ' ' {
+			oldLine++
+			newLine++
+			i++
+			continue
+		}
+		start := max(0, i-context)
+		for j := start; j < i; j++ {
+			oldLine--
+			newLine--
+		}
+		h := hunk{OldStart: oldLine, NewStart: newLine}
+		end := i
+		for end < len(ops) {
+			if ops[end].Kind != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(ops) && ops[run].Kind == ' ' {
+				run++
+			}
+			if run == len(ops) || run-end > 2*context {
+				end = min(end+context, run)
+				break
+			}
+			end = run
+		}
+		h.Ops = ops[start:end]
+		for _, op := range h.Ops {
+			if op.Kind != '+' {
+				h.OldLines++
+				oldLine++
+			}
+			if op.Kind != '-' {
+				h.NewLines++
+				newLine++
+			}
+		}
+		hunks = append(hunks, h)
+		i = end
+	}
+	return hunks
+}
+
+// hunkRange formats one side of a hunk header. An empty side names the line
+// before it, as diff does.
+func hunkRange(start int, lines int) string {
+	if lines == 0 {
+		start--
+	}
+	if lines == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, lines)
+}
+
+// writeUnified writes hunks as a unified diff between the files named from
+// and to.
+func writeUnified(w io.Writer, from string, to string, hunks []hunk) {
+	if len(hunks) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", from, to)
+	for _, h := range hunks {
+		fmt.Fprintf(w, "@@ -%s +%s @@\n", hunkRange(h.OldStart, h.OldLines), hunkRange(h.NewStart, h.NewLines))
+		for _, op := range h.Ops {
+			fmt.Fprintf(w, "%c%s", op.Kind, op.Line)
+			if !strings.HasSuffix(op.Line, "\n") {
+				fmt.Fprint(w, "\n\\ No newline at end of file\n")
+			}
+		}
+	}
+}
+
+// merge3 merges the changes from base to ours and from base to theirs. Where
+// both changed the same lines differently it keeps both between conflict
+// markers labelled with oursLabel and theirsLabel, and counts the conflict.
+func merge3(base []string, ours []string, theirs []string, oursLabel string, theirsLabel string) ([]string, int) {
+	toOurs, toTheirs := matches(diffLines(base, ours)), matches(diffLines(base, theirs))
+	var merged []string
+	conflicts := 0
+	i, o, t := 0, 0, 0
+	for i < len(base) || o < len(ours) || t < len(theirs) {
+		if i < len(base) && toOurs[i] == o && toTheirs[i] == t {
+			merged = append(merged, base[i])
+			i, o, t = i+1, o+1, t+1
+			continue
+		}
+		// Find the next base line both sides kept, and merge what lies
+		// before it.
+		j := i
+		for j < len(base) && (toOurs[j] < o || toTheirs[j] < t) {
+			j++
+		}
+		nextO, nextT := len(ours), len(theirs)
+		if j < len(base) {
+			nextO, nextT = toOurs[j], toTheirs[j]
+		}
+		baseChunk, oursChunk, theirsChunk := base[i:j], ours[o:nextO], theirs[t:nextT]
+		switch {
+		case slices.Equal(oursChunk, baseChunk):
+			merged = append(merged, theirsChunk...)
+		case slices.Equal(theirsChunk, baseChunk), slices.Equal(oursChunk, theirsChunk):
+			merged = append(merged, oursChunk...)
+		default:
+			conflicts++
+			merged = append(merged, "<<<<<<< "+oursLabel+"\n")
+			merged = append(merged, terminated(oursChunk)...)
+			merged = append(merged, "=======\n")
+			merged = append(merged, terminated(theirsChunk)...)
+			merged = append(merged, ">>>>>>> "+theirsLabel+"\n")
+		}
+		i, o, t = j, nextO, nextT
+	}
+	return merged, conflicts
+}
+
+// matches maps every line of the old side of an edit script that is kept to
+// its index on the new side, and every other line to -1.
+func matches(ops []diffOp) []int {
+	var mapping []int
+	newIndex := 0
+	for _, op := range ops {
+		switch op.Kind {
+		case ' ':
+			mapping = append(mapping, newIndex)
+			newIndex++
+		case '-':
+			mapping = append(mapping, -1)
+		case '+':
+			newIndex++
+		}
+	}
+	return mapping
+}
+
+// terminated makes sure the last of lines ends in "\n", so that a marker can
+// follow it.
+func terminated(lines []string) []string {
+	if len(lines) == 0 || strings.HasSuffix(lines[len(lines)-1], "\n") {
+		return lines
+	}
+	out := append([]string(nil), lines...)
+	out[len(out)-1] += "\n"
+	return out
+}
+
+// diffOptions are the flags of the diff command.
+type diffOptions struct {
+	context   int
+	recursive bool
+	newFiles  bool
+}
+
+const diffTimeFormat = "2006-01-02 15:04:05.000000000 -0700"
+
+// diff writes the differences between the files or, with recursive, the
+// directories at from and to to w, and reports whether there were any.
+func (vfs *VFS) diff(w io.Writer, from string, to string, options diffOptions) bool {
+	fromDir, fromFile, err := vfs.lookup(from)
+	if err != nil {
+		vfs.fail(err)
+		return false
+	}
+	toDir, toFile, err := vfs.lookup(to)
+	if err != nil {
+		vfs.fail(err)
+		return false
+	}
+	switch {
+	case fromFile != nil && toFile != nil:
+		return vfs.diffFiles(w, from, fromFile, to, toFile, options)
+	case fromFile == nil && toFile == nil && options.recursive:
+		return vfs.diffDirs(w, from, fromDir, to, toDir, options)
+	case fromFile == nil && toFile == nil:
+		vfs.fail("diff:", from, "and", to, "are directories, use -r")
+	default:
+		vfs.fail("diff: cannot compare a file with a directory")
+	}
+	return false
+}
+
+// diffFiles writes a unified diff of two files. A nil file stands for an
+// empty one that does not exist, for -N.
+func (vfs *VFS) diffFiles(w io.Writer, fromName string, from *File, toName string, to *File, options diffOptions) bool {
+	read := func(name string, file *File) ([]byte, string, bool) {
+		if file == nil {
+			return nil, time.Unix(0, 0).UTC().Format(diffTimeFormat), true
+		}
+		if !checkOverlap(file.ReadPermission, vfs.CurrentUser.GroupPerms) {
+			vfs.fail("You do not have read permissions for", name)
+			return nil, "", false
+		}
+		content, err := vfs.readFile(file)
+		if err != nil {
+			vfs.fail("Error reading", name+":", err)
+			return nil, "", false
+		}
+		vfs.accessed(file)
+		return content, file.UpdatedAt.Format(diffTimeFormat), true
+	}
+	old, oldTime, ok := read(fromName, from)
+	if !ok {
+		return false
+	}
+	updated, newTime, ok := read(toName, to)
+	if !ok || bytes.Equal(old, updated) {
+		return false
+	}
+	if bytes.IndexByte(old, 0) >= 0 || bytes.IndexByte(updated, 0) >= 0 {
+		fmt.Fprintf(w, "Binary files %s and %s differ\n", fromName, toName)
+		return true
+	}
+	hunks := diffHunks(diffLines(splitLines(string(old)), splitLines(string(updated))), options.context)
+	writeUnified(w, fromName+"\t"+oldTime, toName+"\t"+newTime, hunks)
+	return true
+}
+
+// diffDirs compares two directories entry by entry, descending into the
+// subdirectories both have.
+func (vfs *VFS) diffDirs(w io.Writer, fromName string, from *Directory, toName string, to *Directory, options diffOptions) bool {
+	for _, dir := range []*Directory{from, to} {
+		if !checkOverlap(dir.ReadPermission, vfs.CurrentUser.GroupPerms) {
+			vfs.fail("You do not have read permissions for", dir.Path)
+			return false
+		}
+	}
+	names := make(map[string]bool)
+	for _, dir := range []*Directory{from, to} {
+		for name := range dir.Files {
+			names[name] = true
+		}
+		for name, sub := range dir.SubDirs {
+			if !vfs.isLocked(sub) {
+				names[name] = true
+			}
+		}
+	}
+	differ := false
+	for _, name := range sortedKeys(names) {
+		fromPath, toPath := fromName+"/"+name, toName+"/"+name
+		fromFile, fromIsFile := from.Files[name]
+		toFile, toIsFile := to.Files[name]
+		fromSub, fromIsDir := from.SubDirs[name]
+		toSub, toIsDir := to.SubDirs[name]
+		header := fmt.Sprintf("diff -r -u %s %s\n", fromPath, toPath)
+		switch {
+		case fromIsFile && toIsFile:
+			var out bytes.Buffer
+			if vfs.diffFiles(&out, fromPath, fromFile, toPath, toFile, options) {
+				io.WriteString(w, header)
+				w.Write(out.Bytes())
+				differ = true
+			}
+		case fromIsDir && toIsDir:
+			differ = vfs.diffDirs(w, fromPath, fromSub, toPath, toSub, options) || differ
+		case (fromIsFile && toIsDir) || (fromIsDir && toIsFile):
+			fmt.Fprintf(w, "File %s is a %s while file %s is a %s\n", fromPath, kindOf(fromIsFile), toPath, kindOf(toIsFile))
+			differ = true
+		case options.newFiles && (fromIsFile || toIsFile):
+			io.WriteString(w, header)
+			vfs.diffFiles(w, fromPath, fromFile, toPath, toFile, options)
+			differ = true
+		case fromIsFile || fromIsDir:
+			fmt.Fprintf(w, "Only in %s: %s\n", fromName, name)
+			differ = true
+		default:
+			fmt.Fprintf(w, "Only in %s: %s\n", toName, name)
+			differ = true
+		}
+	}
+	return differ
+}
+
+func kindOf(isFile bool) string {
+	if isFile {
+		return "regular file"
+	}
+	return "directory"
+}
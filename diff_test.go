@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name  string
+		a, b  string
+		edits int // lines deleted or inserted by the shortest script
+	}{
+		{"equal", "a\nb\n", "a\nb\n", 0},
+		{"empty to lines", "", "a\nb\n", 2},
+		{"lines to empty", "a\nb\n", "", 2},
+		{"change in the middle", "a\nb\nc\n", "a\nx\nc\n", 2},
+		{"insert at the front", "b\nc\n", "a\nb\nc\n", 1},
+		{"missing newline", "a\nb", "a\nb\n", 2},
+		{"myers example", "a\nb\nc\na\nb\nb\na\n", "c\nb\na\nb\na\nc\n", 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := splitLines(test.a), splitLines(test.b)
+			ops := diffLines(a, b)
+			edits := 0
+			for _, op := range ops {
+				if op.Kind != ' ' {
+					edits++
+				}
+			}
+			if edits != test.edits {
+				t.Errorf("edit script makes %d edits, want %d", edits, test.edits)
+			}
+			old, updated := sides(ops)
+			if strings.Join(old, "") != test.a || strings.Join(updated, "") != test.b {
+				t.Errorf("edit script turns %q into %q, want %q into %q", strings.Join(old, ""), strings.Join(updated, ""), test.a, test.b)
+			}
+		})
+	}
+}
+
+func TestWriteUnified(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    string
+		context int
+		want    string
+	}{
+		{
+			name:    "no changes",
+			a:       "a\n",
+			b:       "a\n",
+			context: 3,
+			want:    "",
+		},
+		{
+			name:    "one change",
+			a:       "1\n2\n3\n4\n5\n",
+			b:       "1\n2\nthree\n4\n5\n",
+			context: 1,
+			want:    "--- a\n+++ b\n@@ -2,3 +2,3 @@\n 2\n-3\n+three\n 4\n",
+		},
+		{
+			name:    "separate hunks",
+			a:       "1\n2\n3\n4\n5\n6\n7\n",
+			b:       "one\n2\n3\n4\n5\n6\nseven\n",
+			context: 1,
+			want:    "--- a\n+++ b\n@@ -1,2 +1,2 @@\n-1\n+one\n 2\n@@ -6,2 +6,2 @@\n 6\n-7\n+seven\n",
+		},
+		{
+			name:    "close changes share a hunk",
+			a:       "1\n2\n3\n4\n",
+			b:       "one\n2\n3\nfour\n",
+			context: 1,
+			want:    "--- a\n+++ b\n@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n-4\n+four\n",
+		},
+		{
+			name:    "new file",
+			a:       "",
+			b:       "a\n",
+			context: 3,
+			want:    "--- a\n+++ b\n@@ -0,0 +1 @@\n+a\n",
+		},
+		{
+			name:    "no newline at end of file",
+			a:       "a\n",
+			b:       "a",
+			context: 3,
+			want:    "--- a\n+++ b\n@@ -1 +1 @@\n-a\n+a\n\\ No newline at end of file\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			writeUnified(&out, "a", "b", diffHunks(diffLines(splitLines(test.a), splitLines(test.b)), test.context))
+			if out.String() != test.want {
+				t.Errorf("got\n%s\nwant\n%s", out.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestMerge3(t *testing.T) {
+	tests := []struct {
+		name               string
+		base, ours, theirs string
+		want               string
+		conflicts          int
+	}{
+		{"only ours changed", "a\nb\n", "a\nB\n", "a\nb\n", "a\nB\n", 0},
+		{"only theirs changed", "a\nb\n", "a\nb\n", "A\nb\n", "A\nb\n", 0},
+		{"both made the same change", "a\nb\n", "a\nB\n", "a\nB\n", "a\nB\n", 0},
+		{"apart", "a\nb\nc\nd\n", "A\nb\nc\nd\n", "a\nb\nc\nD\n", "A\nb\nc\nD\n", 0},
+		{"same line", "a\nb\nc\n", "a\nours\nc\n", "a\ntheirs\nc\n", "a\n<<<<<<< ours\nours\n=======\ntheirs\n>>>>>>> theirs\nc\n", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			merged, conflicts := merge3(splitLines(test.base), splitLines(test.ours), splitLines(test.theirs), "ours", "theirs")
+			if got := strings.Join(merged, ""); got != test.want || conflicts != test.conflicts {
+				t.Errorf("merged to %q with %d conflicts, want %q with %d", got, conflicts, test.want, test.conflicts)
+			}
+		})
+	}
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// findNode is a file or directory find visits. Name is the path as find
+// prints it, built from the starting point it was given.
+type findNode struct {
+	name  string
+	abs   string
+	file  *File
+	dir   *Directory
+	depth int
+}
+
+func (node findNode) isDir() bool {
+	return node.file == nil
+}
+
+func (node findNode) size() int {
+	if node.isDir() {
+		return 0
+	}
+	return node.file.Size
+}
+
+func (node findNode) owner() string {
+	if node.isDir() {
+		return node.dir.Owner
+	}
+	return node.file.Owner
+}
+
+// modTime is when the node's contents last changed.
+func (node findNode) modTime() time.Time {
+	if node.isDir() {
+		return node.dir.UpdatedAt
+	}
+	return node.file.UpdatedAt
+}
+
+type findExpr func(node findNode) bool
+
+// findQuery is a parsed find expression with the options given among it.
+type findQuery struct {
+	expr     findExpr
+	maxDepth int
+	minDepth int
+	depth    bool
+	acts     bool
+	batches  []*findBatch
+}
+
+// findParser turns the arguments after the starting points of find into a
+// findQuery. Tests and actions are joined by an implied -and; -or, -not and
+// parentheses combine them as usual.
+type findParser struct {
+	vfs   *VFS
+	args  []string
+	query *findQuery
+}
+
+func (p *findParser) peek() string {
+	if len(p.args) == 0 {
+		return ""
+	}
+	return p.args[0]
+}
+
+func (p *findParser) next() string {
+	arg := p.peek()
+	if len(p.args) > 0 {
+		p.args = p.args[1:]
+	}
+	return arg
+}
+
+func (p *findParser) value(option string) (string, error) {
+	if len(p.args) == 0 {
+		return "", fmt.Errorf("missing argument to %s", option)
+	}
+	return p.next(), nil
+}
+
+func (p *findParser) parseOr() (findExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "-o" || p.peek() == "-or" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		first := left
+		left = func(node findNode) bool { return first(node) || right(node) }
+	}
+	return left, nil
+}
+
+func (p *findParser) parseAnd() (findExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek() {
+		case "", "-o", "-or", ")":
+			return left, nil
+		case "-a", "-and":
+			p.next()
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		first := left
+		left = func(node findNode) bool { return first(node) && right(node) }
+	}
+}
+
+func (p *findParser) parseNot() (findExpr, error) {
+	switch p.peek() {
+	case "!", "-not":
+		p.next()
+		inner, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(node findNode) bool { return !inner(node) }, nil
+	case "(":
+		p.next()
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return inner, nil
+	case "":
+		return nil, fmt.Errorf("expected an expression")
+	}
+	return p.parsePrimary()
+}
+
+func always(findNode) bool { return true }
+
+// compareNumber matches got against a find number: +N for more than N, -N
+// for less than N, N for exactly N.
+func compareNumber(spec string, got int64) (bool, error) {
+	sign := spec[:min(1, len(spec))]
+	if sign == "+" || sign == "-" {
+		spec = spec[1:]
+	}
+	want, err := strconv.ParseInt(spec, 10, 64)
+	if err != nil || want < 0 {
+		return false, fmt.Errorf("invalid number %q", spec)
+	}
+	switch sign {
+	case "+":
+		return got > want, nil
+	case "-":
+		return got < want, nil
+	}
+	return got == want, nil
+}
+
+// sizeUnits are the suffixes -size accepts. A size without one counts
+// 512-byte blocks, as find does.
+var sizeUnits = map[byte]int64{'c': 1, 'b': 512, 'k': 1024, 'M': 1024 * 1024, 'G': 1024 * 1024 * 1024}
+
+func (p *findParser) parsePrimary() (findExpr, error) {
+	option := p.next()
+	switch option {
+	case "-true":
+		return always, nil
+	case "-false":
+		return func(findNode) bool { return false }, nil
+	case "-maxdepth", "-mindepth":
+		value, err := p.value(option)
+		if err != nil {
+			return nil, err
+		}
+		depth, err := strconv.Atoi(value)
+		if err != nil || depth < 0 {
+			return nil, fmt.Errorf("invalid depth %q for %s", value, option)
+		}
+		if option == "-maxdepth" {
+			p.query.maxDepth = depth
+		} else {
+			p.query.minDepth = depth
+		}
+		return always, nil
+	case "-depth":
+		p.query.depth = true
+		return always, nil
+	case "-name", "-iname":
+		pattern, err := p.value(option)
+		if err != nil {
+			return nil, err
+		}
+		if option == "-iname" {
+			pattern = strings.ToLower(pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q", pattern)
+		}
+		return func(node findNode) bool {
+			name := path.Base(node.name)
+			if option == "-iname" {
+				name = strings.ToLower(name)
+			}
+			matched, _ := path.Match(pattern, name)
+			return matched
+		}, nil
+	case "-type":
+		kind, err := p.value(option)
+		if err != nil {
+			return nil, err
+		}
+		switch kind {
+		case "f":
+			return func(node findNode) bool { return !node.isDir() }, nil
+		case "d":
+			return findNode.isDir, nil
+		case "l":
+			// The tree has no symbolic links.
+			return func(findNode) bool { return false }, nil
+		}
+		return nil, fmt.Errorf("unknown type %q, expected f, d or l", kind)
+	case "-size":
+		spec, err := p.value(option)
+		if err != nil {
+			return nil, err
+		}
+		unit := int64(512)
+		if n := len(spec); n > 0 && sizeUnits[spec[n-1]] != 0 {
+			unit, spec = sizeUnits[spec[n-1]], spec[:n-1]
+		}
+		if _, err := compareNumber(spec, 0); err != nil {
+			return nil, fmt.Errorf("invalid size for -size")
+		}
+		return func(node findNode) bool {
+			// Sizes are rounded up to whole units.
+			matched, _ := compareNumber(spec, (int64(node.size())+unit-1)/unit)
+			return matched
+		}, nil
+	case "-mtime", "-mmin":
+		spec, err := p.value(option)
+		if err != nil {
+			return nil, err
+		}
+		period := 24 * time.Hour
+		if option == "-mmin" {
+			period = time.Minute
+		}
+		if _, err := compareNumber(spec, 0); err != nil {
+			return nil, fmt.Errorf("invalid age for %s", option)
+		}
+		now := time.Now()
+		return func(node findNode) bool {
+			matched, _ := compareNumber(spec, int64(now.Sub(node.modTime())/period))
+			return matched
+		}, nil
+	case "-newer":
+		reference, err := p.value(option)
+		if err != nil {
+			return nil, err
+		}
+		dir, file, err := p.vfs.lookup(reference)
+		if err != nil {
+			return nil, err
+		}
+		since := findNode{file: file, dir: dir}.modTime()
+		return func(node findNode) bool { return node.modTime().After(since) }, nil
+	case "-user":
+		user, err := p.value(option)
+		if err != nil {
+			return nil, err
+		}
+		return func(node findNode) bool { return ownerName(node.owner()) == user }, nil
+	case "-perm":
+		spec, err := p.value(option)
+		if err != nil {
+			return nil, err
+		}
+		return p.vfs.permTest(spec)
+	case "-print":
+		p.query.acts = true
+		return func(node findNode) bool {
+			fmt.Println(node.name)
+			return true
+		}, nil
+	case "-delete":
+		p.query.acts, p.query.depth = true, true
+		return p.vfs.findDelete, nil
+	case "-exec":
+		p.query.acts = true
+		return p.parseExec()
+	}
+	return nil, fmt.Errorf("unknown predicate %s", option)
+}
+
+// permTest parses -perm read|write|modify[:<id>] or -perm executable. With
+// an ID it matches entries that grant it that permission, and without one
+// entries that grant it to the current user.
+func (vfs *VFS) permTest(spec string) (findExpr, error) {
+	kind, id, hasID := strings.Cut(strings.ToLower(spec), ":")
+	if kind == "executable" && !hasID {
+		return func(node findNode) bool { return !node.isDir() && node.file.Executable }, nil
+	}
+	groups := vfs.CurrentUser.GroupPerms
+	if hasID {
+		n, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ID %q for -perm", id)
+		}
+		groups = []int{n}
+	}
+	permissions := func(node findNode) []int {
+		switch {
+		case node.isDir() && kind == "read":
+			return node.dir.ReadPermission
+		case node.isDir() && kind == "write":
+			return node.dir.WritePermission
+		case node.isDir():
+			return node.dir.ModifyPermission
+		case kind == "read":
+			return node.file.ReadPermission
+		case kind == "write":
+			return node.file.WritePermission
+		}
+		return node.file.ModifyPermission
+	}
+	if kind != "read" && kind != "write" && kind != "modify" {
+		return nil, fmt.Errorf("unknown permission %q, expected read, write, modify or executable", kind)
+	}
+	if hasID {
+		return func(node findNode) bool { return slices.Contains(permissions(node), groups[0]) }, nil
+	}
+	return func(node findNode) bool { return checkOverlap(permissions(node), groups) }, nil
+}
+
+// parseExec reads the command of -exec up to ; or +. With ; it runs once for
+// each entry, with {} standing for its path, and is true when the command
+// succeeds. With + it runs once at the end, with {} standing for all of
+// them.
+func (p *findParser) parseExec() (findExpr, error) {
+	var command []string
+	for {
+		if len(p.args) == 0 {
+			return nil, fmt.Errorf("missing ; or + after -exec")
+		}
+		arg := p.next()
+		if arg == ";" || (arg == "+" && len(command) > 0 && command[len(command)-1] == "{}") {
+			if len(command) == 0 {
+				return nil, fmt.Errorf("missing command after -exec")
+			}
+			if arg == ";" {
+				return func(node findNode) bool { return p.vfs.findExec(command, []string{node.name}) }, nil
+			}
+			batch := &findBatch{command: command}
+			p.query.batches = append(p.query.batches, batch)
+			return func(node findNode) bool {
+				batch.names = append(batch.names, node.name)
+				return true
+			}, nil
+		}
+		command = append(command, arg)
+	}
+}
+
+// findBatch is an -exec ... {} + command and the paths collected for it.
+type findBatch struct {
+	command []string
+	names   []string
+}
+
+// findExec runs command with {} replaced by names and reports whether it
+// succeeded.
+func (vfs *VFS) findExec(command []string, names []string) bool {
+	var args []string
+	for _, arg := range command {
+		if arg == "{}" {
+			args = append(args, names...)
+		} else {
+			args = append(args, strings.ReplaceAll(arg, "{}", strings.Join(names, " ")))
+		}
+	}
+	status := vfs.Status
+	execute(vfs, vfs.CommandMap, shellQuote(args))
+	succeeded := vfs.Status == 0
+	vfs.Status = status
+	return succeeded
+}
+
+// findDelete removes a file, or a directory once it is empty, moving it to
+// the trash as rm does.
+func (vfs *VFS) findDelete(node findNode) bool {
+	if node.abs == "/" {
+		vfs.fail("find: cannot delete /")
+		return false
+	}
+	if node.isDir() && (len(node.dir.Files) > 0 || len(node.dir.SubDirs) > 0) {
+		vfs.fail("find: cannot delete", node.name+": Directory not empty")
+		return false
+	}
+	status := vfs.Status
+	vfs.Status = 0
+	vfs.atPath(node.abs, func(name string) { vfs.rm(name, node.isDir(), false) })
+	succeeded := vfs.Status == 0
+	if succeeded {
+		vfs.Status = status
+	}
+	return succeeded
+}
+
+// findNodes lists the entries under start, each directory before its
+// contents or, with depthFirst, after them. Directories the current user
+// may not read are listed but not entered.
+func (vfs *VFS) findNodes(start string, maxDepth int, depthFirst bool) []findNode {
+	dir, file, err := vfs.lookup(start)
+	if err != nil {
+		vfs.fail("find:", err)
+		return nil
+	}
+	if file != nil {
+		return []findNode{{name: start, abs: joinPath(dir.Path, file.Name), file: file, dir: dir}}
+	}
+	var nodes []findNode
+	var walk func(dir *Directory, name string, depth int)
+	walk = func(dir *Directory, name string, depth int) {
+		node := findNode{name: name, abs: dir.Path, dir: dir, depth: depth}
+		if !depthFirst {
+			nodes = append(nodes, node)
+		}
+		switch {
+		case maxDepth >= 0 && depth >= maxDepth:
+		case !checkOverlap(dir.ReadPermission, vfs.CurrentUser.GroupPerms):
+			vfs.fail("find:", name+": Permission denied")
+		case vfs.isLocked(dir):
+		default:
+			prefix := strings.TrimSuffix(name, "/") + "/"
+			for _, fileName := range sortedKeys(dir.Files) {
+				nodes = append(nodes, findNode{name: prefix + fileName, abs: joinPath(dir.Path, fileName), file: dir.Files[fileName], dir: dir, depth: depth + 1})
+			}
+			for _, subName := range sortedKeys(dir.SubDirs) {
+				walk(dir.SubDirs[subName], prefix+subName, depth+1)
+			}
+		}
+		if depthFirst {
+			nodes = append(nodes, node)
+		}
+	}
+	walk(dir, start, 0)
+	return nodes
+}
+
+// find evaluates expression for everything under each of starts, printing
+// the entries it matches unless it has actions of its own.
+func (vfs *VFS) find(starts []string, expression []string) {
+	query := &findQuery{maxDepth: -1, expr: always}
+	if len(expression) > 0 {
+		parser := &findParser{vfs: vfs, args: expression, query: query}
+		expr, err := parser.parseOr()
+		if err == nil && len(parser.args) > 0 {
+			err = fmt.Errorf("unexpected %s", parser.args[0])
+		}
+		if err != nil {
+			vfs.fail("find:", err)
+			return
+		}
+		query.expr = expr
+	}
+	if len(starts) == 0 {
+		starts = []string{"."}
+	}
+	for _, start := range starts {
+		for _, node := range vfs.findNodes(start, query.maxDepth, query.depth) {
+			if node.depth < query.minDepth {
+				continue
+			}
+			if query.expr(node) && !query.acts {
+				fmt.Println(node.name)
+			}
+		}
+	}
+	for _, batch := range query.batches {
+		if len(batch.names) > 0 {
+			vfs.findExec(batch.command, batch.names)
+		}
+	}
+}
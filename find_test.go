@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindPredicates(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       string
+	}{
+		{"", ". ./README.md ./docs ./docs/notes.txt ./src ./src/main.go ./src/old.go ./src/lib ./src/lib/big.bin"},
+		{"-name *.go", "./src/main.go ./src/old.go"},
+		{"-iname readme.*", "./README.md"},
+		{"-type d", ". ./docs ./src ./src/lib"},
+		{"-type f -maxdepth 1", "./README.md"},
+		{"-mindepth 2 -type f", "./docs/notes.txt ./src/main.go ./src/old.go ./src/lib/big.bin"},
+		{"-size +1k", "./src/lib/big.bin"},
+		{"-size -2c -type f", "./docs/notes.txt"},
+		{"-size 10c", "./README.md"},
+		{"-mtime +5", "./src/old.go"},
+		{"-mmin -60 -type f", "./README.md ./docs/notes.txt ./src/main.go ./src/lib/big.bin"},
+		{"-newer src/old.go -name *.go", "./src/main.go"},
+		{"-perm executable", "./src/lib/big.bin"},
+		{"-user admin -type f -name *.md", "./README.md"},
+		{"-name *.go -o -name *.txt", "./docs/notes.txt ./src/main.go ./src/old.go"},
+		{"-type f ! -name *.go", "./README.md ./docs/notes.txt ./src/lib/big.bin"},
+		{"-type f -not \\( -name *.go -o -name *.md \\)", "./docs/notes.txt ./src/lib/big.bin"},
+		{"-depth -type d", "./docs ./src/lib ./src ."},
+		{"-false -o -name lib -print", "./src/lib"},
+	}
+	vfs := newTestVFS(t)
+	writeTestFile(t, vfs, "/p/README.md", "0123456789")
+	writeTestFile(t, vfs, "/p/src/main.go", "package main\n")
+	writeTestFile(t, vfs, "/p/src/old.go", "package old\n")
+	writeTestFile(t, vfs, "/p/src/lib/big.bin", strings.Repeat("x", 2000))
+	writeTestFile(t, vfs, "/p/docs/notes.txt", "")
+	vfs.findFileByPath("/p/src/old.go").UpdatedAt = time.Now().Add(-10 * 24 * time.Hour)
+	vfs.findFileByPath("/p/src/lib/big.bin").Executable = true
+	run(vfs, "cd /p")
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			got := strings.Fields(run(vfs, "find . "+test.expression))
+			if strings.Join(got, " ") != test.want {
+				t.Errorf("found %q, want %q", strings.Join(got, " "), test.want)
+			}
+		})
+	}
+}
+
+func TestFindErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       string
+	}{
+		{"-type x", "unknown type"},
+		{"-size huge", "invalid size"},
+		{"-mtime soon", "invalid age"},
+		{"-perm execute:1", "unknown permission"},
+		{"-frobnicate", "unknown predicate"},
+		{"-exec cat {}", "missing ; or +"},
+		{"\\( -name a", ")"},
+	}
+	vfs := newTestVFS(t)
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			output := run(vfs, "find / "+test.expression)
+			if vfs.Status == 0 || !strings.Contains(output, test.want) {
+				t.Errorf("find printed %q with status %d, want an error about %q", output, vfs.Status, test.want)
+			}
+		})
+	}
+}
+
+func TestFindDelete(t *testing.T) {
+	vfs := newTestVFS(t)
+	writeTestFile(t, vfs, "/p/a.tmp", "a")
+	writeTestFile(t, vfs, "/p/sub/b.tmp", "b")
+	writeTestFile(t, vfs, "/p/sub/keep.txt", "k")
+	run(vfs, "find /p -name *.tmp -delete")
+	if vfs.Status != 0 {
+		t.Errorf("find -delete exited with status %d", vfs.Status)
+	}
+	for filePath, want := range map[string]bool{"/p/a.tmp": false, "/p/sub/b.tmp": false, "/p/sub/keep.txt": true} {
+		if _, exists := readTestFile(t, vfs, filePath); exists != want {
+			t.Errorf("%s exists: %v, want %v", filePath, exists, want)
+		}
+	}
+	if trash := vfs.Trash[vfs.userName()]; len(trash) != 2 {
+		t.Errorf("trash holds %d entries, want the 2 deleted files", len(trash))
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"path"
+)
+
+// Images start with a fixed header followed by the gob encoded HelperVFS:
+//
+//	magic    [8]byte  "VFSIMAGE"
+//	version  uint32   format version of the payload
+//	length   uint64   payload length in bytes
+//	checksum [32]byte SHA-256 of the payload
+//
+// Version 1 images predate the header and are a bare gob of HelperVFS.
+const (
+	imageMagic   = "VFSIMAGE"
+	imageVersion = 2
+	headerSize   = len(imageMagic) + 4 + 8 + sha256.Size
+)
+
+// migrations upgrade a decoded image from the version it is keyed by to the
+// next one. Every format change adds an entry and bumps imageVersion.
+var migrations = map[uint32]func(*HelperVFS) error{
+	1: migrateV1,
+}
+
+// migrateV1 upgrades an image from before the header. It fills in the state
+// version 1 did not persist, cleans the paths the old mkdir built with a
+// doubled slash under the root, moves file contents from the Content string
+// into the blob store, and starts the times version 1 did not keep from the
+// ones it did.
+func migrateV1(state *HelperVFS) error {
+	blobs := state.blobStore()
+	var walk func(dir *Directory)
+	walk = func(dir *Directory) {
+		dir.Path = path.Clean(dir.Path)
+		if dir.Parent != "" {
+			dir.Parent = path.Clean(dir.Parent)
+		}
+		dir.UpdatedAt, dir.ChangedAt, dir.AccessedAt = dir.CreatedAt, dir.CreatedAt, dir.CreatedAt
+		for _, file := range dir.Files {
+			file.Blocks = nil
+			for _, chunk := range splitChunks([]byte(file.Content)) {
+				file.Blocks = append(file.Blocks, blobs.put(chunk))
+			}
+			file.Size = len(file.Content)
+			file.Content = ""
+			file.ChangedAt, file.AccessedAt = file.UpdatedAt, file.UpdatedAt
+		}
+		for _, sub := range dir.SubDirs {
+			walk(sub)
+		}
+	}
+	if state.Root != nil {
+		walk(state.Root)
+	}
+	if state.CurrentDir != nil {
+		state.CurrentPath = path.Clean(state.CurrentDir.Path)
+		state.CurrentDir = nil
+	}
+	if state.MachineName == "" {
+		state.MachineName = "None"
+	}
+	if state.CurrentUser != nil {
+		state.Users = map[string]*User{state.CurrentUser.Name: state.CurrentUser}
+	}
+	return nil
+}
+
+func encodeImage(w io.Writer, state *HelperVFS) error {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(state); err != nil {
+		return fmt.Errorf("failed to encode data: %w", err)
+	}
+
+	header := make([]byte, 0, headerSize)
+	header = append(header, imageMagic...)
+	header = binary.BigEndian.AppendUint32(header, imageVersion)
+	header = binary.BigEndian.AppendUint64(header, uint64(payload.Len()))
+	checksum := sha256.Sum256(payload.Bytes())
+	header = append(header, checksum[:]...)
+
+	if _, err := w.Write(header); err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+	if _, err := w.Write(payload.Bytes()); err != nil {
+		return fmt.Errorf("failed to write data: %w", err)
+	}
+	return nil
+}
+
+// decodeImage verifies and decodes an image of any supported version and
+// migrates it to the current one.
+func decodeImage(data []byte) (*HelperVFS, error) {
+	version := uint32(1)
+	payload := data
+
+	if bytes.HasPrefix(data, []byte(imageMagic)) {
+		if len(data) < headerSize {
+			return nil, fmt.Errorf("image header is truncated")
+		}
+		header := data[len(imageMagic):headerSize]
+		version = binary.BigEndian.Uint32(header[0:4])
+		length := binary.BigEndian.Uint64(header[4:12])
+		payload = data[headerSize:]
+		if uint64(len(payload)) != length {
+			return nil, fmt.Errorf("image is %d bytes but the header declares %d", len(payload), length)
+		}
+		checksum := sha256.Sum256(payload)
+		if !bytes.Equal(checksum[:], header[12:]) {
+			return nil, fmt.Errorf("image checksum mismatch, the file is corrupt")
+		}
+	}
+	if err := checkVersion(version); err != nil {
+		return nil, err
+	}
+
+	var state HelperVFS
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&state); err != nil {
+		return nil, fmt.Errorf("failed to decode data: %w", err)
+	}
+	if err := migrateImage(&state, version); err != nil {
+		return nil, err
+	}
+	state.blobStore().recount(state.roots()...)
+	return &state, nil
+}
+
+// migrateImage upgrades state, decoded from an image of the given version,
+// to imageVersion.
+func migrateImage(state *HelperVFS, version uint32) error {
+	if err := checkVersion(version); err != nil {
+		return err
+	}
+	for ; version < imageVersion; version++ {
+		migrate, ok := migrations[version]
+		if !ok {
+			return fmt.Errorf("no migration from image format version %d", version)
+		}
+		if err := migrate(state); err != nil {
+			return fmt.Errorf("failed to migrate image from version %d: %w", version, err)
+		}
+	}
+	return nil
+}
+
+func checkVersion(version uint32) error {
+	if version > imageVersion {
+		return fmt.Errorf("image format version %d is newer than the supported version %d", version, imageVersion)
+	}
+	return nil
+}
+
+// persistedState collects everything about vfs that belongs in the image.
+func (vfs *VFS) persistedState() *HelperVFS {
+	state := &HelperVFS{
+		Root:        sealedTree(vfs.Root),
+		CurrentPath: vfs.CurrentDir.Path,
+		CurrentUser: vfs.CurrentUser,
+		Users:       vfs.Users,
+		MachineName: vfs.MachineName,
+		Env:         vfs.Env,
+		Snapshots:   vfs.Snapshots,
+		Trash:       vfs.Trash,
+		Index:       vfs.Index,
+		UserQuotas:  vfs.UserQuotas,
+		DirQuotas:   vfs.DirQuotas,
+		Generation:  vfs.Generation,
+		blobs:       vfs.blobs,
+		codecs:      vfs.blobCodecs(),
+		key:         vfs.imageKey,
+	}
+	return state
+}
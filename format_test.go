@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeV1Image writes state the way version 1 images were saved: a bare
+// gob of HelperVFS without a header.
+func writeV1Image(t *testing.T, imagePath string, state *HelperVFS) {
+	t.Helper()
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(imagePath, data.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateV1CleansPaths(t *testing.T) {
+	perms := []int{-1, 0}
+	docs := &Directory{
+		Name:            "docs",
+		Files:           make(map[string]*File),
+		SubDirs:         make(map[string]*Directory),
+		Parent:          "/",
+		Path:            "//docs",
+		ReadPermission:  perms,
+		WritePermission: perms,
+	}
+	docs.SubDirs["notes"] = &Directory{
+		Name:            "notes",
+		Files:           make(map[string]*File),
+		SubDirs:         make(map[string]*Directory),
+		Parent:          "//docs",
+		Path:            "//docs/notes",
+		ReadPermission:  perms,
+		WritePermission: perms,
+	}
+	root := &Directory{
+		Name:            "/",
+		Files:           make(map[string]*File),
+		SubDirs:         map[string]*Directory{"docs": docs},
+		Path:            "/",
+		ReadPermission:  perms,
+		WritePermission: perms,
+	}
+	imagePath := filepath.Join(t.TempDir(), "v1.gob")
+	writeV1Image(t, imagePath, &HelperVFS{
+		Root:        root,
+		CurrentDir:  docs,
+		CurrentUser: &User{Name: "admin", GroupPerms: []int{0, -1}},
+	})
+
+	vfs, err := openImage(imagePath, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vfs.closeJournal()
+
+	migrated := vfs.Root.SubDirs["docs"]
+	if migrated.Path != "/docs" || migrated.Parent != "/" {
+		t.Errorf("docs has Path %q and Parent %q, want /docs and /", migrated.Path, migrated.Parent)
+	}
+	notes := migrated.SubDirs["notes"]
+	if notes.Path != "/docs/notes" || notes.Parent != "/docs" {
+		t.Errorf("notes has Path %q and Parent %q, want /docs/notes and /docs", notes.Path, notes.Parent)
+	}
+	if vfs.CurrentDir != migrated {
+		t.Errorf("current directory is %q, want /docs", vfs.CurrentDir.Path)
+	}
+}
+
+func TestMigratedVaultStaysSealedInJournal(t *testing.T) {
+	perms := []int{-1, 0}
+	root := &Directory{
+		Name:            "/",
+		Files:           make(map[string]*File),
+		SubDirs:         make(map[string]*Directory),
+		Path:            "/",
+		ReadPermission:  perms,
+		WritePermission: perms,
+	}
+	root.SubDirs["docs"] = &Directory{
+		Name:            "docs",
+		Files:           make(map[string]*File),
+		SubDirs:         make(map[string]*Directory),
+		Parent:          "/",
+		Path:            "//docs",
+		ReadPermission:  perms,
+		WritePermission: perms,
+	}
+	imagePath := filepath.Join(t.TempDir(), "v1.gob")
+	writeV1Image(t, imagePath, &HelperVFS{
+		Root:        root,
+		CurrentDir:  root,
+		CurrentUser: &User{Name: "admin", GroupPerms: []int{0, -1}},
+	})
+
+	vfs, err := openImage(imagePath, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vfs.closeJournal()
+	commands := GetCommands(vfs, GetUsage())
+	vfs.CommandMap = commands
+
+	vfs.vaultCreate("/docs", "vault key")
+	executeLine(vfs, commands, "echo /docs/s.txt topsecretcontent")
+	if _, exists := vfs.Root.SubDirs["docs"].Files["s.txt"]; !exists {
+		t.Fatal("echo did not create /docs/s.txt")
+	}
+
+	journal, err := os.ReadFile(journalPath(imagePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(journal) == 0 {
+		t.Fatal("the write was not journaled")
+	}
+	secret := base64.StdEncoding.EncodeToString([]byte("topsecretcontent"))
+	if bytes.Contains(journal, []byte(secret)) || bytes.Contains(journal, []byte("s.txt")) {
+		t.Errorf("journal holds the vault's contents in the clear:\n%s", journal)
+	}
+}
+
+func TestMigrateV1MovesContents(t *testing.T) {
+	perms := []int{-1, 0}
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	big := strings.Repeat("x", chunkSize+10)
+	root := &Directory{
+		Name: "/",
+		Files: map[string]*File{
+			"a.txt":   {Name: "a.txt", Content: "hello", UpdatedAt: created, ReadPermission: perms},
+			"big.txt": {Name: "big.txt", Content: big, UpdatedAt: created, ReadPermission: perms},
+			"empty":   {Name: "empty", UpdatedAt: created, ReadPermission: perms},
+		},
+		SubDirs:         make(map[string]*Directory),
+		Path:            "/",
+		CreatedAt:       created,
+		ReadPermission:  perms,
+		WritePermission: perms,
+	}
+	imagePath := filepath.Join(t.TempDir(), "v1.gob")
+	writeV1Image(t, imagePath, &HelperVFS{
+		Root:        root,
+		CurrentDir:  root,
+		CurrentUser: &User{Name: "admin", GroupPerms: []int{0, -1}},
+	})
+
+	vfs, err := openImage(imagePath, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"a.txt": "hello", "big.txt": big, "empty": ""} {
+		file := vfs.Root.Files[name]
+		got, err := vfs.readFile(file)
+		if err != nil || string(got) != want || file.Size != len(want) || file.Content != "" {
+			t.Errorf("%s reads %d bytes with error %v, want %d", name, len(got), err, len(want))
+		}
+		if !file.AccessedAt.Equal(created) || !file.ChangedAt.Equal(created) {
+			t.Errorf("%s was accessed at %v and changed at %v, want %v", name, file.AccessedAt, file.ChangedAt, created)
+		}
+	}
+	if len(vfs.Root.Files["big.txt"].Blocks) != 2 {
+		t.Errorf("big.txt is in %d chunks, want 2", len(vfs.Root.Files["big.txt"].Blocks))
+	}
+	if !vfs.Root.UpdatedAt.Equal(created) {
+		t.Errorf("/ was updated at %v, want %v", vfs.Root.UpdatedAt, created)
+	}
+	if vfs.MachineName != "None" || vfs.Users["admin"] == nil {
+		t.Errorf("the image has machine name %q and users %v", vfs.MachineName, vfs.Users)
+	}
+}
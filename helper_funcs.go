@@ -1,29 +1,56 @@
 package main
 
 import (
-	"bytes"
-	"encoding/gob"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 func loadFromFile(filename string) (*VFS, error) {
-	data, err := os.ReadFile(filename)
+	TempVFS, err := loadStruct(filename)
 	if err != nil {
 		return nil, err
 	}
 
-	var vfs VFS
-	buffer := bytes.NewBuffer(data)
-	decoder := gob.NewDecoder(buffer)
-	if err := decoder.Decode(&vfs); err != nil {
-		return nil, err
+	vfs := &VFS{imageState: imageState{
+		Root:        TempVFS.Root,
+		CurrentDir:  TempVFS.Root,
+		CurrentUser: TempVFS.CurrentUser,
+		Users:       TempVFS.Users,
+		MachineName: TempVFS.MachineName,
+		Env:         TempVFS.Env,
+		Snapshots:   TempVFS.Snapshots,
+		Trash:       TempVFS.Trash,
+		Index:       TempVFS.Index,
+		UserQuotas:  TempVFS.UserQuotas,
+		DirQuotas:   TempVFS.DirQuotas,
+		Generation:  TempVFS.Generation,
+		ImagePath:   filename,
+		StoreName:   TempVFS.store,
+		blobs:       TempVFS.blobStore(),
+		imageKey:    TempVFS.key,
+	}}
+	if dir := vfs.findDirectoryByPath(TempVFS.CurrentPath); dir != nil {
+		vfs.CurrentDir = dir
 	}
-
-	os.Remove("filedata.gob")
-	return &vfs, nil
+	if vfs.Users == nil {
+		vfs.Users = make(map[string]*User)
+	}
+	if vfs.CurrentUser != nil {
+		if user, exists := vfs.Users[vfs.CurrentUser.Name]; exists {
+			vfs.CurrentUser = user
+		} else {
+			vfs.Users[vfs.CurrentUser.Name] = vfs.CurrentUser
+		}
+	}
+	vfs.initEnv()
+	vfs.initAliases()
+	return vfs, nil
 }
 
 func fileExists(filename string) bool {
@@ -43,7 +70,7 @@ func (vfs *VFS) findDirectoryByPath(path string) *Directory {
 		if parts[i] == "" {
 			continue // Skip empty parts
 		}
-		nextDir, exists := current.SubDirs[parts[i]]
+		nextDir, exists := vfs.subDir(current, parts[i])
 		if !exists {
 			return nil // Directory not found
 		}
@@ -51,39 +78,351 @@ func (vfs *VFS) findDirectoryByPath(path string) *Directory {
 	}
 	return current
 }
-func saveStruct(filename string, data *VFS) error {
 
-	var RealData HelperVFS
-	RealData.Root = data.Root
-	RealData.CurrentDir = data.CurrentDir
-	RealData.CurrentUser = data.CurrentUser
+// resolveDir walks an absolute or relative path, with . and .. components,
+// to a directory the current user may read.
+func (vfs *VFS) resolveDir(dirPath string) (*Directory, error) {
+	current := vfs.CurrentDir
+	if strings.HasPrefix(dirPath, "/") {
+		current = vfs.Root
+	}
+	for _, part := range strings.Split(dirPath, "/") {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if current.Parent == "" {
+				continue
+			}
+			parent := vfs.findDirectoryByPath(current.Parent)
+			if parent == nil {
+				return nil, fmt.Errorf("parent directory of %s not found", current.Path)
+			}
+			current = parent
+		default:
+			next, exists := vfs.subDir(current, part)
+			if !exists {
+				return nil, fmt.Errorf("directory %s does not exist", dirPath)
+			}
+			if !checkOverlap(next.ReadPermission, vfs.CurrentUser.GroupPerms) {
+				return nil, fmt.Errorf("you do not have read permissions to access %s", next.Path)
+			}
+			if vfs.isLocked(next) {
+				return nil, fmt.Errorf("%s is a locked vault", next.Path)
+			}
+			current = next
+		}
+	}
+	return current, nil
+}
+
+// atPath runs fn with the current directory temporarily switched to the
+// parent of target, passing the final path component, so that commands
+// written against CurrentDir also accept paths like a/b.txt.
+func (vfs *VFS) atPath(target string, fn func(name string)) {
+	dirPath, name := path.Split(target)
+	if dirPath == "" {
+		fn(name)
+		return
+	}
+	dir, err := vfs.resolveDir(dirPath)
+	if err != nil {
+		vfs.fail(err)
+		return
+	}
+	previous := vfs.CurrentDir
+	vfs.CurrentDir = dir
+	// fn may have removed the directory the shell was in.
+	defer func() { vfs.CurrentDir = vfs.nearestDir(previous) }()
+	fn(name)
+}
+
+// nearestDir returns dir if it is still in the tree, or else the closest of
+// its parents that is.
+func (vfs *VFS) nearestDir(dir *Directory) *Directory {
+	if vfs.findDirectoryByPath(dir.Path) == dir {
+		return dir
+	}
+	for dirPath := path.Dir(dir.Path); dirPath != "/"; dirPath = path.Dir(dirPath) {
+		if found := vfs.findDirectoryByPath(dirPath); found != nil {
+			return found
+		}
+	}
+	return vfs.Root
+}
 
-	file, err := os.Create(filename)
+// lookup resolves target to the directory holding it and the file itself,
+// or to the directory itself and a nil file when target is a directory.
+func (vfs *VFS) lookup(target string) (*Directory, *File, error) {
+	dirPath, name := path.Split(target)
+	if name != "" && name != "." && name != ".." {
+		dir, err := vfs.resolveDir(dirPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		if file, exists := dir.Files[name]; exists {
+			return dir, file, nil
+		}
+	}
+	dir, err := vfs.resolveDir(target)
+	if err != nil {
+		return nil, nil, fmt.Errorf("no such file or directory: %s", target)
+	}
+	return dir, nil, nil
+}
+
+func joinPath(dir string, name string) string {
+	return path.Join(dir, name)
+}
+
+// mkdirAll returns the directory at dirPath, creating any missing parents on
+// the way. It is meant for directories the shell itself manages, so it skips
+// the permission checks that mkdir performs.
+func (vfs *VFS) mkdirAll(dirPath string) *Directory {
+	current := vfs.Root
+	for _, part := range strings.Split(dirPath, "/") {
+		if part == "" {
+			continue
+		}
+		next, exists := current.SubDirs[part]
+		if !exists {
+			now := time.Now()
+			next = &Directory{
+				Name:             part,
+				Files:            make(map[string]*File),
+				SubDirs:          make(map[string]*Directory),
+				Parent:           current.Path,
+				CreatedAt:        now,
+				UpdatedAt:        now,
+				ChangedAt:        now,
+				AccessedAt:       now,
+				Path:             joinPath(current.Path, part),
+				ReadPermission:   []int{1, -1},
+				WritePermission:  []int{1, -1},
+				ModifyPermission: []int{1, -1},
+				Owner:            vfs.userName(),
+			}
+			current.SubDirs[part] = next
+			vfs.logDirCreate(next)
+		}
+		current = next
+	}
+	return current
+}
+
+func (vfs *VFS) newFile(name string) *File {
+	now := time.Now()
+	return &File{
+		Name:             name,
+		Size:             0,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+		ChangedAt:        now,
+		AccessedAt:       now,
+		ReadPermission:   []int{1, -1},
+		WritePermission:  []int{1, -1},
+		ModifyPermission: []int{1, -1},
+		Executable:       false,
+		Owner:            vfs.userName(),
+	}
+}
+
+// splitCommands splits a line on the ';' and newline separators that are not
+// quoted or inside a { } block.
+func splitCommands(line string) []string {
+	var commands []string
+	var quote byte
+	escaped := false
+	depth := 0
+	start := 0
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if escaped {
+			escaped = false
+			continue
+		}
+		switch {
+		case c == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+		case (c == ';' || c == '\n') && depth == 0:
+			commands = append(commands, line[start:i])
+			start = i + 1
+		}
+	}
+	commands = append(commands, line[start:])
+
+	nonEmpty := commands[:0]
+	for _, command := range commands {
+		if strings.TrimSpace(command) != "" {
+			nonEmpty = append(nonEmpty, command)
+		}
+	}
+	return nonEmpty
+}
+
+// splitPipeline splits a command on the '|' that are not quoted or inside a
+// { } block, giving the stages of a pipeline.
+func splitPipeline(command string) []string {
+	var stages []string
+	var quote byte
+	escaped := false
+	depth := 0
+	start := 0
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		if escaped {
+			escaped = false
+			continue
+		}
+		switch {
+		case c == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+		case c == '|' && depth == 0:
+			stages = append(stages, command[start:i])
+			start = i + 1
+		}
+	}
+	return append(stages, command[start:])
+}
+
+// splitStatements groups the lines of a script into complete statements,
+// joining lines the same way the interactive prompt does with PS2.
+func splitStatements(script string) []string {
+	var statements []string
+	current := ""
+	pending := false
+	for _, line := range strings.Split(script, "\n") {
+		switch {
+		case !pending:
+			current = line
+		case strings.HasSuffix(current, "\\"):
+			current = strings.TrimSuffix(current, "\\") + line
+		default:
+			current += "\n" + line
+		}
+		pending = needsContinuation(current)
+		if !pending && strings.TrimSpace(current) != "" {
+			statements = append(statements, current)
+		}
+	}
+	if pending {
+		statements = append(statements, current)
+	}
+	return statements
+}
+
+func saveStruct(filename string, data *VFS) error {
+	store, err := getStore(data.StoreName)
+	if err != nil {
+		return err
+	}
+	return store.Save(filename, data.persistedState())
+}
+
+// writeFileAtomic writes to a temporary file next to filename, syncs it and
+// renames it into place, so a crash leaves either the old or the new file and
+// never a truncated one. The previous contents are kept in filename.bak.
+func writeFileAtomic(filename string, write func(io.Writer) error) error {
+	dir := filepath.Dir(filename)
+	tempfile, err := os.CreateTemp(dir, filepath.Base(filename)+".tmp*")
 	if err != nil {
 		return fmt.Errorf("failed to create file: %w", err)
 	}
-	defer file.Close()
+	defer os.Remove(tempfile.Name())
+
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(filename); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := tempfile.Chmod(mode); err != nil {
+		tempfile.Close()
+		return fmt.Errorf("failed to set file mode: %w", err)
+	}
 
-	encoder := gob.NewEncoder(file)
-	if err := encoder.Encode(RealData); err != nil {
-		return fmt.Errorf("failed to encode data: %w", err)
+	if err := write(tempfile); err != nil {
+		tempfile.Close()
+		return err
+	}
+	if err := tempfile.Sync(); err != nil {
+		tempfile.Close()
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	if err := tempfile.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+
+	if fileExists(filename) {
+		if err := backupFile(filename, filename+".bak"); err != nil {
+			return fmt.Errorf("failed to back up %s: %w", filename, err)
+		}
+	}
+	if err := os.Rename(tempfile.Name(), filename); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", filename, err)
+	}
+
+	if dirHandle, err := os.Open(dir); err == nil {
+		dirHandle.Sync()
+		dirHandle.Close()
 	}
 	return nil
 }
 
+func backupFile(filename string, backup string) error {
+	os.Remove(backup)
+	if err := os.Link(filename, backup); err == nil {
+		return nil
+	}
+
+	source, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	dest, err := os.Create(backup)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dest, source); err != nil {
+		dest.Close()
+		return err
+	}
+	if err := dest.Sync(); err != nil {
+		dest.Close()
+		return err
+	}
+	return dest.Close()
+}
+
 func loadStruct(filename string) (*HelperVFS, error) {
-	file, err := os.Open(filename)
+	storeName, err := detectStore(filename)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %w", err)
+		return nil, err
 	}
-	defer file.Close()
-	decoder := gob.NewDecoder(file)
-	var TempVFS HelperVFS
-	if err := decoder.Decode(&TempVFS); err != nil {
-		return nil, fmt.Errorf("failed to decode data: %w", err)
+	TempVFS, err := stores[storeName].Load(filename)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
 	}
-	fmt.Println(&TempVFS)
-	return &TempVFS, nil
+	return TempVFS, nil
 }
 
 func (vfs *VFS) checkFileWrite(name string) bool {
@@ -189,8 +528,13 @@ func openInEditor(content string, ret bool) (*string, error) {
 }
 
 func (vfs *VFS) getCommandArray(name string) []string {
-	fmt.Println(strings.Split(vfs.CurrentDir.Files[name].Content, ";"))
-	return strings.Split(vfs.CurrentDir.Files[name].Content, ";")
+	content, err := vfs.readFile(vfs.CurrentDir.Files[name])
+	if err != nil {
+		vfs.fail("Error reading", name+":", err)
+		return nil
+	}
+	fmt.Println(strings.Split(string(content), ";"))
+	return strings.Split(string(content), ";")
 }
 func (vfs *VFS) executeArray(array []string) {
 	usage := GetUsage()
@@ -200,9 +544,9 @@ func (vfs *VFS) executeArray(array []string) {
 	}
 }
 
-func (vfs *VFS) pipe(source *string, file *File) error {
+func (vfs *VFS) pipe(source []byte, file *File) error {
 	if source == nil {
-		return fmt.Errorf("source data must not be a nil pointer")
+		return fmt.Errorf("source data must not be nil")
 	}
 
 	if file == nil {
@@ -212,7 +556,7 @@ func (vfs *VFS) pipe(source *string, file *File) error {
 	if !checkOverlap(vfs.CurrentUser.GroupPerms, file.WritePermission) {
 		return fmt.Errorf("you do not have the appropriate write permissions for file: %s", file.Name)
 	}
+	vfs.keepVersion(file, vfs.userName())
 
-	file.Content = *source
-	return nil
+	return vfs.writeFile(file, source)
 }
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxVersions is how many previous versions of its contents a file keeps.
+const maxVersions = 10
+
+// Version is an earlier state of a file's contents. It shares its chunks
+// with the blob store like the file itself does, so keeping one only costs
+// the chunks that have changed since.
+type Version struct {
+	Number  int
+	Size    int
+	Blocks  []string
+	SavedAt time.Time
+	Author  string
+}
+
+// fileHashes lists the chunks file refers to, in its current contents and
+// in its history.
+func fileHashes(file *File) []string {
+	hashes := slices.Clone(file.Blocks)
+	for _, version := range file.Versions {
+		hashes = append(hashes, version.Blocks...)
+	}
+	return hashes
+}
+
+func (vfs *VFS) userName() string {
+	if vfs.CurrentUser == nil {
+		return ""
+	}
+	return vfs.CurrentUser.Name
+}
+
+// keepVersion adds the current contents of file to its history before
+// author replaces them, dropping the oldest version once there are more
+// than maxVersions. A file that has never had any contents has nothing to
+// keep.
+func (vfs *VFS) keepVersion(file *File, author string) {
+	if file.Size == 0 && len(file.Versions) == 0 {
+		file.ModifiedBy = author
+		return
+	}
+	number := 1
+	if len(file.Versions) > 0 {
+		number = file.Versions[len(file.Versions)-1].Number + 1
+	}
+	version := Version{
+		Number:  number,
+		Size:    file.Size,
+		Blocks:  slices.Clone(file.Blocks),
+		SavedAt: file.UpdatedAt,
+		Author:  file.ModifiedBy,
+	}
+	for _, hash := range version.Blocks {
+		vfs.blobs.retain(hash)
+	}
+	file.Versions = append(file.Versions, version)
+	for len(file.Versions) > maxVersions {
+		for _, hash := range file.Versions[0].Blocks {
+			vfs.blobs.release(hash)
+		}
+		file.Versions = slices.Delete(file.Versions, 0, 1)
+	}
+	file.ModifiedBy = author
+}
+
+// copyVersions returns a copy of the history of file, holding references
+// of its own to the chunks.
+func (vfs *VFS) copyVersions(file *File) []Version {
+	versions := slices.Clone(file.Versions)
+	for i := range versions {
+		versions[i].Blocks = slices.Clone(versions[i].Blocks)
+		for _, hash := range versions[i].Blocks {
+			vfs.blobs.retain(hash)
+		}
+	}
+	return versions
+}
+
+func findVersion(file *File, number int) (Version, bool) {
+	for _, version := range file.Versions {
+		if version.Number == number {
+			return version, true
+		}
+	}
+	return Version{}, false
+}
+
+// readableFile looks up the file at target, provided the current user may
+// read it.
+func (vfs *VFS) readableFile(target string) (*Directory, *File) {
+	dir, file, err := vfs.lookup(target)
+	if err != nil {
+		vfs.fail(err)
+		return nil, nil
+	}
+	if file == nil {
+		vfs.fail(target, "is a directory")
+		return nil, nil
+	}
+	if !checkOverlap(file.ReadPermission, vfs.CurrentUser.GroupPerms) {
+		vfs.fail("You do not have read permissions for", target)
+		return nil, nil
+	}
+	vfs.accessed(file)
+	return dir, file
+}
+
+// logVersions lists the versions of the file at target, newest first,
+// starting with its current contents.
+func (vfs *VFS) logVersions(target string) {
+	_, file := vfs.readableFile(target)
+	if file == nil {
+		return
+	}
+	printVersion := func(label string, size int, savedAt time.Time, author string) {
+		if author == "" {
+			author = "-"
+		}
+		fmt.Printf("%-8s %s %-12s %8d bytes\n", label, savedAt.Format("2006-01-02 15:04:05"), author, size)
+	}
+	printVersion("current", file.Size, file.UpdatedAt, file.ModifiedBy)
+	for i := len(file.Versions) - 1; i >= 0; i-- {
+		version := file.Versions[i]
+		printVersion(strconv.Itoa(version.Number), version.Size, version.SavedAt, version.Author)
+	}
+}
+
+// parseVersionSpec splits file@n into the file and the version number.
+func parseVersionSpec(spec string) (string, int, error) {
+	at := strings.LastIndex(spec, "@")
+	if at <= 0 {
+		return "", 0, fmt.Errorf("expected <file>@<version>, got %s", spec)
+	}
+	number, err := strconv.Atoi(spec[at+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid version %q", spec[at+1:])
+	}
+	return spec[:at], number, nil
+}
+
+// showVersion prints the contents file had at a version, given as file@n.
+func (vfs *VFS) showVersion(spec string) {
+	target, number, err := parseVersionSpec(spec)
+	if err != nil {
+		vfs.fail(err)
+		return
+	}
+	_, file := vfs.readableFile(target)
+	if file == nil {
+		return
+	}
+	version, ok := findVersion(file, number)
+	if !ok {
+		vfs.fail(target, "has no version", number)
+		return
+	}
+	content, err := vfs.readAt(&File{Size: version.Size, Blocks: version.Blocks}, 0, version.Size)
+	if err != nil {
+		vfs.fail("Error reading", spec+":", err)
+		return
+	}
+	os.Stdout.Write(content)
+}
+
+// revert makes a previous version the current contents of the file at
+// target. The contents it replaces become a version of their own, so a
+// revert can itself be reverted.
+func (vfs *VFS) revert(target string, number int) {
+	dir, file := vfs.readableFile(target)
+	if file == nil {
+		return
+	}
+	if !checkOverlap(file.WritePermission, vfs.CurrentUser.GroupPerms) {
+		vfs.deny("write", joinPath(dir.Path, file.Name), "You do not have write permissions for", target)
+		return
+	}
+	version, ok := findVersion(file, number)
+	if !ok {
+		vfs.fail(target, "has no version", number)
+		return
+	}
+	// Hold on to the version first, keeping another one may drop it.
+	blocks := slices.Clone(version.Blocks)
+	for _, hash := range blocks {
+		vfs.blobs.retain(hash)
+	}
+	vfs.setUndo(vfs.undoOverwrite("revert", dir, file))
+	vfs.keepVersion(file, vfs.userName())
+	vfs.replaceContents(file, version.Size, blocks)
+	vfs.logFileWrite(dir, file)
+	fmt.Println("Reverted", target, "to version", number)
+}
+
+// replaceContents points file at blocks, whose references the caller hands
+// over, and gives up the ones it had.
+func (vfs *VFS) replaceContents(file *File, size int, blocks []string) {
+	for _, hash := range file.Blocks {
+		vfs.blobs.release(hash)
+	}
+	file.Blocks = blocks
+	file.Size = size
+	file.modified(time.Now())
+}
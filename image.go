@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const imageEnv = "VFS_IMAGE"
+
+func defaultImagePath() string {
+	if imagePath := os.Getenv(imageEnv); imagePath != "" {
+		return imagePath
+	}
+	return "filedata.gob"
+}
+
+// openImage loads the image at imagePath, or starts an empty one when fresh
+// is set or the file does not exist yet, then replays and reopens its
+// journal.
+func openImage(imagePath string, fresh bool, readOnly bool) (*VFS, error) {
+	var vfs *VFS
+	if !fresh && fileExists(imagePath) {
+		loaded, err := loadFromFile(imagePath)
+		if err != nil {
+			return nil, err
+		}
+		vfs = loaded
+	} else {
+		vfs = newVFS()
+		vfs.initAdmin()
+		vfs.ImagePath = imagePath
+	}
+	vfs.ReadOnly = readOnly
+	vfs.CheckpointRecords = defaultCheckpointRecords
+
+	if !fresh {
+		applied, err := vfs.replayJournal()
+		if err != nil {
+			return nil, err
+		}
+		if applied > 0 {
+			fmt.Fprintln(os.Stderr, "Recovered", applied, "changes from", journalPath(imagePath))
+		}
+	}
+	if readOnly {
+		return vfs, nil
+	}
+	if err := vfs.openJournal(fresh); err != nil {
+		return nil, err
+	}
+	if vfs.dirty {
+		if err := vfs.save(); err != nil {
+			return nil, err
+		}
+	}
+	return vfs, nil
+}
+
+func (vfs *VFS) save() error {
+	if vfs.ReadOnly {
+		return fmt.Errorf("image %s is mounted read-only", vfs.ImagePath)
+	}
+	vfs.saveMu.Lock()
+	defer vfs.saveMu.Unlock()
+	if err := vfs.resealVaults(); err != nil {
+		return err
+	}
+	// Records journaled from here on are made on top of the new image.
+	vfs.Generation++
+	if err := saveStruct(vfs.ImagePath, vfs); err != nil {
+		vfs.Generation--
+		return err
+	}
+	vfs.dirty = false
+	vfs.checkpointNow = false
+	if vfs.journal == nil {
+		return nil
+	}
+	return vfs.openJournal(true)
+}
+
+// afterCommand runs once a top-level command line has finished. It saves
+// the image if autosave on change is enabled and something was modified, or
+// checkpoints it once the journal has grown past CheckpointRecords.
+func (vfs *VFS) afterCommand() {
+	if !vfs.dirty || vfs.ReadOnly {
+		return
+	}
+	if !vfs.AutosaveOnChange && !vfs.checkpointNow && vfs.journalRecords < vfs.CheckpointRecords {
+		return
+	}
+	if err := vfs.save(); err != nil {
+		fmt.Fprintln(os.Stderr, "Autosave failed:", err)
+	}
+}
+
+// startAutosave saves the image every interval if it has unsaved changes,
+// and saves before exiting when the process is interrupted or terminated.
+func (vfs *VFS) startAutosave() {
+	if vfs.AutosaveInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(vfs.AutosaveInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				vfs.mu.Lock()
+				if vfs.dirty && !vfs.ReadOnly {
+					if err := vfs.save(); err != nil {
+						fmt.Fprintln(os.Stderr, "Autosave failed:", err)
+					}
+				}
+				vfs.mu.Unlock()
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		sig := <-signals
+		vfs.mu.Lock()
+		fmt.Fprintln(os.Stderr, "\nReceived", sig.String()+", saving and exiting")
+		vfs.Status = 130
+		vfs.shutdown()
+	}()
+}
+
+func (vfs *VFS) sync() {
+	if err := vfs.save(); err != nil {
+		vfs.fail("Error saving image:", err)
+		return
+	}
+	fmt.Println("Saved", vfs.ImagePath)
+}
+
+// mount saves the current image and swaps in the one at imagePath, opened
+// the same way as at startup. Everything that comes from an image is
+// replaced with the new one's as a whole. The command table belongs to the
+// shell session and is kept; aliases and functions are read again from the
+// rc file in the new image.
+func (vfs *VFS) mount(imagePath string, fresh bool, readOnly bool) {
+	other, err := openImage(imagePath, fresh, readOnly)
+	if err != nil {
+		vfs.fail("Error mounting", imagePath+":", err)
+		return
+	}
+	if !vfs.ReadOnly {
+		if err := vfs.save(); err != nil {
+			other.closeJournal()
+			vfs.fail("Error saving", vfs.ImagePath+":", err)
+			return
+		}
+	}
+
+	vfs.closeJournal()
+	vfs.imageState = other.imageState
+	vfs.sourceRC(vfs.CommandMap)
+	fmt.Println("Mounted", imagePath)
+}
+
+func (vfs *VFS) showMount() {
+	mode := "read-write"
+	if vfs.ReadOnly {
+		mode = "read-only"
+	}
+	fmt.Println("Image:", vfs.ImagePath, "("+mode+")")
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+const defaultCheckpointRecords = 500
+
+// journalRecord is one mutation appended to the journal between snapshots.
+// Generation is that of the image the record was made on top of: a crash
+// after saving but before the journal is truncated leaves records from the
+// previous generation behind, and those are already in the image.
+type journalRecord struct {
+	Op               string
+	Path             string
+	To               string `json:",omitempty"`
+	Content          string `json:",omitempty"`
+	Data             []byte `json:",omitempty"`
+	Offset           int    `json:",omitempty"`
+	Size             int    `json:",omitempty"`
+	ReadPermission   []int  `json:",omitempty"`
+	WritePermission  []int  `json:",omitempty"`
+	ModifyPermission []int  `json:",omitempty"`
+	Executable       bool   `json:",omitempty"`
+	Owner            string `json:",omitempty"`
+	User             string `json:",omitempty"`
+	Generation       int    `json:",omitempty"`
+	Time             time.Time
+}
+
+func journalPath(imagePath string) string {
+	return imagePath + ".journal"
+}
+
+// openJournal opens the journal next to the image for appending, discarding
+// what is in it when truncate is set.
+func (vfs *VFS) openJournal(truncate bool) error {
+	vfs.closeJournal()
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if truncate {
+		flags |= os.O_TRUNC
+	}
+	journal, err := os.OpenFile(journalPath(vfs.ImagePath), flags, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open journal: %w", err)
+	}
+	vfs.journal = journal
+	vfs.journalRecords = 0
+	return nil
+}
+
+func (vfs *VFS) closeJournal() {
+	if vfs.journal != nil {
+		vfs.journal.Close()
+		vfs.journal = nil
+	}
+}
+
+// logMutation marks the image as modified and appends rec to the journal so
+// the change survives a crash before the next snapshot.
+func (vfs *VFS) logMutation(rec journalRecord) {
+	vfs.dirty = true
+	vfs.countMutation(rec)
+	if vfs.replaying {
+		return
+	}
+	vfs.indexRecord(rec)
+	rec.Time = time.Now()
+	rec.User = vfs.userName()
+	vfs.stampRecord(rec)
+	if rec.Op == "vault" || !vfs.journalVaults(rec) {
+		vfs.appendJournal(rec)
+	}
+	vfs.audit(rec, false)
+}
+
+func (vfs *VFS) appendJournal(rec journalRecord) {
+	if vfs.journal == nil {
+		return
+	}
+	rec.Generation = vfs.Generation
+	line, err := json.Marshal(rec)
+	if err == nil && vfs.imageKey != nil {
+		line, err = sealJournalLine(vfs.imageKey, line)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error encoding journal record:", err)
+		return
+	}
+	if _, err := vfs.journal.Write(append(line, '\n')); err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing journal:", err)
+		return
+	}
+	if err := vfs.journal.Sync(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error syncing journal:", err)
+	}
+	vfs.journalRecords++
+}
+
+// logFileCreate records a new file with its owner and permissions, which
+// replaying cannot tell from whoever opened the image.
+func (vfs *VFS) logFileCreate(dir *Directory, file *File) {
+	vfs.logMutation(journalRecord{
+		Op:               "create",
+		Path:             joinPath(dir.Path, file.Name),
+		Owner:            file.Owner,
+		ReadPermission:   file.ReadPermission,
+		WritePermission:  file.WritePermission,
+		ModifyPermission: file.ModifyPermission,
+	})
+}
+
+// logDirCreate records a new directory, as logFileCreate does a file.
+func (vfs *VFS) logDirCreate(dir *Directory) {
+	vfs.logMutation(journalRecord{
+		Op:               "mkdir",
+		Path:             dir.Path,
+		Owner:            dir.Owner,
+		ReadPermission:   dir.ReadPermission,
+		WritePermission:  dir.WritePermission,
+		ModifyPermission: dir.ModifyPermission,
+	})
+}
+
+// logFileWrite records the whole contents of file. Use logFileWriteAt when
+// only part of it changed.
+func (vfs *VFS) logFileWrite(dir *Directory, file *File) {
+	content, err := vfs.readFile(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error journaling", file.Name+":", err)
+		return
+	}
+	vfs.logMutation(journalRecord{Op: "write", Path: joinPath(dir.Path, file.Name), Data: content})
+}
+
+func (vfs *VFS) logFileWriteAt(dir *Directory, file *File, data []byte, offset int) {
+	vfs.logMutation(journalRecord{Op: "writeat", Path: joinPath(dir.Path, file.Name), Data: data, Offset: offset})
+}
+
+func (vfs *VFS) logFileTruncate(dir *Directory, file *File) {
+	vfs.logMutation(journalRecord{Op: "truncate", Path: joinPath(dir.Path, file.Name), Size: file.Size})
+}
+
+func (vfs *VFS) logFileChmod(dir *Directory, file *File) {
+	vfs.logMutation(journalRecord{
+		Op:               "chmod",
+		Path:             joinPath(dir.Path, file.Name),
+		ReadPermission:   file.ReadPermission,
+		WritePermission:  file.WritePermission,
+		ModifyPermission: file.ModifyPermission,
+		Executable:       file.Executable,
+	})
+}
+
+// replayJournal applies the records left in the image's journal by a session
+// that did not checkpoint, and returns how many it applied.
+func (vfs *VFS) replayJournal() (int, error) {
+	journal, err := os.Open(journalPath(vfs.ImagePath))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to open journal: %w", err)
+	}
+	defer journal.Close()
+
+	vfs.replaying = true
+	defer func() { vfs.replaying = false }()
+
+	applied := 0
+	scanner := bufio.NewScanner(journal)
+	scanner.Buffer(make([]byte, 64*1024), 1<<30)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if !bytes.HasPrefix(line, []byte("{")) {
+			if vfs.imageKey == nil {
+				return applied, fmt.Errorf("the journal is encrypted but the image is not")
+			}
+			if line, err = openJournalLine(vfs.imageKey, line); err != nil {
+				break
+			}
+		}
+		var rec journalRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			// A torn final record from a crash mid-append; everything before
+			// it was synced and has been applied.
+			break
+		}
+		if rec.Generation < vfs.Generation {
+			continue
+		}
+		vfs.applyRecord(rec)
+		vfs.stampRecord(rec)
+		vfs.indexRecord(rec)
+		applied++
+	}
+	if err := scanner.Err(); err != nil {
+		return applied, fmt.Errorf("failed to read journal: %w", err)
+	}
+	if applied > 0 {
+		vfs.dirty = true
+	}
+	return applied, nil
+}
+
+// Journals of encrypted images hold each record sealed with the image key
+// and base64 encoded, one per line.
+func sealJournalLine(key *sealKey, line []byte) ([]byte, error) {
+	sealed, err := key.seal(line, nil)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.AppendEncode(nil, sealed), nil
+}
+
+func openJournalLine(key *sealKey, line []byte) ([]byte, error) {
+	sealed, err := base64.StdEncoding.AppendDecode(nil, line)
+	if err != nil {
+		return nil, err
+	}
+	return key.open(sealed, nil)
+}
+
+func (vfs *VFS) applyRecord(rec journalRecord) {
+	dirPath, name := path.Split(rec.Path)
+	switch rec.Op {
+	case "mkdir":
+		dir := vfs.mkdirAll(rec.Path)
+		// Journals from before owners were recorded leave the defaults.
+		if rec.Owner != "" {
+			dir.Owner = rec.Owner
+			dir.ReadPermission = rec.ReadPermission
+			dir.WritePermission = rec.WritePermission
+			dir.ModifyPermission = rec.ModifyPermission
+		}
+	case "create":
+		dir := vfs.mkdirAll(dirPath)
+		if _, exists := dir.Files[name]; !exists {
+			file := vfs.newFile(name)
+			if rec.Owner != "" {
+				file.Owner = rec.Owner
+				file.ReadPermission = rec.ReadPermission
+				file.WritePermission = rec.WritePermission
+				file.ModifyPermission = rec.ModifyPermission
+			}
+			dir.Files[name] = file
+		}
+	case "write", "writeat", "truncate":
+		dir := vfs.mkdirAll(dirPath)
+		file, exists := dir.Files[name]
+		if !exists {
+			file = vfs.newFile(name)
+			dir.Files[name] = file
+		}
+		vfs.keepVersion(file, rec.User)
+		var err error
+		switch {
+		case rec.Op == "truncate":
+			err = vfs.truncate(file, rec.Size)
+		case rec.Op == "writeat":
+			err = vfs.writeAt(file, rec.Data, rec.Offset)
+		default:
+			err = vfs.writeFile(file, rec.Data)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error replaying", rec.Op, "of", rec.Path+":", err)
+		}
+		file.modified(rec.Time)
+	case "chmod":
+		if file := vfs.findFileByPath(rec.Path); file != nil {
+			file.ReadPermission = rec.ReadPermission
+			file.WritePermission = rec.WritePermission
+			file.ModifyPermission = rec.ModifyPermission
+			file.Executable = rec.Executable
+		}
+	case "rename":
+		source := vfs.findDirectoryByPath(dirPath)
+		if source == nil {
+			return
+		}
+		file, exists := source.Files[name]
+		if !exists {
+			return
+		}
+		destDirPath, destName := path.Split(rec.To)
+		dest := vfs.mkdirAll(destDirPath)
+		if _, taken := dest.Files[destName]; taken {
+			return
+		}
+		delete(source.Files, name)
+		file.Name = destName
+		dest.Files[destName] = file
+	case "delete":
+		file, dir := vfs.detach(rec.Path)
+		if file != nil {
+			vfs.releaseFile(file)
+		} else if dir != nil {
+			vfs.releaseDir(dir)
+		}
+	case "trash":
+		vfs.moveToTrash(rec.Content, rec.Size, rec.Path, rec.Time)
+	case "untrash":
+		vfs.restoreFromTrash(rec.Content, rec.Size, rec.Path)
+	case "purge":
+		vfs.dropTrash(rec.Content, rec.Size)
+	case "copy":
+		vfs.copyPath(rec.Path, rec.To)
+	case "vault":
+		vfs.applyVault(rec)
+	case "snapshot":
+		vfs.takeSnapshot(rec.Path, rec.Time)
+	case "snapshot-delete":
+		vfs.dropSnapshot(rec.Path)
+	case "restore":
+		if snapshot, exists := vfs.Snapshots[rec.Path]; exists {
+			vfs.restoreSnapshot(snapshot, rec.To)
+		}
+	case "compress":
+		if file := vfs.findFileByPath(rec.Path); file != nil {
+			file.Compression = rec.Content
+		} else if dir := vfs.findDirectoryByPath(rec.Path); dir != nil {
+			dir.Compression = rec.Content
+		}
+	case "audit":
+		vfs.appendAudit(rec.Content)
+	case "sethost":
+		vfs.MachineName = rec.Content
+	case "setenv":
+		vfs.Env[rec.Path] = rec.Content
+	case "unsetenv":
+		delete(vfs.Env, rec.Path)
+	case "utime":
+		if t, err := time.Parse(time.RFC3339Nano, rec.Content); err == nil {
+			vfs.applyTimes(rec.Path, t, rec.Time)
+		}
+	case "quota":
+		var quota *Quota
+		if rec.Data != nil {
+			quota = &Quota{}
+			if err := json.Unmarshal(rec.Data, quota); err != nil {
+				fmt.Fprintln(os.Stderr, "Error replaying quota of", rec.Path+":", err)
+				return
+			}
+		}
+		vfs.applyQuota(rec.Content, rec.Path, quota)
+	case "index":
+		if rec.Content == "on" {
+			vfs.buildIndex()
+		} else {
+			vfs.Index = nil
+		}
+	}
+}
+
+func (vfs *VFS) findFileByPath(filePath string) *File {
+	dirPath, name := path.Split(filePath)
+	dir := vfs.findDirectoryByPath(dirPath)
+	if dir == nil {
+		return nil
+	}
+	return dir.Files[name]
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// dumpTree describes every file and directory under root by path: its
+// owner, permissions and, for files, history and contents. Times are left
+// out, as replaying stamps changes with when they were journaled rather
+// than when they were made.
+func dumpTree(t *testing.T, vfs *VFS, root *Directory) map[string]string {
+	t.Helper()
+	tree := make(map[string]string)
+	var walk func(dir *Directory)
+	walk = func(dir *Directory) {
+		tree[dir.Path+"/"] = fmt.Sprint(dir.Owner, dir.ReadPermission, dir.WritePermission, dir.ModifyPermission)
+		for name, file := range dir.Files {
+			content, err := vfs.readFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tree[joinPath(dir.Path, name)] = fmt.Sprint(file.Owner, file.ReadPermission, file.WritePermission, file.ModifyPermission,
+				file.Executable, len(file.Versions), string(content))
+		}
+		for _, sub := range dir.SubDirs {
+			walk(sub)
+		}
+	}
+	walk(root)
+	return tree
+}
+
+// dumpImage describes what an image holds besides the tree.
+func dumpImage(vfs *VFS) string {
+	var trash []string
+	for user, entries := range vfs.Trash {
+		for _, entry := range entries {
+			trash = append(trash, fmt.Sprint(user, entry.ID, entry.Path))
+		}
+	}
+	slices.Sort(trash)
+	var snapshots []string
+	for name, snapshot := range vfs.Snapshots {
+		snapshots = append(snapshots, fmt.Sprint(name, snapshot.CreatedAt.Round(time.Second).Unix()))
+	}
+	slices.Sort(snapshots)
+	var quotas []string
+	for name, quota := range vfs.UserQuotas {
+		quotas = append(quotas, fmt.Sprint("user ", name, *quota))
+	}
+	for name, quota := range vfs.DirQuotas {
+		quotas = append(quotas, fmt.Sprint("dir ", name, *quota))
+	}
+	slices.Sort(quotas)
+	return fmt.Sprint(vfs.MachineName, vfs.Env, trash, snapshots, quotas)
+}
+
+// journalSession makes changes of every kind on top of a saved image,
+// without saving them, and returns the image's path.
+func journalSession(t *testing.T) (string, *VFS) {
+	t.Helper()
+	imagePath := filepath.Join(t.TempDir(), "image.gob")
+	vfs, err := openImage(imagePath, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(vfs.closeJournal)
+	vfs.CommandMap = GetCommands(vfs, GetUsage())
+	if err := vfs.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	run(vfs, "mkdir docs; cd docs; echo a.txt hello; echo -a a.txt ' world'; echo b.txt bee; mkdir sub")
+	run(vfs, "cp a.txt c.txt; mkdir moved; mv b.txt moved; truncate -s 3 c.txt; addPerms a.txt write 7")
+	run(vfs, "echo gone.txt x; rm gone.txt; echo forced.txt x; rm -f forced.txt")
+	run(vfs, "snapshot create before; echo a.txt changed; sethost journaled; export KEY=value")
+	run(vfs, "setquota -u admin 0 1M 0 1000; setquota -d /docs 0 1M 0 0")
+	admin := vfs.CurrentUser
+	vfs.CurrentUser = &User{Name: "bob", GroupPerms: []int{2, -1}}
+	run(vfs, "cd /docs; mkdir bobs; echo bobs/b.txt mine")
+	vfs.CurrentUser = admin
+	vfs.closeJournal()
+	return imagePath, vfs
+}
+
+func TestReplayJournal(t *testing.T) {
+	imagePath, vfs := journalSession(t)
+	if !vfs.dirty || vfs.journalRecords == 0 || vfs.UserQuotas["admin"] == nil || vfs.DirQuotas["/docs"] == nil {
+		t.Fatal("the session did not make the changes it should have")
+	}
+
+	replayed, err := openImage(imagePath, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, got := dumpTree(t, vfs, vfs.Root), dumpTree(t, replayed, replayed.Root)
+	for _, filePath := range slices.Sorted(maps.Keys(want)) {
+		if got[filePath] != want[filePath] {
+			t.Errorf("%s replayed as %q, want %q", filePath, got[filePath], want[filePath])
+		}
+	}
+	for filePath := range got {
+		if _, exists := want[filePath]; !exists {
+			t.Errorf("replaying made %s", filePath)
+		}
+	}
+	if got, want := dumpImage(replayed), dumpImage(vfs); got != want {
+		t.Errorf("replayed image holds %s, want %s", got, want)
+	}
+	if got, want := dumpTree(t, replayed, replayed.Snapshots["before"].Root), dumpTree(t, vfs, vfs.Snapshots["before"].Root); !maps.Equal(got, want) {
+		t.Error("the replayed snapshot differs from the one taken")
+	}
+}
+
+func TestReplaySkipsSavedGenerations(t *testing.T) {
+	imagePath, vfs := journalSession(t)
+	journal, err := os.ReadFile(journalPath(imagePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.save(); err != nil {
+		t.Fatal(err)
+	}
+	vfs.closeJournal()
+	// A crash between saving the image and truncating the journal leaves
+	// the old records behind. Appends would be applied twice if they were
+	// replayed.
+	if err := os.WriteFile(journalPath(imagePath), journal, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed, err := openImage(imagePath, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed.dirty {
+		t.Error("records from before the last save were replayed")
+	}
+	if got, want := dumpTree(t, replayed, replayed.Root), dumpTree(t, vfs, vfs.Root); !maps.Equal(got, want) {
+		t.Error("the image changed when it was reopened")
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTerminalWidth = 80
+	lsTimeFormat         = "2006-01-02 15:04"
+)
+
+// lsOptions are the flags of the ls command.
+type lsOptions struct {
+	long      bool
+	all       bool
+	recursive bool
+	human     bool
+	byTime    bool
+	bySize    bool
+	reverse   bool
+}
+
+// entries returns the names of the files and directories in dir, sorted.
+func entries(dir *Directory) ([]string, []string) {
+	return sortedKeys(dir.Files), sortedKeys(dir.SubDirs)
+}
+
+// humanSize formats a size in bytes the way ls -h does, as in 4.2K or 17M.
+func humanSize(size int) string {
+	if size < 1024 {
+		return strconv.Itoa(size)
+	}
+	value := float64(size)
+	for _, unit := range "KMGTP" {
+		value /= 1024
+		if value < 1024 || unit == 'P' {
+			if value < 10 {
+				return fmt.Sprintf("%.1f%c", value, unit)
+			}
+			return fmt.Sprintf("%.0f%c", value, unit)
+		}
+	}
+	return strconv.Itoa(size)
+}
+
+// mode describes a file or directory as the current user sees it: d for a
+// directory, then r, w, m and x for whether they may read, write, modify
+// the permissions of, and execute it.
+func (vfs *VFS) mode(node findNode) string {
+	groups := vfs.CurrentUser.GroupPerms
+	read, write, modify := node.dir.ReadPermission, node.dir.WritePermission, node.dir.ModifyPermission
+	kind, executable := "d", false
+	if !node.isDir() {
+		read, write, modify = node.file.ReadPermission, node.file.WritePermission, node.file.ModifyPermission
+		kind, executable = "-", node.file.Executable
+	}
+	flag := func(set bool, letter string) string {
+		if set {
+			return letter
+		}
+		return "-"
+	}
+	return kind + flag(checkOverlap(read, groups), "r") + flag(checkOverlap(write, groups), "w") +
+		flag(checkOverlap(modify, groups), "m") + flag(executable, "x")
+}
+
+// terminalWidth returns how many columns the terminal has, from $COLUMNS
+// or the terminal itself.
+func (vfs *VFS) terminalWidth() int {
+	for _, columns := range []string{vfs.Env["COLUMNS"], os.Getenv("COLUMNS")} {
+		if width, err := strconv.Atoi(columns); err == nil && width > 0 {
+			return width
+		}
+	}
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return defaultTerminalWidth
+	}
+	defer tty.Close()
+	cmd := exec.Command("stty", "size")
+	cmd.Stdin = tty
+	out, err := cmd.Output()
+	if err != nil {
+		return defaultTerminalWidth
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return defaultTerminalWidth
+	}
+	if width, err := strconv.Atoi(fields[1]); err == nil && width > 0 {
+		return width
+	}
+	return defaultTerminalWidth
+}
+
+// toTerminal reports whether output goes straight to a terminal, rather
+// than into a file or the next stage of a pipeline.
+func toTerminal() bool {
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func (options lsOptions) sort(nodes []findNode) {
+	slices.SortStableFunc(nodes, func(a findNode, b findNode) int {
+		order := 0
+		switch {
+		case options.bySize:
+			order = cmp.Compare(b.size(), a.size())
+		case options.byTime:
+			order = b.modTime().Compare(a.modTime())
+		}
+		if order == 0 {
+			order = strings.Compare(a.name, b.name)
+		}
+		if options.reverse {
+			return -order
+		}
+		return order
+	})
+}
+
+// printNodes prints one listing: a line per entry in the long format, and
+// otherwise names in columns, or one per line when the output is not a
+// terminal. Directories' names end in a slash.
+func (vfs *VFS) printNodes(nodes []findNode, options lsOptions) {
+	if len(nodes) == 0 {
+		return
+	}
+	names := make([]string, len(nodes))
+	for i, node := range nodes {
+		names[i] = node.name
+		if node.isDir() {
+			names[i] += "/"
+		}
+	}
+	if options.long {
+		sizes := make([]string, len(nodes))
+		ownerWidth, sizeWidth := 0, 0
+		for i, node := range nodes {
+			sizes[i] = strconv.Itoa(node.size())
+			if options.human {
+				sizes[i] = humanSize(node.size())
+			}
+			ownerWidth = max(ownerWidth, len(ownerName(node.owner())))
+			sizeWidth = max(sizeWidth, len(sizes[i]))
+		}
+		for i, node := range nodes {
+			fmt.Printf("%s %-*s %*s %s %s\n", vfs.mode(node), ownerWidth, ownerName(node.owner()),
+				sizeWidth, sizes[i], node.modTime().Local().Format(lsTimeFormat), names[i])
+		}
+		return
+	}
+	if !toTerminal() {
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return
+	}
+
+	// Fill the columns top to bottom, using as many as fit.
+	width := vfs.terminalWidth()
+	rows := len(names)
+	var widths []int
+	for rows = 1; rows < len(names); rows++ {
+		widths = widths[:0]
+		total := 0
+		for start := 0; start < len(names); start += rows {
+			column := 0
+			for _, name := range names[start:min(start+rows, len(names))] {
+				column = max(column, len(name))
+			}
+			widths = append(widths, column)
+			total += column + 2
+		}
+		if total-2 <= width {
+			break
+		}
+	}
+	if rows == len(names) {
+		widths = []int{0}
+	}
+	for row := 0; row < rows; row++ {
+		var line strings.Builder
+		for column := 0; column*rows+row < len(names); column++ {
+			name := names[column*rows+row]
+			if (column+1)*rows+row < len(names) {
+				name = fmt.Sprintf("%-*s", widths[column]+2, name)
+			}
+			line.WriteString(name)
+		}
+		fmt.Println(line.String())
+	}
+}
+
+// listDir prints the contents of dir, and with -R those of the directories
+// under it.
+func (vfs *VFS) listDir(dir *Directory, name string, header bool, options lsOptions) {
+	if header {
+		fmt.Printf("%s:\n", name)
+	}
+	if !checkOverlap(dir.ReadPermission, vfs.CurrentUser.GroupPerms) {
+		vfs.fail("ls: cannot open directory", name+": Permission denied")
+		return
+	}
+	dir.AccessedAt = time.Now()
+	files, dirs := entries(dir)
+	var nodes []findNode
+	for _, fileName := range files {
+		if options.all || !strings.HasPrefix(fileName, ".") {
+			nodes = append(nodes, findNode{name: fileName, abs: joinPath(dir.Path, fileName), file: dir.Files[fileName], dir: dir})
+		}
+	}
+	for _, subName := range dirs {
+		if options.all || !strings.HasPrefix(subName, ".") {
+			nodes = append(nodes, findNode{name: subName, abs: dir.SubDirs[subName].Path, dir: dir.SubDirs[subName]})
+		}
+	}
+	options.sort(nodes)
+	vfs.printNodes(nodes, options)
+	if !options.recursive {
+		return
+	}
+	for _, node := range nodes {
+		if node.isDir() && !vfs.isLocked(node.dir) {
+			fmt.Println()
+			vfs.listDir(node.dir, strings.TrimSuffix(name, "/")+"/"+node.name, true, options)
+		}
+	}
+}
+
+// ls lists each of targets, the current directory if there are none. Files
+// named directly are listed together first, then each directory in turn.
+func (vfs *VFS) ls(targets []string, options lsOptions) {
+	if len(targets) == 0 {
+		targets = []string{"."}
+	}
+	var files, dirs []findNode
+	for _, target := range targets {
+		dir, file, err := vfs.lookup(target)
+		switch {
+		case err != nil:
+			vfs.fail("ls: cannot access", target+":", "no such file or directory")
+		case file != nil:
+			files = append(files, findNode{name: target, abs: joinPath(dir.Path, file.Name), file: file, dir: dir})
+		default:
+			dirs = append(dirs, findNode{name: target, abs: dir.Path, dir: dir})
+		}
+	}
+	options.sort(files)
+	vfs.printNodes(files, options)
+	options.sort(dirs)
+	for i, node := range dirs {
+		if i > 0 || len(files) > 0 {
+			fmt.Println()
+		}
+		vfs.listDir(node.dir, node.name, len(targets) > 1 || options.recursive, options)
+	}
+}
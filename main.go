@@ -2,8 +2,11 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -11,21 +14,69 @@ import (
 )
 
 func newVFS() *VFS {
+	now := time.Now()
 	root := &Directory{
 		Name:            "/",
 		Files:           make(map[string]*File),
 		SubDirs:         make(map[string]*Directory),
-		CreatedAt:       time.Now(),
+		CreatedAt:       now,
+		UpdatedAt:       now,
+		ChangedAt:       now,
+		AccessedAt:      now,
 		Parent:          "",
 		Path:            "/",
-		History:         []string{"init"},
 		ReadPermission:  []int{-1, 0},
 		WritePermission: []int{-1, 0},
 	}
-	return &VFS{Root: root, CurrentDir: root, MachineName: "None"}
+	vfs := &VFS{imageState: imageState{Root: root, CurrentDir: root, MachineName: "None", StoreName: defaultStore, blobs: newBlobStore(nil, nil)}}
+	vfs.initEnv()
+	vfs.initAliases()
+	return vfs
+}
+
+func executeLine(vfs *VFS, commands CommandMap, line string) {
+	if vfs.nesting == 0 {
+		vfs.mu.Lock()
+		defer vfs.mu.Unlock()
+		defer vfs.afterCommand()
+	}
+	vfs.nesting++
+	defer func() { vfs.nesting-- }()
+
+	for _, icommand := range splitCommands(line) {
+		if stages := splitPipeline(icommand); len(stages) > 1 {
+			vfs.pipeline(commands, stages)
+			continue
+		}
+		execute(vfs, commands, icommand)
+	}
+}
+
+// pipeline runs the stages of a pipeline in turn, giving each the output of
+// the one before as its input. Its status is that of the last stage.
+func (vfs *VFS) pipeline(commands CommandMap, stages []string) {
+	stdin, piped := vfs.stdin, vfs.piped
+	defer func() { vfs.stdin, vfs.piped = stdin, piped }()
+	for i, stage := range stages {
+		if strings.TrimSpace(stage) == "" {
+			fmt.Println("Error parsing command: empty pipeline stage")
+			vfs.Status = 2
+			return
+		}
+		if i == len(stages)-1 {
+			execute(vfs, commands, stage)
+			return
+		}
+		output := capture(func() { execute(vfs, commands, stage) })
+		vfs.stdin, vfs.piped = output, true
+	}
 }
 
 func execute(vfs *VFS, commands CommandMap, icommand string) {
+	if vfs.defineFunction(icommand) {
+		vfs.Status = 0
+		return
+	}
 
 	parts := strings.Split(icommand, " >> ")
 	var commandName string
@@ -44,6 +95,10 @@ func execute(vfs *VFS, commands CommandMap, icommand string) {
 		parsedParts, err := shellwords.Parse(icommand)
 		if err != nil {
 			fmt.Println("Error parsing command:", err)
+			vfs.Status = 2
+			return
+		}
+		if len(parsedParts) == 0 {
 			return
 		}
 		commandName = parsedParts[0]
@@ -51,59 +106,182 @@ func execute(vfs *VFS, commands CommandMap, icommand string) {
 	}
 
 	if commandName == "exit" {
-		fmt.Println("Exiting")
-		err := saveStruct("filedata.gob", vfs)
-		if err != nil {
-			fmt.Println(err)
+		if len(args) > 0 {
+			status, err := strconv.Atoi(args[0])
+			if err != nil {
+				fmt.Println("Usage: exit [status]")
+				vfs.Status = 2
+				return
+			}
+			vfs.Status = status
 		}
-		os.Exit(0)
+		fmt.Println("Exiting")
+		vfs.shutdown()
+	}
+
+	if vfs.expandAlias(commands, commandName, args) {
+		return
+	}
+	if vfs.callFunction(commands, commandName, args) {
+		return
 	}
 
 	command, ok := commands[commandName]
 	if !ok {
 		fmt.Println("Unknown command:", commandName)
+		vfs.Status = 127
 		return
 	}
 
+	vfs.Status = 0
 	command(args)
 }
 
 func inputs(vfs *VFS, commands CommandMap) {
 	scanner := bufio.NewScanner(os.Stdin)
 	for {
-		fmt.Print("&Shell" + vfs.CurrentDir.Path + ": ")
+		fmt.Print(vfs.prompt("PS1"))
 		if !scanner.Scan() {
 			break
 		}
 		input := scanner.Text()
-		if len(input) == 0 {
+		for needsContinuation(input) {
+			fmt.Print(vfs.prompt("PS2"))
+			if !scanner.Scan() {
+				break
+			}
+			if strings.HasSuffix(input, "\\") {
+				input = strings.TrimSuffix(input, "\\") + scanner.Text()
+			} else {
+				input += "\n" + scanner.Text()
+			}
+		}
+		if len(strings.TrimSpace(input)) == 0 {
 			continue
 		}
 
 		if err := scanner.Err(); err != nil {
 			fmt.Fprintln(os.Stderr, "Error reading input:", err)
 		}
-		execute(vfs, commands, input)
+		executeLine(vfs, commands, input)
+	}
+}
+
+// shutdown saves the image, unless it is mounted read-only, and exits with
+// the status of the last command.
+func (vfs *VFS) shutdown() {
+	if !vfs.ReadOnly {
+		if err := vfs.save(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	os.Exit(vfs.Status)
+}
+
+func runHostScript(vfs *VFS, commands CommandMap, scriptPath string, args []string) {
+	data, err := os.ReadFile(scriptPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading script:", err)
+		vfs.Status = 1
+		return
+	}
+	vfs.runScript(commands, string(data), scriptPath, args)
+}
+
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// runConvert implements `vfs-go-system convert -to <store> <source> <dest>`.
+func runConvert(args []string) {
+	flags := flag.NewFlagSet("convert", flag.ExitOnError)
+	to := flags.String("to", defaultStore, "store to write: "+storeNames())
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: vfs-go-system convert -to <store> <source-image> <dest-image>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err := convertImage(flags.Arg(0), flags.Arg(1), *to); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 }
 
 func main() {
-	var vfs *VFS
-	TempVFS, err := loadStruct("filedata.gob")
+	if len(os.Args) > 1 && os.Args[1] == "convert" {
+		runConvert(os.Args[2:])
+		return
+	}
+
+	commandString := flag.String("c", "", "run the given commands and exit")
+	imagePath := flag.String("image", defaultImagePath(), "image file to load and save (env "+imageEnv+")")
+	fresh := flag.Bool("new", false, "start from an empty image, replacing the file on save")
+	readOnly := flag.Bool("readonly", false, "never write the image back to disk")
+	autosaveInterval := flag.Duration("autosave", 0, "save unsaved changes at this interval, e.g. 30s (0 disables)")
+	autosaveOnChange := flag.Bool("autosave-on-change", false, "save after every command that modifies the image")
+	storeName := flag.String("store", "", "store to save the image with: "+storeNames()+" (default: the image's current store, or "+defaultStore+")")
+	encrypt := flag.Bool("encrypt", false, "encrypt the image with a passphrase (env "+passphraseEnv+", or asked for)")
+	decrypt := flag.Bool("decrypt", false, "save the image unencrypted from now on")
+	checkpointRecords := flag.Int("checkpoint", defaultCheckpointRecords, "fold the journal into a new snapshot after this many changes")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: vfs-go-system [-image path] [-store name] [-new] [-readonly] [-c commands] [script [args...]]")
+		fmt.Fprintln(os.Stderr, "       vfs-go-system convert -to <store> <source-image> <dest-image>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	vfs, err := openImage(*imagePath, *fresh, *readOnly)
 	if err != nil {
-		fmt.Println(err)
-		vfs = newVFS()
-		vfs.initAdmin()
-	} else {
-		vfs = &VFS{
-			Root:        TempVFS.Root,
-			CurrentDir:  TempVFS.CurrentDir,
-			CurrentUser: TempVFS.CurrentUser,
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	vfs.CheckpointRecords = *checkpointRecords
+	if *storeName != "" {
+		if _, err := getStore(*storeName); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		vfs.StoreName = *storeName
+	}
+	if *encrypt || *decrypt {
+		if *encrypt && *decrypt {
+			fmt.Fprintln(os.Stderr, "-encrypt and -decrypt cannot be used together")
+			os.Exit(2)
+		}
+		if err := vfs.encryptImage(*encrypt); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
 	}
+	vfs.AutosaveInterval = *autosaveInterval
+	vfs.AutosaveOnChange = *autosaveOnChange
+	vfs.startAutosave()
 
 	usage := GetUsage()
 	commands := GetCommands(vfs, usage)
 	vfs.CommandMap = commands
-	inputs(vfs, commands)
+	vfs.sourceRC(commands)
+
+	switch {
+	case *commandString != "":
+		executeLine(vfs, commands, *commandString)
+	case flag.NArg() > 0:
+		runHostScript(vfs, commands, flag.Arg(0), flag.Args()[1:])
+	case !stdinIsTerminal():
+		script, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading input:", err)
+			vfs.Status = 1
+			break
+		}
+		vfs.runScript(commands, string(script), "stdin", nil)
+	default:
+		inputs(vfs, commands)
+	}
+	vfs.shutdown()
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+// newTestVFS starts a shell on a fresh image in a temporary directory.
+func newTestVFS(t *testing.T) *VFS {
+	t.Helper()
+	vfs, err := openImage(filepath.Join(t.TempDir(), "image.gob"), true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(vfs.closeJournal)
+	vfs.CommandMap = GetCommands(vfs, GetUsage())
+	return vfs
+}
+
+// run executes line and returns what it printed.
+func run(vfs *VFS, line string) string {
+	return string(capture(func() { executeLine(vfs, vfs.CommandMap, line) }))
+}
+
+// writeTestFile writes content to the file at filePath, making the
+// directories on the way.
+func writeTestFile(t *testing.T, vfs *VFS, filePath string, content string) {
+	t.Helper()
+	dirPath, name := path.Split(filePath)
+	if _, err := vfs.storeFile(vfs.mkdirAll(dirPath), name, []byte(content)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readTestFile returns the contents of the file at filePath, and whether
+// there is one.
+func readTestFile(t *testing.T, vfs *VFS, filePath string) (string, bool) {
+	t.Helper()
+	file := vfs.findFileByPath(filePath)
+	if file == nil {
+		return "", false
+	}
+	content, err := vfs.readFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content), true
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The page store keeps every directory and file as its own record in a file
+// of fixed size pages, with an index mapping record keys to page extents.
+// Saving only writes the records whose encoding changed, always into pages
+// the previous index does not use, and then switches to the new index by
+// rewriting the older of two superblock slots in page 0. A crash at any
+// point leaves the previous index and everything it points to intact.
+//
+// Unlike the other stores, saving in place makes no .bak copy: the previous
+// image is still in the file until the next save, and copying the whole
+// file each time would undo the point of writing only what changed. A .bak
+// is only made when a file in another format is laid out as pages.
+//
+//	slot     magic [8] | generation u64 | index page u64 | index length u64 |
+//	         index checksum [32] | slot checksum [32]
+const (
+	pageMagic     = "VFSPAGES"
+	pageSize      = 4096
+	superSlotSize = pageSize / 2
+	superSize     = len(pageMagic) + 8 + 8 + 8 + sha256.Size + sha256.Size
+)
+
+type pageStore struct{}
+
+type pageExtent struct {
+	Page   uint64
+	Length uint64
+	Sum    [sha256.Size]byte
+}
+
+func (e pageExtent) pages() uint64 {
+	return max(1, (e.Length+pageSize-1)/pageSize)
+}
+
+type pageIndex struct {
+	Version uint32
+	Records map[string]pageExtent
+}
+
+type pageSuper struct {
+	Generation uint64
+	Index      pageExtent
+}
+
+// pageDir is the record for one directory; its children are records of
+// their own.
+type pageDir struct {
+	Dir     Directory
+	Files   []string
+	SubDirs []string
+}
+
+// pageRecord is the encoding of one record, or the extent of one already in
+// the file that should be kept as it is.
+type pageRecord struct {
+	data []byte
+	keep *pageExtent
+}
+
+func (pageStore) Save(filename string, state *HelperVFS) error {
+	if state.key != nil {
+		return fmt.Errorf("the page store cannot encrypt images, save with the gob or json store")
+	}
+	records, err := pageRecords(state, filename)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	super, index, err := readPageIndex(file)
+	if info, statErr := file.Stat(); err != nil && statErr == nil && info.Size() == 0 {
+		super, index, err = pageSuper{}, nil, nil
+	}
+	if err != nil {
+		// Not a page store yet (or an unreadable one): lay it out from
+		// scratch next to it and swap it in atomically.
+		file.Close()
+		return writeFileAtomic(filename, func(w io.Writer) error {
+			_, err := writePages(w.(*os.File), pageSuper{}, nil, records)
+			return err
+		})
+	}
+	end, err := writePages(file, super, index, records)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(int64(end) * pageSize); err != nil {
+		return fmt.Errorf("failed to truncate file: %w", err)
+	}
+	return nil
+}
+
+func (pageStore) Load(filename string) (*HelperVFS, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	_, index, err := readPageIndex(file)
+	if err != nil {
+		return nil, err
+	}
+	read := func(key string, value any) error {
+		extent, ok := index.Records[key]
+		if !ok {
+			return fmt.Errorf("page store is missing record %s", key)
+		}
+		data, err := readExtent(file, extent)
+		if err != nil {
+			return fmt.Errorf("record %s: %w", key, err)
+		}
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+	}
+
+	var state HelperVFS
+	if err := read("meta", &state); err != nil {
+		return nil, err
+	}
+	var loadDir func(dirPath string) (*Directory, error)
+	loadDir = func(dirPath string) (*Directory, error) {
+		var record pageDir
+		if err := read("d:"+dirPath, &record); err != nil {
+			return nil, err
+		}
+		dir := record.Dir
+		dir.Files = make(map[string]*File, len(record.Files))
+		dir.SubDirs = make(map[string]*Directory, len(record.SubDirs))
+		for _, name := range record.Files {
+			var file File
+			filePath := joinPath(dirPath, name)
+			if err := read("f:"+filePath, &file); err != nil {
+				return nil, err
+			}
+			dir.Files[name] = &file
+		}
+		for _, name := range record.SubDirs {
+			sub, err := loadDir(joinPath(dirPath, name))
+			if err != nil {
+				return nil, err
+			}
+			dir.SubDirs[name] = sub
+		}
+		return &dir, nil
+	}
+	if state.Root, err = loadDir("/"); err != nil {
+		return nil, err
+	}
+	// Chunks are only read when something first asks for them.
+	compressed := state.Compressed
+	blobs := state.blobStore()
+	for key, extent := range index.Records {
+		if hash, ok := strings.CutPrefix(key, "b:"); ok {
+			blobs.lazy[hash] = lazyBlob{compressedBlob: compressed[hash], source: filename, extent: extent}
+		}
+	}
+	if err := migrateImage(&state, index.Version); err != nil {
+		return nil, err
+	}
+	blobs.recount(state.roots()...)
+	state.store = "page"
+	return &state, nil
+}
+
+// pageRecords encodes the image as one record per directory, one for the
+// metadata of each file, one holding the raw bytes of each chunk, and a
+// "meta" record for everything outside the tree. Chunks that were never
+// loaded from filename are kept where they are.
+func pageRecords(state *HelperVFS, filename string) (map[string]pageRecord, error) {
+	records := make(map[string]pageRecord)
+	encode := func(key string, value any) error {
+		var buffer bytes.Buffer
+		if err := gob.NewEncoder(&buffer).Encode(value); err != nil {
+			return fmt.Errorf("failed to encode %s: %w", key, err)
+		}
+		records[key] = pageRecord{data: buffer.Bytes()}
+		return nil
+	}
+
+	blobs := state.blobStore()
+	compressed, err := state.packBlobs(func(hash string, codec string) error {
+		if lazy, ok := blobs.lazy[hash]; ok && lazy.source == filename && lazy.Codec == codec {
+			records["b:"+hash] = pageRecord{keep: &lazy.extent}
+			return nil
+		}
+		data, err := blobs.pack(hash, codec)
+		records["b:"+hash] = pageRecord{data: data}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	meta := *state
+	meta.Root, meta.Blobs, meta.Compressed = nil, nil, compressed
+	if err := encode("meta", &meta); err != nil {
+		return nil, err
+	}
+
+	var walk func(dirPath string, dir *Directory) error
+	walk = func(dirPath string, dir *Directory) error {
+		record := pageDir{Dir: *dir}
+		record.Dir.Files, record.Dir.SubDirs = nil, nil
+		for name, file := range dir.Files {
+			record.Files = append(record.Files, name)
+			if err := encode("f:"+joinPath(dirPath, name), file); err != nil {
+				return err
+			}
+		}
+		for name, sub := range dir.SubDirs {
+			record.SubDirs = append(record.SubDirs, name)
+			if err := walk(joinPath(dirPath, name), sub); err != nil {
+				return err
+			}
+		}
+		sort.Strings(record.Files)
+		sort.Strings(record.SubDirs)
+		return encode("d:"+dirPath, &record)
+	}
+	if err := walk("/", state.Root); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// writePages stores records in f, reusing the extents of unchanged records
+// from index, and commits a new index through the superblock. It returns the
+// number of pages the new layout occupies.
+func writePages(f *os.File, super pageSuper, index *pageIndex, records map[string]pageRecord) (uint64, error) {
+	alloc := &pageAllocator{}
+	alloc.reserve(pageExtent{Page: 0, Length: pageSize})
+	if index != nil {
+		alloc.reserve(super.Index)
+		for _, extent := range index.Records {
+			alloc.reserve(extent)
+		}
+	}
+
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	next := pageIndex{Version: imageVersion, Records: make(map[string]pageExtent, len(records))}
+	for _, key := range keys {
+		record := records[key]
+		if record.keep != nil && index != nil {
+			next.Records[key] = *record.keep
+			continue
+		}
+		if record.keep != nil {
+			return 0, fmt.Errorf("record %s refers to data that is not in the file", key)
+		}
+		sum := sha256.Sum256(record.data)
+		if index != nil {
+			if old, ok := index.Records[key]; ok && old.Sum == sum {
+				next.Records[key] = old
+				continue
+			}
+		}
+		extent, err := writeExtent(f, alloc, record.data)
+		if err != nil {
+			return 0, err
+		}
+		next.Records[key] = extent
+	}
+
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(&next); err != nil {
+		return 0, fmt.Errorf("failed to encode index: %w", err)
+	}
+	indexExtent, err := writeExtent(f, alloc, buffer.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to sync file: %w", err)
+	}
+
+	nextSuper := pageSuper{Generation: super.Generation + 1, Index: indexExtent}
+	slot := int64(nextSuper.Generation%2) * superSlotSize
+	if _, err := f.WriteAt(encodeSuper(nextSuper), slot); err != nil {
+		return 0, fmt.Errorf("failed to write superblock: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to sync file: %w", err)
+	}
+
+	end := indexExtent.Page + indexExtent.pages()
+	for _, extent := range next.Records {
+		end = max(end, extent.Page+extent.pages())
+	}
+	return end, nil
+}
+
+func writeExtent(f *os.File, alloc *pageAllocator, data []byte) (pageExtent, error) {
+	extent := pageExtent{Length: uint64(len(data)), Sum: sha256.Sum256(data)}
+	extent.Page = alloc.allocate(extent.pages())
+	if _, err := f.WriteAt(data, int64(extent.Page)*pageSize); err != nil {
+		return extent, fmt.Errorf("failed to write page %d: %w", extent.Page, err)
+	}
+	return extent, nil
+}
+
+func readExtent(f *os.File, extent pageExtent) ([]byte, error) {
+	data := make([]byte, extent.Length)
+	if _, err := f.ReadAt(data, int64(extent.Page)*pageSize); err != nil {
+		return nil, fmt.Errorf("failed to read page %d: %w", extent.Page, err)
+	}
+	if sha256.Sum256(data) != extent.Sum {
+		return nil, fmt.Errorf("checksum mismatch at page %d, the file is corrupt", extent.Page)
+	}
+	return data, nil
+}
+
+func encodeSuper(super pageSuper) []byte {
+	buf := make([]byte, 0, superSize)
+	buf = append(buf, pageMagic...)
+	buf = binary.BigEndian.AppendUint64(buf, super.Generation)
+	buf = binary.BigEndian.AppendUint64(buf, super.Index.Page)
+	buf = binary.BigEndian.AppendUint64(buf, super.Index.Length)
+	buf = append(buf, super.Index.Sum[:]...)
+	sum := sha256.Sum256(buf)
+	return append(buf, sum[:]...)
+}
+
+func decodeSuper(buf []byte) (pageSuper, bool) {
+	var super pageSuper
+	if len(buf) < superSize || !bytes.HasPrefix(buf, []byte(pageMagic)) {
+		return super, false
+	}
+	body := buf[:superSize-sha256.Size]
+	if sha256.Sum256(body) != [sha256.Size]byte(buf[len(body):superSize]) {
+		return super, false
+	}
+	fields := body[len(pageMagic):]
+	super.Generation = binary.BigEndian.Uint64(fields[0:8])
+	super.Index.Page = binary.BigEndian.Uint64(fields[8:16])
+	super.Index.Length = binary.BigEndian.Uint64(fields[16:24])
+	copy(super.Index.Sum[:], fields[24:])
+	return super, true
+}
+
+// readPageIndex finds the newest valid superblock slot and loads the index
+// it points to.
+func readPageIndex(f *os.File) (pageSuper, *pageIndex, error) {
+	page := make([]byte, pageSize)
+	if _, err := f.ReadAt(page, 0); err != nil {
+		return pageSuper{}, nil, fmt.Errorf("not a page store: %w", err)
+	}
+	first, firstOK := decodeSuper(page[:superSlotSize])
+	second, secondOK := decodeSuper(page[superSlotSize:])
+
+	candidates := []pageSuper{}
+	if firstOK {
+		candidates = append(candidates, first)
+	}
+	if secondOK {
+		candidates = append(candidates, second)
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Generation > candidates[j].Generation })
+
+	for _, super := range candidates {
+		data, err := readExtent(f, super.Index)
+		if err != nil {
+			continue
+		}
+		var index pageIndex
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&index); err != nil {
+			continue
+		}
+		return super, &index, nil
+	}
+	return pageSuper{}, nil, fmt.Errorf("no valid page store superblock")
+}
+
+// pageAllocator hands out runs of pages that do not overlap any reserved
+// extent, filling gaps first.
+type pageAllocator struct {
+	busy []pageExtent
+}
+
+func (a *pageAllocator) reserve(extent pageExtent) {
+	a.busy = append(a.busy, extent)
+	sort.Slice(a.busy, func(i, j int) bool { return a.busy[i].Page < a.busy[j].Page })
+}
+
+func (a *pageAllocator) allocate(pages uint64) uint64 {
+	start := uint64(0)
+	for _, extent := range a.busy {
+		if extent.Page >= start+pages {
+			break
+		}
+		start = max(start, extent.Page+extent.pages())
+	}
+	a.reserve(pageExtent{Page: start, Length: pages * pageSize})
+	return start
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var hunkHeaderPattern = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// filePatch is the part of a unified diff that changes one file.
+type filePatch struct {
+	From, To string
+	Hunks    []hunk
+}
+
+// patchOptions are the flags of the patch command.
+type patchOptions struct {
+	strip  int
+	fuzz   int
+	dryRun bool
+}
+
+// headerName returns the file named in a "---" or "+++" line, without the
+// timestamp diff puts after it. A file diff -N made up, which it dates to
+// the epoch, is reported as /dev/null.
+func headerName(line string) string {
+	name, stamp, _ := strings.Cut(strings.TrimSpace(line[4:]), "\t")
+	if strings.HasPrefix(stamp, "1970-01-01 00:00:00") {
+		return "/dev/null"
+	}
+	return name
+}
+
+// parsePatch reads the file patches in a unified diff. Anything between
+// them, such as the commands that produced them, is skipped.
+func parsePatch(text string) ([]filePatch, error) {
+	var patches []filePatch
+	lines := splitLines(text)
+	for i := 0; i < len(lines); i++ {
+		if !strings.HasPrefix(lines[i], "--- ") || i+1 >= len(lines) || !strings.HasPrefix(lines[i+1], "+++ ") {
+			continue
+		}
+		patch := filePatch{From: headerName(lines[i]), To: headerName(lines[i+1])}
+		i += 2
+		for i < len(lines) && strings.HasPrefix(lines[i], "@@ ") {
+			h, next, err := parseHunk(lines, i)
+			if err != nil {
+				return nil, err
+			}
+			patch.Hunks = append(patch.Hunks, h)
+			i = next
+		}
+		if len(patch.Hunks) == 0 {
+			return nil, fmt.Errorf("no hunks for %s", patch.To)
+		}
+		patches = append(patches, patch)
+		i--
+	}
+	if len(patches) == 0 {
+		return nil, fmt.Errorf("no unified diff found")
+	}
+	return patches, nil
+}
+
+// parseHunk reads the hunk whose header is lines[start] and returns it with
+// the index of the line after it.
+func parseHunk(lines []string, start int) (hunk, int, error) {
+	match := hunkHeaderPattern.FindStringSubmatch(lines[start])
+	if match == nil {
+		return hunk{}, 0, fmt.Errorf("malformed hunk header at line %d: %s", start+1, strings.TrimSpace(lines[start]))
+	}
+	number := func(value string) int {
+		if value == "" {
+			return 1
+		}
+		n, _ := strconv.Atoi(value)
+		return n
+	}
+	h := hunk{OldStart: number(match[1]), OldLines: number(match[2]), NewStart: number(match[3]), NewLines: number(match[4])}
+	// An empty side names the line before it.
+	if h.OldLines == 0 {
+		h.OldStart++
+	}
+	if h.NewLines == 0 {
+		h.NewStart++
+	}
+	oldLeft, newLeft := h.OldLines, h.NewLines
+	i := start + 1
+	for ; i < len(lines) && (oldLeft > 0 || newLeft > 0); i++ {
+		line := lines[i]
+		kind := byte(' ')
+		if line != "\n" {
+			kind, line = line[0], line[1:]
+		}
+		switch kind {
+		case ' ':
+			oldLeft--
+			newLeft--
+		case '-':
+			oldLeft--
+		case '+':
+			newLeft--
+		case '\\':
+			last := &h.Ops[len(h.Ops)-1]
+			last.Line = strings.TrimSuffix(last.Line, "\n")
+			continue
+		default:
+			return hunk{}, 0, fmt.Errorf("malformed line %d in hunk: %s", i+1, strings.TrimSpace(lines[i]))
+		}
+		h.Ops = append(h.Ops, diffOp{kind, line})
+	}
+	if oldLeft != 0 || newLeft != 0 {
+		return hunk{}, 0, fmt.Errorf("hunk at line %d is truncated", start+1)
+	}
+	if i < len(lines) && strings.HasPrefix(lines[i], "\\") {
+		last := &h.Ops[len(h.Ops)-1]
+		last.Line = strings.TrimSuffix(last.Line, "\n")
+		i++
+	}
+	return h, i, nil
+}
+
+// sides returns the lines a hunk expects to find and the lines it puts in
+// their place.
+func sides(ops []diffOp) ([]string, []string) {
+	var old, updated []string
+	for _, op := range ops {
+		if op.Kind != '+' {
+			old = append(old, op.Line)
+		}
+		if op.Kind != '-' {
+			updated = append(updated, op.Line)
+		}
+	}
+	return old, updated
+}
+
+// placeHunk finds where h applies in lines, searching outward from where it
+// is expected and no earlier than from. With fuzz it may ignore up to that
+// many lines of context at either end. It returns the index it applies at
+// and how many lines of context it left off the front and the back.
+func placeHunk(lines []string, h hunk, expected int, from int, fuzz int) (int, int, int, bool) {
+	leading, trailing := 0, 0
+	for leading < len(h.Ops) && h.Ops[leading].Kind == ' ' {
+		leading++
+	}
+	for trailing < len(h.Ops)-leading && h.Ops[len(h.Ops)-1-trailing].Kind == ' ' {
+		trailing++
+	}
+	for f := 0; f <= fuzz; f++ {
+		dropFront, dropBack := min(f, leading), min(f, trailing)
+		if f > 0 && dropFront < f && dropBack < f {
+			break
+		}
+		ops := h.Ops[dropFront : len(h.Ops)-dropBack]
+		old, _ := sides(ops)
+		at := expected + dropFront
+		for distance := 0; ; distance++ {
+			below, above := at-distance, at+distance
+			if below < from && above+len(old) > len(lines) {
+				break
+			}
+			for _, pos := range []int{below, above} {
+				if pos >= from && pos+len(old) <= len(lines) && slices.Equal(lines[pos:pos+len(old)], old) {
+					return pos, dropFront, dropBack, true
+				}
+			}
+		}
+	}
+	return 0, 0, 0, false
+}
+
+// applyHunks applies the hunks of a file patch to lines. It returns the
+// patched lines and the hunks that did not apply.
+func applyHunks(lines []string, hunks []hunk, fuzz int) ([]string, []hunk) {
+	lines = slices.Clone(lines)
+	var rejected []hunk
+	from, delta, offset := 0, 0, 0
+	for n, h := range hunks {
+		expected := h.OldStart - 1 + delta + offset
+		pos, dropFront, dropBack, ok := placeHunk(lines, h, expected, from, fuzz)
+		if !ok {
+			fmt.Printf("Hunk #%d FAILED at %d.\n", n+1, h.OldStart)
+			rejected = append(rejected, h)
+			continue
+		}
+		old, updated := sides(h.Ops[dropFront : len(h.Ops)-dropBack])
+		lines = slices.Replace(lines, pos, pos+len(old), updated...)
+		fuzzed := max(dropFront, dropBack)
+		offset = pos - (h.OldStart - 1 + delta + dropFront)
+		delta += len(updated) - len(old)
+		from = pos + len(updated)
+		switch {
+		case fuzzed > 0 && offset != 0:
+			fmt.Printf("Hunk #%d succeeded at %d with fuzz %d (offset %d lines).\n", n+1, pos+1, fuzzed, offset)
+		case fuzzed > 0:
+			fmt.Printf("Hunk #%d succeeded at %d with fuzz %d.\n", n+1, pos+1, fuzzed)
+		case offset != 0:
+			fmt.Printf("Hunk #%d succeeded at %d (offset %d lines).\n", n+1, pos+1, offset)
+		}
+	}
+	return lines, rejected
+}
+
+// stripPath removes the first strip directories from name, as patch -p
+// does.
+func stripPath(name string, strip int) (string, bool) {
+	parts := strings.Split(name, "/")
+	if strip >= len(parts) {
+		return "", false
+	}
+	return strings.Join(parts[strip:], "/"), true
+}
+
+// patchTarget works out which file a file patch changes. It returns the
+// path relative to the current directory and whether the patch creates it.
+func (vfs *VFS) patchTarget(patch filePatch, strip int) (string, bool, error) {
+	var candidates []string
+	for _, name := range []string{patch.To, patch.From} {
+		if name == "/dev/null" {
+			continue
+		}
+		stripped, ok := stripPath(name, strip)
+		if !ok {
+			return "", false, fmt.Errorf("cannot strip %d directories from %s", strip, name)
+		}
+		candidates = append(candidates, stripped)
+	}
+	for _, candidate := range candidates {
+		if _, file, err := vfs.lookup(candidate); err == nil && file != nil {
+			return candidate, false, nil
+		}
+	}
+	if patch.From == "/dev/null" && len(candidates) > 0 {
+		return candidates[0], true, nil
+	}
+	if len(candidates) == 0 {
+		return "", false, fmt.Errorf("patch names no file")
+	}
+	return "", false, fmt.Errorf("cannot find file to patch: %s", candidates[0])
+}
+
+// patch applies the unified diff in the file patchName. Each file it
+// changes is found from the diff's headers, or is target if one is given.
+// Hunks that do not apply are saved to the file's name with .rej appended.
+func (vfs *VFS) patch(patchName string, target string, options patchOptions) {
+	_, patchFile := vfs.readableFile(patchName)
+	if patchFile == nil {
+		return
+	}
+	content, err := vfs.readFile(patchFile)
+	if err != nil {
+		vfs.fail("Error reading", patchName+":", err)
+		return
+	}
+	patches, err := parsePatch(string(content))
+	if err != nil {
+		vfs.fail("patch:", err)
+		return
+	}
+	failed := false
+	for _, patch := range patches {
+		name, creating := target, false
+		if name == "" {
+			if name, creating, err = vfs.patchTarget(patch, options.strip); err != nil {
+				vfs.fail("patch:", err)
+				failed = true
+				continue
+			}
+		}
+		if !vfs.patchFile(name, creating, patch, options) {
+			failed = true
+		}
+	}
+	if failed {
+		vfs.Status = 1
+	}
+}
+
+// patchFile applies one file patch to the file at target and reports
+// whether every hunk applied.
+func (vfs *VFS) patchFile(target string, creating bool, patch filePatch, options patchOptions) bool {
+	dirPath, name := path.Split(target)
+	dir, err := vfs.resolveDir(dirPath)
+	if err != nil {
+		vfs.fail(err)
+		return false
+	}
+	var original []byte
+	file, exists := dir.Files[name]
+	switch {
+	case exists && !checkOverlap(file.WritePermission, vfs.CurrentUser.GroupPerms):
+		vfs.deny("write", joinPath(dir.Path, name), "You do not have write permissions for", target)
+		return false
+	case exists:
+		if original, err = vfs.readFile(file); err != nil {
+			vfs.fail("Error reading", target+":", err)
+			return false
+		}
+	case !creating:
+		vfs.fail("patch: cannot find file to patch:", target)
+		return false
+	}
+	if patch.From == "/dev/null" && len(original) > 0 {
+		vfs.fail("patch:", target, "already exists, the patch may have been applied")
+		return false
+	}
+
+	verb := "patching"
+	if options.dryRun {
+		verb = "checking"
+	}
+	fmt.Println(verb, "file", target)
+	lines, rejected := applyHunks(splitLines(string(original)), patch.Hunks, options.fuzz)
+	if options.dryRun {
+		return len(rejected) == 0
+	}
+
+	patched := []byte(strings.Join(lines, ""))
+	if !vfs.writable(dir, name, len(patched)) {
+		return false
+	}
+	switch {
+	case patch.To == "/dev/null" && len(rejected) == 0 && len(patched) == 0 && exists:
+		vfs.atPath(target, func(name string) { vfs.rm(name, false, false) })
+	case !exists:
+		vfs.atPath(target, func(name string) {
+			vfs.touch(name)
+			if _, created := vfs.CurrentDir.Files[name]; created {
+				if _, err := vfs.storeFile(vfs.CurrentDir, name, patched); err != nil {
+					vfs.fail("Error writing", target+":", err)
+				}
+			}
+		})
+	case !bytes.Equal(original, patched):
+		if _, err := vfs.storeFile(dir, name, patched); err != nil {
+			vfs.fail("Error writing", target+":", err)
+			return false
+		}
+	}
+	if len(rejected) == 0 {
+		return true
+	}
+
+	if !checkOverlap(dir.WritePermission, vfs.CurrentUser.GroupPerms) {
+		fmt.Printf("%d out of %d hunks FAILED\n", len(rejected), len(patch.Hunks))
+		return false
+	}
+	var rejects bytes.Buffer
+	writeUnified(&rejects, patch.From, patch.To, rejected)
+	rejectName := name + ".rej"
+	if !vfs.writable(dir, rejectName, rejects.Len()) {
+		fmt.Printf("%d out of %d hunks FAILED\n", len(rejected), len(patch.Hunks))
+		return false
+	}
+	if _, err := vfs.storeFile(dir, rejectName, rejects.Bytes()); err != nil {
+		vfs.fail("Error writing", rejectName+":", err)
+		return false
+	}
+	fmt.Printf("%d out of %d hunks FAILED -- saving rejects to file %s\n", len(rejected), len(patch.Hunks), joinPath(dirPath, rejectName))
+	return false
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApplyHunks(t *testing.T) {
+	const patch = "--- a\n+++ b\n@@ -3,5 +3,5 @@\n 3\n 4\n-5\n+five\n 6\n 7\n"
+	tests := []struct {
+		name     string
+		original string
+		fuzz     int
+		want     string
+		rejected int
+	}{
+		{
+			name:     "in place",
+			original: "1\n2\n3\n4\n5\n6\n7\n8\n",
+			want:     "1\n2\n3\n4\nfive\n6\n7\n8\n",
+		},
+		{
+			name:     "offset",
+			original: "0\n0\n1\n2\n3\n4\n5\n6\n7\n8\n",
+			want:     "0\n0\n1\n2\n3\n4\nfive\n6\n7\n8\n",
+		},
+		{
+			name:     "context changed without fuzz",
+			original: "1\n2\nthree\n4\n5\n6\n7\n8\n",
+			rejected: 1,
+			want:     "1\n2\nthree\n4\n5\n6\n7\n8\n",
+		},
+		{
+			name:     "context changed with fuzz",
+			original: "1\n2\nthree\n4\n5\n6\n7\n8\n",
+			fuzz:     1,
+			want:     "1\n2\nthree\n4\nfive\n6\n7\n8\n",
+		},
+		{
+			name:     "changed line already gone",
+			original: "1\n2\n3\n4\nV\n6\n7\n8\n",
+			fuzz:     2,
+			rejected: 1,
+			want:     "1\n2\n3\n4\nV\n6\n7\n8\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			patches, err := parsePatch(patch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var lines []string
+			var rejected []hunk
+			capture(func() {
+				lines, rejected = applyHunks(splitLines(test.original), patches[0].Hunks, test.fuzz)
+			})
+			if got := strings.Join(lines, ""); got != test.want || len(rejected) != test.rejected {
+				t.Errorf("patched to %q with %d rejects, want %q with %d", got, len(rejected), test.want, test.rejected)
+			}
+		})
+	}
+}
+
+func TestParsePatchErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		patch string
+		want  string
+	}{
+		{"no diff", "hello\n", "no unified diff found"},
+		{"no hunks", "--- a\n+++ b\n", "no hunks for b"},
+		{"bad header", "--- a\n+++ b\n@@ nonsense @@\n", "malformed hunk header"},
+		{"bad line", "--- a\n+++ b\n@@ -1,2 +1,2 @@\n a\n?b\n", "malformed line"},
+		{"truncated", "--- a\n+++ b\n@@ -1,3 +1,3 @@\n a\n", "is truncated"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parsePatch(test.patch)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got error %v, want one about %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestPatchAppliesDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+	}{
+		{"change", "1\n2\n3\n4\n5\n6\n7\n8\n9\n", "1\ntwo\n3\n4\n5\n6\n7\neight\n9\n"},
+		{"far apart", "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n", "0\n1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n"},
+		{"no newline at end", "1\n2\n3", "1\n2\n3\n4"},
+		{"filled", "", "1\n2\n"},
+		{"emptied", "1\n2\n", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vfs := newTestVFS(t)
+			run(vfs, "mkdir /w; cd /w")
+			writeTestFile(t, vfs, "/w/a.txt", test.from)
+			writeTestFile(t, vfs, "/w/b.txt", test.to)
+			run(vfs, "diff a.txt b.txt >> p.diff")
+			if vfs.Status != 1 {
+				t.Fatalf("diff exited with status %d", vfs.Status)
+			}
+			output := run(vfs, "patch p.diff a.txt")
+			if vfs.Status != 0 {
+				t.Fatalf("patch failed:\n%s", output)
+			}
+			if got, _ := readTestFile(t, vfs, "/w/a.txt"); got != test.to {
+				t.Errorf("patched a.txt holds %q, want %q", got, test.to)
+			}
+		})
+	}
+}
+
+func TestPatchSavesRejects(t *testing.T) {
+	vfs := newTestVFS(t)
+	run(vfs, "mkdir /w; cd /w")
+	writeTestFile(t, vfs, "/w/a.txt", "1\n2\n3\n")
+	writeTestFile(t, vfs, "/w/p.diff", "--- a.txt\n+++ a.txt\n@@ -1,3 +1,3 @@\n 1\n-x\n+y\n 3\n")
+	output := run(vfs, "patch -F0 p.diff")
+	if vfs.Status == 0 {
+		t.Error("patch with a failed hunk succeeded")
+	}
+	if !strings.Contains(output, "1 out of 1 hunks FAILED -- saving rejects to file a.txt.rej") {
+		t.Errorf("patch printed %q", output)
+	}
+	if got, _ := readTestFile(t, vfs, "/w/a.txt"); got != "1\n2\n3\n" {
+		t.Errorf("a.txt was changed to %q", got)
+	}
+	if got, _ := readTestFile(t, vfs, "/w/a.txt.rej"); !strings.Contains(got, "-x\n+y\n") {
+		t.Errorf("a.txt.rej holds %q", got)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPS1 = `\u@\h:\w\$ `
+	defaultPS2 = "> "
+)
+
+func (vfs *VFS) initEnv() {
+	if vfs.Env == nil {
+		vfs.Env = make(map[string]string)
+	}
+	if _, ok := vfs.Env["PS1"]; !ok {
+		vfs.Env["PS1"] = defaultPS1
+	}
+	if _, ok := vfs.Env["PS2"]; !ok {
+		vfs.Env["PS2"] = defaultPS2
+	}
+}
+
+func (vfs *VFS) prompt(name string) string {
+	return vfs.expandPrompt(vfs.Env[name])
+}
+
+// expandPrompt understands the bash prompt escapes, plus \? and $? for the
+// status of the last command.
+func (vfs *VFS) expandPrompt(ps string) string {
+	var out strings.Builder
+	now := time.Now()
+
+	for i := 0; i < len(ps); i++ {
+		c := ps[i]
+		if c == '$' && i+1 < len(ps) && ps[i+1] == '?' {
+			out.WriteString(strconv.Itoa(vfs.Status))
+			i++
+			continue
+		}
+		if c != '\\' || i+1 >= len(ps) {
+			out.WriteByte(c)
+			continue
+		}
+		i++
+		switch ps[i] {
+		case 'u':
+			if vfs.CurrentUser != nil {
+				out.WriteString(vfs.CurrentUser.Name)
+			}
+		case 'h':
+			host, _, _ := strings.Cut(vfs.MachineName, ".")
+			out.WriteString(host)
+		case 'H':
+			out.WriteString(vfs.MachineName)
+		case 'w':
+			out.WriteString(path.Clean(vfs.CurrentDir.Path))
+		case 'W':
+			out.WriteString(path.Base(path.Clean(vfs.CurrentDir.Path)))
+		case '$':
+			if vfs.isAdmin() {
+				out.WriteByte('#')
+			} else {
+				out.WriteByte('$')
+			}
+		case '?':
+			out.WriteString(strconv.Itoa(vfs.Status))
+		case 's':
+			out.WriteString("vsh")
+		case 't':
+			out.WriteString(now.Format("15:04:05"))
+		case 'T':
+			out.WriteString(now.Format("03:04:05"))
+		case '@':
+			out.WriteString(now.Format("03:04 PM"))
+		case 'A':
+			out.WriteString(now.Format("15:04"))
+		case 'd':
+			out.WriteString(now.Format("Mon Jan 02"))
+		case 'e':
+			out.WriteByte(0x1b)
+		case 'a':
+			out.WriteByte(0x07)
+		case 'n':
+			out.WriteByte('\n')
+		case 'r':
+			out.WriteByte('\r')
+		case '[', ']':
+			// Non-printing sequence markers only matter to readline.
+		case '\\':
+			out.WriteByte('\\')
+		case '0':
+			// \0nn is an octal escape of three digits at most, as in bash.
+			end := i + 1
+			for end < len(ps) && end < i+3 && ps[end] >= '0' && ps[end] <= '7' {
+				end++
+			}
+			value, err := strconv.ParseUint(ps[i:end], 8, 8)
+			if err != nil {
+				out.WriteString(`\0`)
+				continue
+			}
+			out.WriteByte(byte(value))
+			i = end - 1
+		default:
+			out.WriteByte('\\')
+			out.WriteByte(ps[i])
+		}
+	}
+	return out.String()
+}
+
+func (vfs *VFS) isAdmin() bool {
+	return vfs.CurrentUser != nil && checkOverlap(vfs.CurrentUser.GroupPerms, []int{0})
+}
+
+// needsContinuation reports whether input is incomplete and the shell should
+// keep reading with the PS2 prompt: an unclosed quote, an unclosed { block or
+// a trailing backslash. The shell has no if, for or while, so there are no
+// such blocks to wait for. A } with nothing open is left for the command to
+// reject rather than cancelling out a { after it.
+func needsContinuation(input string) bool {
+	var quote byte
+	escaped := false
+	depth := 0
+	for i := 0; i < len(input); i++ {
+		c := input[i]
+		if escaped {
+			escaped = false
+			continue
+		}
+		switch {
+		case c == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '{':
+			depth++
+		case c == '}' && depth > 0:
+			depth--
+		}
+	}
+	return quote != 0 || escaped || depth > 0
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestNeedsContinuation(t *testing.T) {
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{"ls", false},
+		{"echo a.txt 'open", true},
+		{`echo a.txt "closed"`, false},
+		{`echo a.txt "it's"`, false},
+		{`echo a.txt 'back\'`, false},
+		{`ls \`, true},
+		{`ls \\`, false},
+		{"greet() {", true},
+		{"greet() { echo a.txt hi; }", false},
+		{"greet() { { }", true},
+		{"echo a.txt '{'", false},
+		{"}", false},
+		{"}{", true},
+		{"} } {", true},
+	}
+	for _, test := range tests {
+		if got := needsContinuation(test.input); got != test.want {
+			t.Errorf("needsContinuation(%q) = %v, want %v", test.input, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Quota limits the bytes and the number of files and directories (inodes)
+// a user may own, or that a directory tree may hold whoever owns them.
+// Going over a soft limit prints a warning; a change that would go over a
+// hard limit is refused. Zero means no limit.
+type Quota struct {
+	SoftBytes  int
+	HardBytes  int
+	SoftInodes int
+	HardInodes int
+}
+
+// quotaUsage is how many bytes and inodes something uses, or a change
+// would add.
+type quotaUsage struct {
+	bytes  int
+	inodes int
+}
+
+// quotaCounters keeps what each user owns and what the tree under each
+// directory with a quota holds, so that checks need not walk the tree.
+// Writes, new files and new directories update them as they happen; other
+// changes to the tree drop them, and they are counted afresh when next
+// needed.
+type quotaCounters struct {
+	owners map[string]quotaUsage
+	dirs   map[string]quotaUsage
+	sizes  map[*File]int // the size each file is counted with
+}
+
+// charge adds used, owned by owner, to the directory at dirPath.
+func (counters *quotaCounters) charge(dirPath string, owner string, used quotaUsage) {
+	total := counters.owners[owner]
+	counters.owners[owner] = quotaUsage{total.bytes + used.bytes, total.inodes + used.inodes}
+	for quotaPath, total := range counters.dirs {
+		if quotaPath == "/" || dirPath == quotaPath || strings.HasPrefix(dirPath, quotaPath+"/") {
+			counters.dirs[quotaPath] = quotaUsage{total.bytes + used.bytes, total.inodes + used.inodes}
+		}
+	}
+}
+
+// usage returns the quota counters, counting them first if they were
+// dropped.
+func (vfs *VFS) usage() *quotaCounters {
+	if vfs.quotaCounts != nil {
+		return vfs.quotaCounts
+	}
+	counters := &quotaCounters{
+		owners: make(map[string]quotaUsage),
+		dirs:   make(map[string]quotaUsage),
+		sizes:  make(map[*File]int),
+	}
+	for quotaPath := range vfs.DirQuotas {
+		if dir := vfs.findDirectoryByPath(quotaPath); dir != nil && dir.Path == quotaPath {
+			counters.dirs[quotaPath] = quotaUsage{}
+		}
+	}
+	// The audit log is the shell's own and is left out.
+	var walk func(dir *Directory)
+	walk = func(dir *Directory) {
+		for _, file := range dir.Files {
+			counters.charge(dir.Path, file.Owner, quotaUsage{file.Size, 1})
+			counters.sizes[file] = file.Size
+		}
+		for _, sub := range dir.SubDirs {
+			if sub.Path == auditLogDir {
+				continue
+			}
+			counters.charge(dir.Path, sub.Owner, quotaUsage{0, 1})
+			walk(sub)
+		}
+	}
+	walk(vfs.Root)
+	vfs.quotaCounts = counters
+	return counters
+}
+
+// countMutation brings the quota counters up to date with rec, or drops
+// them if it is a change they cannot follow.
+func (vfs *VFS) countMutation(rec journalRecord) {
+	counters := vfs.quotaCounts
+	if counters == nil {
+		return
+	}
+	if rec.Path == auditLogDir || strings.HasPrefix(rec.Path, auditLogDir+"/") {
+		return
+	}
+	switch rec.Op {
+	case "create", "write", "writeat", "truncate":
+		dirPath, name := path.Split(rec.Path)
+		dir := vfs.findDirectoryByPath(dirPath)
+		if dir == nil || dir.Files[name] == nil {
+			vfs.quotaCounts = nil
+			return
+		}
+		file := dir.Files[name]
+		size, counted := counters.sizes[file]
+		added := quotaUsage{file.Size - size, 0}
+		if !counted {
+			added.inodes = 1
+		}
+		counters.sizes[file] = file.Size
+		counters.charge(dir.Path, file.Owner, added)
+	case "mkdir":
+		dir := vfs.findDirectoryByPath(rec.Path)
+		if dir == nil {
+			vfs.quotaCounts = nil
+			return
+		}
+		counters.charge(dir.Parent, dir.Owner, quotaUsage{0, 1})
+		if _, exists := vfs.DirQuotas[dir.Path]; exists {
+			counters.dirs[dir.Path] = quotaUsage{}
+		}
+	case "chmod", "compress", "utime", "sethost", "setenv", "unsetenv", "index",
+		"snapshot", "snapshot-delete", "purge", "audit", "vault-create", "vault":
+		// Locking and unlocking a vault drop the counters themselves.
+	default:
+		vfs.quotaCounts = nil
+	}
+}
+
+// dirQuotas returns the paths of the directory quotas that cover dirPath,
+// outermost first.
+func (vfs *VFS) dirQuotas(dirPath string) []string {
+	var paths []string
+	for _, quotaPath := range sortedKeys(vfs.DirQuotas) {
+		if quotaPath == "/" || dirPath == quotaPath || strings.HasPrefix(dirPath, quotaPath+"/") {
+			paths = append(paths, quotaPath)
+		}
+	}
+	return paths
+}
+
+// exceeds checks used plus added against quota. It fails and returns true
+// if that would go over a hard limit, and warns if it would go over a soft
+// one.
+func (vfs *VFS) exceeds(subject string, quota *Quota, used quotaUsage, added quotaUsage) bool {
+	after := quotaUsage{used.bytes + added.bytes, used.inodes + added.inodes}
+	switch {
+	case added.bytes > 0 && quota.HardBytes > 0 && after.bytes > quota.HardBytes:
+		vfs.fail("Disk quota exceeded:", subject, "would use", after.bytes, "bytes, over the hard limit of", quota.HardBytes)
+		return true
+	case added.inodes > 0 && quota.HardInodes > 0 && after.inodes > quota.HardInodes:
+		vfs.fail("Disk quota exceeded:", subject, "would hold", after.inodes, "files and directories, over the hard limit of", quota.HardInodes)
+		return true
+	}
+	if added.bytes > 0 && quota.SoftBytes > 0 && after.bytes > quota.SoftBytes {
+		fmt.Println("Warning:", subject, "is over the soft limit of", quota.SoftBytes, "bytes")
+	}
+	if added.inodes > 0 && quota.SoftInodes > 0 && after.inodes > quota.SoftInodes {
+		fmt.Println("Warning:", subject, "is over the soft limit of", quota.SoftInodes, "files and directories")
+	}
+	return false
+}
+
+// quotaCharge is what one change adds to the directory at dirPath, owned by
+// owner.
+type quotaCharge struct {
+	dirPath string
+	owner   string
+	added   quotaUsage
+}
+
+// withinQuota reports whether the quotas allow adding to the directory at
+// dirPath what charges lists for each owner. It prints why when they do
+// not.
+func (vfs *VFS) withinQuota(dirPath string, charges map[string]quotaUsage) bool {
+	var all []quotaCharge
+	for _, owner := range sortedKeys(charges) {
+		all = append(all, quotaCharge{dirPath, owner, charges[owner]})
+	}
+	return vfs.withinQuotas(all)
+}
+
+// withinQuotas reports whether the quotas allow making all of charges
+// together, for changes spread over several directories.
+func (vfs *VFS) withinQuotas(charges []quotaCharge) bool {
+	owners := make(map[string]quotaUsage)
+	dirs := make(map[string]quotaUsage)
+	add := func(totals map[string]quotaUsage, key string, added quotaUsage) {
+		total := totals[key]
+		totals[key] = quotaUsage{total.bytes + added.bytes, total.inodes + added.inodes}
+	}
+	for _, charge := range charges {
+		add(owners, charge.owner, charge.added)
+		for _, quotaPath := range vfs.dirQuotas(charge.dirPath) {
+			add(dirs, quotaPath, charge.added)
+		}
+	}
+	for _, owner := range sortedKeys(owners) {
+		if quota := vfs.UserQuotas[owner]; quota != nil && vfs.exceeds("user "+owner, quota, vfs.usage().owners[owner], owners[owner]) {
+			return false
+		}
+	}
+	for _, quotaPath := range sortedKeys(dirs) {
+		used, exists := vfs.usage().dirs[quotaPath]
+		if !exists {
+			continue
+		}
+		if vfs.exceeds(quotaPath, vfs.DirQuotas[quotaPath], used, dirs[quotaPath]) {
+			return false
+		}
+	}
+	return true
+}
+
+// chargeable reports whether adding bytes and inodes owned by owner to the
+// directory at dirPath stays within the quotas.
+func (vfs *VFS) chargeable(dirPath string, owner string, bytes int, inodes int) bool {
+	return vfs.withinQuota(dirPath, map[string]quotaUsage{owner: {bytes, inodes}})
+}
+
+// writable reports whether writing size bytes to name in dir stays within
+// the quotas, counting the file itself if it does not exist yet.
+func (vfs *VFS) writable(dir *Directory, name string, size int) bool {
+	if file, exists := dir.Files[name]; exists {
+		return vfs.chargeable(dir.Path, file.Owner, size-file.Size, 0)
+	}
+	return vfs.chargeable(dir.Path, vfs.userName(), size, 1)
+}
+
+// movable reports whether moving file from the directory at fromPath to the
+// one at toPath stays within the quotas of the directories it enters. Its
+// owner stays the same, so user quotas are not affected.
+func (vfs *VFS) movable(fromPath string, toPath string, file *File) bool {
+	left := make(map[string]bool)
+	for _, quotaPath := range vfs.dirQuotas(fromPath) {
+		left[quotaPath] = true
+	}
+	for _, quotaPath := range vfs.dirQuotas(toPath) {
+		used, exists := vfs.usage().dirs[quotaPath]
+		if left[quotaPath] || !exists {
+			continue
+		}
+		if vfs.exceeds(quotaPath, vfs.DirQuotas[quotaPath], used, quotaUsage{file.Size, 1}) {
+			return false
+		}
+	}
+	return true
+}
+
+// copyCharges is what copying file or dir over replaced adds, by owner.
+// Copies keep the owners of what they were copied from.
+func copyCharges(file *File, dir *Directory, replaced *File) map[string]quotaUsage {
+	charges := make(map[string]quotaUsage)
+	add := func(owner string, bytes int, inodes int) {
+		charge := charges[owner]
+		charges[owner] = quotaUsage{charge.bytes + bytes, charge.inodes + inodes}
+	}
+	if file != nil {
+		add(file.Owner, file.Size, 1)
+	} else {
+		add(dir.Owner, 0, 1)
+		walkFiles(dir, func(file *File) { add(file.Owner, file.Size, 1) })
+		walkDirs(dir, func(sub *Directory) { add(sub.Owner, 0, 1) })
+	}
+	if replaced != nil {
+		add(replaced.Owner, -replaced.Size, -1)
+	}
+	return charges
+}
+
+// parseLimit reads a limit such as 500, 64K, 10M or 1G. The suffixes are
+// powers of 1024.
+func parseLimit(value string) (int, error) {
+	multiplier := 1
+	if n := len(value); n > 0 {
+		switch strings.ToUpper(value[n-1:]) {
+		case "K":
+			multiplier = 1 << 10
+		case "M":
+			multiplier = 1 << 20
+		case "G":
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			value = value[:n-1]
+		}
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid limit %q", value)
+	}
+	return n * multiplier, nil
+}
+
+// setQuota sets the quota of a user, or of a directory when dir is set, to
+// limits. All zero limits remove the quota.
+func (vfs *VFS) setQuota(name string, dir bool, limits []string) {
+	if !vfs.isAdmin() {
+		vfs.deny("quota", name, "Only an administrator can set quotas")
+		return
+	}
+	var values [4]int
+	for i, limit := range limits {
+		n, err := parseLimit(limit)
+		if err != nil {
+			vfs.fail("setquota:", err)
+			return
+		}
+		values[i] = n
+	}
+	quota := &Quota{SoftBytes: values[0], HardBytes: values[1], SoftInodes: values[2], HardInodes: values[3]}
+	if quota.HardBytes > 0 && quota.SoftBytes > quota.HardBytes || quota.HardInodes > 0 && quota.SoftInodes > quota.HardInodes {
+		vfs.fail("setquota: a soft limit cannot be above its hard limit")
+		return
+	}
+	kind := "user"
+	if dir {
+		target, err := vfs.resolveDir(name)
+		if err != nil {
+			vfs.fail(err)
+			return
+		}
+		kind, name = "dir", target.Path
+	} else if _, exists := vfs.Users[name]; !exists {
+		vfs.fail("No such user:", name)
+		return
+	}
+	if *quota == (Quota{}) {
+		quota = nil
+	}
+	vfs.applyQuota(kind, name, quota)
+	rec := journalRecord{Op: "quota", Path: name, Content: kind}
+	if quota != nil {
+		data, err := json.Marshal(quota)
+		if err != nil {
+			vfs.fail("Error encoding quota:", err)
+			return
+		}
+		rec.Data = data
+	}
+	vfs.logMutation(rec)
+	if quota == nil {
+		fmt.Println("Removed the quota of", kind, name)
+		return
+	}
+	fmt.Println("Set the quota of", kind, name)
+}
+
+// applyQuota sets or, when quota is nil, removes the quota of a user or
+// directory.
+func (vfs *VFS) applyQuota(kind string, name string, quota *Quota) {
+	quotas := &vfs.UserQuotas
+	if kind == "dir" {
+		quotas = &vfs.DirQuotas
+	}
+	if quota == nil {
+		delete(*quotas, name)
+		return
+	}
+	if *quotas == nil {
+		*quotas = make(map[string]*Quota)
+	}
+	(*quotas)[name] = quota
+}
+
+func printQuotaHeader(first string) {
+	fmt.Printf("%-20s %2s %10s %10s %10s %8s %8s %8s\n", first, "", "Used", "Soft", "Hard", "Inodes", "Soft", "Hard")
+}
+
+// printQuota prints one line of a quota report. The flags show a + where
+// the bytes, then the inodes, are over the soft limit.
+func printQuota(name string, used quotaUsage, quota *Quota, human bool) {
+	if quota == nil {
+		quota = &Quota{}
+	}
+	limit := func(n int, bytes bool) string {
+		switch {
+		case n == 0:
+			return "-"
+		case bytes:
+			return formatSize(n, human)
+		}
+		return strconv.Itoa(n)
+	}
+	over := func(used int, soft int) string {
+		if soft > 0 && used > soft {
+			return "+"
+		}
+		return "-"
+	}
+	fmt.Printf("%-20s %2s %10s %10s %10s %8d %8s %8s\n", name,
+		over(used.bytes, quota.SoftBytes)+over(used.inodes, quota.SoftInodes),
+		formatSize(used.bytes, human), limit(quota.SoftBytes, true), limit(quota.HardBytes, true),
+		used.inodes, limit(quota.SoftInodes, false), limit(quota.HardInodes, false))
+}
+
+// quota prints the usage and limits of user, and of the directory quotas
+// that apply to everyone.
+func (vfs *VFS) quota(user string, human bool) {
+	if user != vfs.userName() && !vfs.isAdmin() {
+		vfs.deny("quota", user, "Only an administrator can see the quotas of other users")
+		return
+	}
+	if _, exists := vfs.Users[user]; !exists {
+		vfs.fail("No such user:", user)
+		return
+	}
+	printQuotaHeader("User")
+	printQuota(user, vfs.usage().owners[user], vfs.UserQuotas[user], human)
+	vfs.printDirQuotas(human)
+}
+
+func (vfs *VFS) printDirQuotas(human bool) {
+	if len(vfs.DirQuotas) == 0 {
+		return
+	}
+	fmt.Println()
+	printQuotaHeader("Directory")
+	for _, quotaPath := range sortedKeys(vfs.DirQuotas) {
+		printQuota(quotaPath, vfs.usage().dirs[quotaPath], vfs.DirQuotas[quotaPath], human)
+	}
+}
+
+// repquota prints the usage and limits of every user and every directory
+// with a quota.
+func (vfs *VFS) repquota(human bool) {
+	if !vfs.isAdmin() {
+		vfs.deny("quota", "", "Only an administrator can report on all quotas")
+		return
+	}
+	used := vfs.usage().owners
+	names := make(map[string]bool)
+	for name := range vfs.Users {
+		names[name] = true
+	}
+	for name := range vfs.UserQuotas {
+		names[name] = true
+	}
+	printQuotaHeader("User")
+	for _, name := range sortedKeys(names) {
+		printQuota(name, used[name], vfs.UserQuotas[name], human)
+	}
+	vfs.printDirQuotas(human)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"500", 500, false},
+		{"64K", 64 << 10, false},
+		{"10m", 10 << 20, false},
+		{"1G", 1 << 30, false},
+		{"", 0, true},
+		{"K", 0, true},
+		{"-5", 0, true},
+		{"5T", 0, true},
+	}
+	for _, test := range tests {
+		got, err := parseLimit(test.value)
+		if got != test.want || (err != nil) != test.wantErr {
+			t.Errorf("parseLimit(%q) = %d, %v", test.value, got, err)
+		}
+	}
+}
+
+func TestHardLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		quota   string
+		line    string
+		refused bool
+	}{
+		{"bytes up to the hard limit", "setquota -d /q 0 100 0 0", "echo new.txt " + strings.Repeat("x", 40), false},
+		{"bytes one over the hard limit", "setquota -d /q 0 100 0 0", "echo new.txt " + strings.Repeat("x", 41), true},
+		{"user bytes up to the hard limit", "setquota -u admin 0 141 0 0", "echo new.txt " + strings.Repeat("x", 40), false},
+		{"user bytes one over", "setquota -u admin 0 141 0 0", "echo new.txt " + strings.Repeat("x", 41), true},
+		{"inodes up to the hard limit", "setquota -d /q 0 0 0 3", "touch new.txt", false},
+		{"inodes one over", "setquota -d /q 0 0 0 2", "touch new.txt", true},
+		{"directories count as inodes", "setquota -d /q 0 0 0 2", "mkdir sub", true},
+		{"appending up to the hard limit", "setquota -d /q 0 100 0 0", "echo -a a.txt " + strings.Repeat("x", 40), false},
+		{"appending one over", "setquota -d /q 0 100 0 0", "echo -a a.txt " + strings.Repeat("x", 41), true},
+		{"overwriting with less", "setquota -d /q 0 60 0 0", "echo a.txt short", false},
+		{"truncate up to the hard limit", "setquota -d /q 0 100 0 0", "truncate -s 90 a.txt", false},
+		{"truncate one over", "setquota -d /q 0 100 0 0", "truncate -s 91 a.txt", true},
+		{"cat up to the hard limit", "setquota -d /q 0 100 0 0", "cat a.txt >> b.txt", false},
+		{"cat one over", "setquota -d /q 0 99 0 0", "cat a.txt >> b.txt", true},
+		{"copying up to the hard limit", "setquota -d /q 0 110 0 0", "cp a.txt c.txt", false},
+		{"copying one over", "setquota -d /q 0 109 0 0", "cp a.txt c.txt", true},
+		{"moving in", "setquota -d /q 0 100 0 0", "cd /; mv out.txt q", true},
+		{"moving within", "setquota -d /q 0 60 0 0", "mkdir sub; mv a.txt sub", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vfs := newTestVFS(t)
+			// /q starts with 60 bytes in 2 files.
+			writeTestFile(t, vfs, "/q/a.txt", strings.Repeat("a", 50))
+			writeTestFile(t, vfs, "/q/b.txt", strings.Repeat("b", 10))
+			writeTestFile(t, vfs, "/out.txt", strings.Repeat("o", 41))
+			run(vfs, test.quota)
+			if vfs.Status != 0 {
+				t.Fatalf("%s failed", test.quota)
+			}
+			before := dumpTree(t, vfs, vfs.Root)
+			output := run(vfs, "cd /q; "+test.line)
+			refused := strings.Contains(output, "Disk quota exceeded")
+			if refused != test.refused {
+				t.Errorf("refused: %v, want %v; printed %q", refused, test.refused, output)
+			}
+			if refused && vfs.Status == 0 {
+				t.Error("a refused change exited with status 0")
+			}
+			if after := dumpTree(t, vfs, vfs.Root); test.refused && !maps.Equal(before, after) {
+				t.Error("a refused change still changed the tree")
+			}
+		})
+	}
+}
+
+func TestSoftLimitWarns(t *testing.T) {
+	vfs := newTestVFS(t)
+	run(vfs, "mkdir /q; setquota -d /q 10 100 0 0; cd /q")
+	output := run(vfs, "echo a.txt "+strings.Repeat("x", 20))
+	if !strings.Contains(output, "Warning: /q is over the soft limit of 10 bytes") || vfs.Status != 0 {
+		t.Errorf("going over the soft limit printed %q with status %d", output, vfs.Status)
+	}
+}
+
+func TestQuotaCountersFollowChanges(t *testing.T) {
+	vfs := newTestVFS(t)
+	run(vfs, "mkdir /q; setquota -d /q 0 1M 0 0; setquota -u admin 0 1M 0 0")
+	// Count once, so that the changes below are followed as they happen.
+	vfs.usage()
+	run(vfs, "cd /q; echo a.txt hello; echo -a a.txt more; mkdir sub; echo sub/b.txt bee")
+	run(vfs, "truncate -s 2 a.txt; cp a.txt c.txt; rm c.txt; echo d.txt dd; cat a.txt >> d.txt; mv a.txt sub")
+	followed := *vfs.usage()
+
+	vfs.quotaCounts = nil
+	counted := vfs.usage()
+	for owner, used := range counted.owners {
+		if followed.owners[owner] != used {
+			t.Errorf("user %s uses %v, counted afresh %v", owner, followed.owners[owner], used)
+		}
+	}
+	if followed.dirs["/q"] != counted.dirs["/q"] {
+		t.Errorf("/q holds %v, counted afresh %v", followed.dirs["/q"], counted.dirs["/q"])
+	}
+	if want := (quotaUsage{bytes: 7, inodes: 4}); counted.dirs["/q"] != want {
+		t.Errorf("/q holds %v, want %v", counted.dirs["/q"], want)
+	}
+}
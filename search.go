@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"path"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+const (
+	maxTermLength  = 64
+	defaultResults = 10
+	maxSnippets    = 3
+	snippetWidth   = 80
+)
+
+// SearchIndex is an inverted index of the words in the files of the tree,
+// kept up to date as files change once it is turned on. Vaults, the audit
+// log and repositories' own files are left out.
+type SearchIndex struct {
+	Postings map[string]map[string][]int // term -> file path -> positions of the term in it
+	Lengths  map[string]int              // file path -> number of terms in it
+	Terms    map[string][]string         // file path -> the distinct terms in it
+}
+
+func newSearchIndex() *SearchIndex {
+	return &SearchIndex{
+		Postings: make(map[string]map[string][]int),
+		Lengths:  make(map[string]int),
+		Terms:    make(map[string][]string),
+	}
+}
+
+// tokenize splits text into lowercase words of letters and digits.
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	terms := words[:0]
+	for _, word := range words {
+		if len(word) <= maxTermLength {
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+func (index *SearchIndex) remove(filePath string) {
+	for _, term := range index.Terms[filePath] {
+		delete(index.Postings[term], filePath)
+		if len(index.Postings[term]) == 0 {
+			delete(index.Postings, term)
+		}
+	}
+	delete(index.Terms, filePath)
+	delete(index.Lengths, filePath)
+}
+
+func (index *SearchIndex) add(filePath string, content []byte) {
+	terms := tokenize(string(content))
+	for position, term := range terms {
+		postings := index.Postings[term]
+		if postings == nil {
+			postings = make(map[string][]int)
+			index.Postings[term] = postings
+		}
+		if postings[filePath] == nil {
+			index.Terms[filePath] = append(index.Terms[filePath], term)
+		}
+		postings[filePath] = append(postings[filePath], position)
+	}
+	index.Lengths[filePath] = len(terms)
+}
+
+// indexable reports whether the file at filePath belongs in the index.
+func (vfs *VFS) indexable(filePath string) bool {
+	if vfs.unlockedVault(filePath) != nil || strings.HasPrefix(filePath, auditLogDir+"/") {
+		return false
+	}
+	return !slices.Contains(strings.Split(filePath, "/"), vcsDirName)
+}
+
+// indexFile brings the entry for the file at filePath up to date.
+func (vfs *VFS) indexFile(filePath string, file *File) {
+	vfs.Index.remove(filePath)
+	if file == nil || !vfs.indexable(filePath) {
+		return
+	}
+	content, err := vfs.readFile(file)
+	if err != nil || bytes.IndexByte(content, 0) >= 0 {
+		return
+	}
+	vfs.Index.add(filePath, content)
+}
+
+// indexTree brings the entries for target and everything under it up to
+// date.
+func (vfs *VFS) indexTree(target string) {
+	target = path.Clean("/" + target)
+	for filePath := range vfs.Index.Lengths {
+		if filePath == target || target == "/" || strings.HasPrefix(filePath, target+"/") {
+			vfs.Index.remove(filePath)
+		}
+	}
+	if file := vfs.findFileByPath(target); file != nil {
+		vfs.indexFile(target, file)
+		return
+	}
+	if dir := vfs.findDirectoryByPath(target); dir != nil && dir.Path == target {
+		for filePath, file := range filesByPath(dir) {
+			vfs.indexFile(joinPath(target, filePath), file)
+		}
+	}
+}
+
+// indexRecord updates the index for a change to the tree, as described by
+// its journal record.
+func (vfs *VFS) indexRecord(rec journalRecord) {
+	if vfs.Index == nil {
+		return
+	}
+	switch rec.Op {
+	case "create", "write", "writeat", "truncate":
+		vfs.indexFile(rec.Path, vfs.findFileByPath(rec.Path))
+	case "rename", "copy":
+		vfs.indexTree(rec.Path)
+		vfs.indexTree(rec.To)
+	case "delete", "trash", "untrash", "vault", "vault-create":
+		vfs.indexTree(rec.Path)
+	case "restore":
+		vfs.indexTree(rec.To)
+	}
+}
+
+// buildIndex indexes the whole tree from scratch.
+func (vfs *VFS) buildIndex() {
+	vfs.Index = newSearchIndex()
+	vfs.indexTree("/")
+}
+
+func (vfs *VFS) indexCommand(action string) {
+	switch action {
+	case "on", "rebuild":
+		if !vfs.isAdmin() {
+			vfs.fail("Only an administrator can change the search index")
+			return
+		}
+		if action == "on" && vfs.Index != nil {
+			fmt.Println("The search index is already on")
+			return
+		}
+		vfs.buildIndex()
+		vfs.logMutation(journalRecord{Op: "index", Content: "on"})
+		fmt.Printf("Indexed %d files, %d terms\n", len(vfs.Index.Lengths), len(vfs.Index.Postings))
+	case "off":
+		if !vfs.isAdmin() {
+			vfs.fail("Only an administrator can change the search index")
+			return
+		}
+		vfs.Index = nil
+		vfs.logMutation(journalRecord{Op: "index", Content: "off"})
+		fmt.Println("The search index is off")
+	case "status":
+		if vfs.Index == nil {
+			fmt.Println("The search index is off")
+			return
+		}
+		postings := 0
+		for _, files := range vfs.Index.Postings {
+			postings += len(files)
+		}
+		fmt.Printf("The search index is on: %d files, %d terms, %d postings\n", len(vfs.Index.Lengths), len(vfs.Index.Postings), postings)
+	}
+}
+
+// searchClause is one part of a query: a word, a word prefix written as
+// word*, or a phrase in double quotes. A file matches a query if it matches
+// every clause.
+type searchClause struct {
+	terms  []string
+	prefix bool
+}
+
+func parseQuery(query string) ([]searchClause, error) {
+	var clauses []searchClause
+	for query = strings.TrimSpace(query); query != ""; query = strings.TrimSpace(query) {
+		if query[0] == '"' {
+			end := strings.IndexByte(query[1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated phrase in query")
+			}
+			if terms := tokenize(query[1 : end+1]); len(terms) > 0 {
+				clauses = append(clauses, searchClause{terms: terms})
+			}
+			query = query[end+2:]
+			continue
+		}
+		word, rest, _ := strings.Cut(query, " ")
+		query = rest
+		prefix := strings.HasSuffix(word, "*")
+		terms := tokenize(word)
+		switch {
+		case prefix && len(terms) == 1:
+			clauses = append(clauses, searchClause{terms: terms, prefix: true})
+		case len(terms) == 1:
+			clauses = append(clauses, searchClause{terms: terms})
+		case len(terms) > 1:
+			// Words such as "e-mail" index as a phrase of their parts.
+			clauses = append(clauses, searchClause{terms: terms})
+		}
+	}
+	if len(clauses) == 0 {
+		return nil, fmt.Errorf("the query has no words to search for")
+	}
+	return clauses, nil
+}
+
+// matches returns how often the clause occurs in each file that has it.
+func (index *SearchIndex) matches(clause searchClause) map[string]int {
+	counts := make(map[string]int)
+	if clause.prefix {
+		for term, postings := range index.Postings {
+			if strings.HasPrefix(term, clause.terms[0]) {
+				for filePath, positions := range postings {
+					counts[filePath] += len(positions)
+				}
+			}
+		}
+		return counts
+	}
+	first := index.Postings[clause.terms[0]]
+	for filePath, positions := range first {
+		for _, start := range positions {
+			if index.phraseAt(filePath, clause.terms[1:], start+1) {
+				counts[filePath]++
+			}
+		}
+	}
+	return counts
+}
+
+// phraseAt reports whether terms follow one another in the file from
+// position on.
+func (index *SearchIndex) phraseAt(filePath string, terms []string, position int) bool {
+	for i, term := range terms {
+		if _, found := slices.BinarySearch(index.Postings[term][filePath], position+i); !found {
+			return false
+		}
+	}
+	return true
+}
+
+type searchResult struct {
+	path  string
+	score float64
+}
+
+// rank scores the files that match every clause, highest first. Each clause
+// adds how often it occurs, weighted by how rare it is across files, and
+// the total is scaled down for long files.
+func (index *SearchIndex) rank(clauses []searchClause) []searchResult {
+	scores := make(map[string]float64)
+	for i, clause := range clauses {
+		counts := index.matches(clause)
+		idf := math.Log(1 + float64(len(index.Lengths))/float64(max(len(counts), 1)))
+		next := make(map[string]float64)
+		for filePath, count := range counts {
+			if _, matched := scores[filePath]; i == 0 || matched {
+				next[filePath] = scores[filePath] + float64(count)*idf
+			}
+		}
+		scores = next
+	}
+	results := make([]searchResult, 0, len(scores))
+	for filePath, score := range scores {
+		results = append(results, searchResult{filePath, score / math.Sqrt(float64(max(index.Lengths[filePath], 1)))})
+	}
+	slices.SortFunc(results, func(a searchResult, b searchResult) int {
+		if a.score != b.score {
+			if a.score > b.score {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.path, b.path)
+	})
+	return results
+}
+
+// snippets returns the numbered lines of content that hold any of the
+// clauses' words.
+func snippets(content []byte, clauses []searchClause) []string {
+	var lines []string
+	for n, line := range textLines(content) {
+		found := false
+		for _, term := range tokenize(line) {
+			for _, clause := range clauses {
+				for _, want := range clause.terms {
+					if term == want || (clause.prefix && strings.HasPrefix(term, want)) {
+						found = true
+					}
+				}
+			}
+		}
+		if !found {
+			continue
+		}
+		line = strings.TrimSpace(line)
+		if len(line) > snippetWidth {
+			line = line[:snippetWidth] + "..."
+		}
+		lines = append(lines, fmt.Sprintf("%5d: %s", n+1, line))
+		if len(lines) == maxSnippets {
+			break
+		}
+	}
+	return lines
+}
+
+// search prints the files that match query, best first, with the lines
+// that matched. Files the current user may not read are left out.
+func (vfs *VFS) search(query string, limit int) {
+	if vfs.Index == nil {
+		vfs.fail("The search index is off, turn it on with: index on")
+		return
+	}
+	clauses, err := parseQuery(query)
+	if err != nil {
+		vfs.fail("search:", err)
+		return
+	}
+	shown := 0
+	for _, result := range vfs.Index.rank(clauses) {
+		if shown == limit {
+			break
+		}
+		_, file, err := vfs.lookup(result.path)
+		if err != nil || file == nil || !checkOverlap(file.ReadPermission, vfs.CurrentUser.GroupPerms) {
+			continue
+		}
+		content, err := vfs.readFile(file)
+		if err != nil {
+			continue
+		}
+		fmt.Printf("%s  (score %.3f)\n", result.path, result.score)
+		for _, line := range snippets(content, clauses) {
+			fmt.Println(line)
+		}
+		shown++
+	}
+	if shown == 0 {
+		vfs.fail("No matches for", query)
+	}
+}
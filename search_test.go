@@ -0,0 +1,133 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"", nil},
+		{"Hello, World!", []string{"hello", "world"}},
+		{"e-mail  v2.0", []string{"e", "mail", "v2", "0"}},
+		{"Größe straße", []string{"größe", "straße"}},
+		{strings.Repeat("a", maxTermLength+1) + " kept", []string{"kept"}},
+	}
+	for _, test := range tests {
+		if got := tokenize(test.text); !slices.Equal(got, test.want) {
+			t.Errorf("tokenize(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    []searchClause
+		wantErr bool
+	}{
+		{query: "fox", want: []searchClause{{terms: []string{"fox"}}}},
+		{query: "Quick fox*", want: []searchClause{{terms: []string{"quick"}}, {terms: []string{"fox"}, prefix: true}}},
+		{query: `"lazy dog" e-mail`, want: []searchClause{{terms: []string{"lazy", "dog"}}, {terms: []string{"e", "mail"}}}},
+		{query: `"lazy dog`, wantErr: true},
+		{query: " ... ", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseQuery(test.query)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseQuery(%q) returned error %v", test.query, err)
+			continue
+		}
+		if !slices.EqualFunc(got, test.want, func(a searchClause, b searchClause) bool {
+			return a.prefix == b.prefix && slices.Equal(a.terms, b.terms)
+		}) {
+			t.Errorf("parseQuery(%q) = %v, want %v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestRank(t *testing.T) {
+	index := newSearchIndex()
+	index.add("/fox.txt", []byte("the quick brown fox jumps over the lazy dog"))
+	index.add("/dog.txt", []byte("a lazy dog, a lazy dog, a very lazy dog"))
+	index.add("/cat.txt", []byte("the cat ignores the dog and the fox"))
+	index.add("/foxes.txt", []byte("foxes and foxhounds"))
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"dog", []string{"/dog.txt", "/cat.txt", "/fox.txt"}},
+		{"fox dog", []string{"/cat.txt", "/fox.txt"}},
+		{`"lazy dog"`, []string{"/dog.txt", "/fox.txt"}},
+		{`"dog a lazy"`, []string{"/dog.txt"}},
+		{`"dog lazy"`, []string{}},
+		{"fox*", []string{"/foxes.txt", "/cat.txt", "/fox.txt"}},
+		{"unicorn", []string{}},
+	}
+	for _, test := range tests {
+		clauses, err := parseQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, result := range index.rank(clauses) {
+			got = append(got, result.path)
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("rank(%s) = %q, want %q", test.query, got, test.want)
+		}
+	}
+
+	index.remove("/dog.txt")
+	if _, found := index.Postings["very"]; found {
+		t.Error("removing the only file with a term left the term in the index")
+	}
+	if _, found := index.Postings["lazy"]["/dog.txt"]; found {
+		t.Error("removing a file left its postings behind")
+	}
+}
+
+func TestIndexFollowsTree(t *testing.T) {
+	tests := []struct {
+		name  string
+		line  string
+		query string
+		want  string // the files found, in order
+		vault bool   // whether /d/v is a vault
+	}{
+		{"created", "echo new.txt zebra", "zebra", "/d/new.txt", false},
+		{"written", "echo a.txt zebra", "zebra", "/d/a.txt", false},
+		{"old words forgotten", "echo a.txt zebra", "apple", "", false},
+		{"moved", "mkdir sub; mv a.txt sub", "apple", "/d/sub/a.txt", false},
+		{"move undone", "mkdir sub; mv a.txt sub; undo", "apple", "/d/a.txt", false},
+		{"trashed", "rm a.txt", "apple", "", false},
+		{"untrashed", "rm a.txt; trash restore 1", "apple", "/d/a.txt", false},
+		{"copied", "cp a.txt b.txt", "apple", "/d/a.txt /d/b.txt", false},
+		{"vaults left out", "echo v/s.txt apple", "apple", "/d/a.txt", true},
+		{"repositories left out", "mkdir .vcs; echo .vcs/s.txt apple", "apple", "/d/a.txt", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vfs := newTestVFS(t)
+			writeTestFile(t, vfs, "/d/a.txt", "apple banana")
+			run(vfs, "index on; cd /d")
+			if test.vault {
+				run(vfs, "mkdir v")
+				vfs.vaultCreate("/d/v", "vault key")
+			}
+			run(vfs, test.line)
+			var got []string
+			clauses, _ := parseQuery(test.query)
+			for _, result := range vfs.Index.rank(clauses) {
+				got = append(got, result.path)
+			}
+			if strings.Join(got, " ") != test.want {
+				t.Errorf("search for %s found %q, want %q", test.query, got, test.want)
+			}
+		})
+	}
+}
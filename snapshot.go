@@ -0,0 +1,392 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// snapshotsDirName is the hidden directory under / through which snapshots
+// can be browsed. It is not part of the tree: it is built from Snapshots
+// when first visited, and everything in it is read-only.
+const snapshotsDirName = ".snapshots"
+
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Snapshot is a frozen copy of the tree. It shares file data with the tree
+// and with other snapshots, so taking one only copies metadata.
+type Snapshot struct {
+	Name      string
+	CreatedAt time.Time
+	Root      *Directory
+}
+
+// subDir looks up the directory name in dir, including the snapshots
+// directory under the root.
+func (vfs *VFS) subDir(dir *Directory, name string) (*Directory, bool) {
+	sub, exists := dir.SubDirs[name]
+	if !exists && dir == vfs.Root && name == snapshotsDirName {
+		return vfs.snapshotsDir(), true
+	}
+	return sub, exists
+}
+
+func (vfs *VFS) snapshotsDir() *Directory {
+	if vfs.snapshotView == nil {
+		view := &Directory{
+			Name:           snapshotsDirName,
+			Files:          make(map[string]*File),
+			SubDirs:        make(map[string]*Directory),
+			Parent:         "/",
+			Path:           "/" + snapshotsDirName,
+			CreatedAt:      time.Now(),
+			ReadPermission: slices.Clone(vfs.Root.ReadPermission),
+		}
+		for name, snapshot := range vfs.Snapshots {
+			view.SubDirs[name] = readOnlyView(snapshot.Root, name, view.Path)
+		}
+		vfs.snapshotView = view
+	}
+	return vfs.snapshotView
+}
+
+// readOnlyView mirrors the tree under dir at parentPath/name, with all write
+// and modify permissions taken away. The files share their chunks with the
+// snapshot without holding references of their own, which is safe because
+// nothing can write to them.
+func readOnlyView(dir *Directory, name string, parentPath string) *Directory {
+	view := *dir
+	view.Name = name
+	view.Parent = parentPath
+	view.Path = joinPath(parentPath, name)
+	view.WritePermission, view.ModifyPermission = nil, nil
+	view.Files = make(map[string]*File, len(dir.Files))
+	view.SubDirs = make(map[string]*Directory, len(dir.SubDirs))
+	for fileName, file := range dir.Files {
+		copied := *file
+		copied.WritePermission, copied.ModifyPermission = nil, nil
+		view.Files[fileName] = &copied
+	}
+	for subName, sub := range dir.SubDirs {
+		view.SubDirs[subName] = readOnlyView(sub, subName, view.Path)
+	}
+	return &view
+}
+
+func (vfs *VFS) inSnapshots(dir *Directory) bool {
+	snapshots := "/" + snapshotsDirName
+	return dir.Path == snapshots || strings.HasPrefix(dir.Path, snapshots+"/")
+}
+
+// forgetSnapshotView drops the browsable view after the snapshots changed,
+// moving out of it if that is where the shell is.
+func (vfs *VFS) forgetSnapshotView() {
+	vfs.snapshotView = nil
+	if vfs.inSnapshots(vfs.CurrentDir) {
+		vfs.CurrentDir = vfs.Root
+	}
+}
+
+func (vfs *VFS) snapshotCreate(name string) {
+	if !vfs.isAdmin() {
+		vfs.deny("snapshot", name, "Only an administrator can take a snapshot")
+		return
+	}
+	if !snapshotNamePattern.MatchString(name) || name == "current" {
+		vfs.fail("Invalid snapshot name:", name)
+		return
+	}
+	if _, exists := vfs.Snapshots[name]; exists {
+		vfs.fail("Snapshot", name, "already exists")
+		return
+	}
+	vfs.takeSnapshot(name, time.Now())
+	vfs.logMutation(journalRecord{Op: "snapshot", Path: name})
+	fmt.Println("Created snapshot", name)
+}
+
+func (vfs *VFS) takeSnapshot(name string, at time.Time) {
+	if vfs.Snapshots == nil {
+		vfs.Snapshots = make(map[string]*Snapshot)
+	}
+	if old, exists := vfs.Snapshots[name]; exists {
+		vfs.releaseDir(old.Root)
+	}
+	root := vfs.copyDir(vfs.Root, "/", "")
+	if log := vfs.pruneAuditLog(root); log != nil {
+		vfs.releaseDir(log)
+	}
+	vfs.Snapshots[name] = &Snapshot{Name: name, CreatedAt: at, Root: root}
+	vfs.forgetSnapshotView()
+}
+
+// pruneAuditLog removes the audit log from the tree under root and returns
+// it. Snapshots leave the audit log out, so that restoring one cannot roll
+// back the record of what was done.
+func (vfs *VFS) pruneAuditLog(root *Directory) *Directory {
+	dirPath, name := path.Split(auditLogDir)
+	parent := findIn(root, dirPath)
+	if parent == nil {
+		return nil
+	}
+	log, exists := parent.SubDirs[name]
+	if !exists {
+		return nil
+	}
+	delete(parent.SubDirs, name)
+	return log
+}
+
+func (vfs *VFS) snapshotDelete(name string) {
+	if !vfs.isAdmin() {
+		vfs.deny("snapshot", name, "Only an administrator can delete a snapshot")
+		return
+	}
+	if _, exists := vfs.Snapshots[name]; !exists {
+		vfs.fail("Snapshot", name, "does not exist")
+		return
+	}
+	vfs.dropSnapshot(name)
+	vfs.logMutation(journalRecord{Op: "snapshot-delete", Path: name})
+	fmt.Println("Deleted snapshot", name)
+}
+
+func (vfs *VFS) dropSnapshot(name string) {
+	if snapshot, exists := vfs.Snapshots[name]; exists {
+		vfs.releaseDir(snapshot.Root)
+		delete(vfs.Snapshots, name)
+		vfs.forgetSnapshotView()
+	}
+}
+
+func (vfs *VFS) snapshotList() {
+	for _, name := range sortedKeys(vfs.Snapshots) {
+		snapshot := vfs.Snapshots[name]
+		files, size := 0, 0
+		walkFiles(snapshot.Root, func(file *File) {
+			files++
+			size += file.Size
+		})
+		fmt.Printf("%-20s %s %6d files %10d bytes\n", name, snapshot.CreatedAt.Format("2006-01-02 15:04:05"), files, size)
+	}
+}
+
+// snapshotRestore rolls the whole tree back to a snapshot, or only the
+// given paths.
+func (vfs *VFS) snapshotRestore(name string, paths []string) {
+	snapshot, exists := vfs.Snapshots[name]
+	if !exists {
+		vfs.fail("Snapshot", name, "does not exist")
+		return
+	}
+	if len(paths) == 0 {
+		if !vfs.isAdmin() {
+			vfs.deny("restore", "/", "Only an administrator can restore a whole snapshot")
+			return
+		}
+		vfs.restoreSnapshot(snapshot, "")
+		vfs.logMutation(journalRecord{Op: "restore", Path: name})
+		fmt.Println("Restored snapshot", name)
+		return
+	}
+	for _, target := range paths {
+		if !strings.HasPrefix(target, "/") {
+			target = joinPath(vfs.CurrentDir.Path, target)
+		}
+		target = path.Clean(target)
+		if target == "/" {
+			vfs.fail("Use snapshot restore", name, "without paths to restore everything")
+			continue
+		}
+		if target == auditLogDir || strings.HasPrefix(target, auditLogDir+"/") {
+			vfs.fail("The audit log cannot be restored from a snapshot")
+			continue
+		}
+		parent := vfs.findDirectoryByPath(path.Dir(target))
+		if parent == nil || !checkOverlap(parent.WritePermission, vfs.CurrentUser.GroupPerms) {
+			vfs.deny("restore", target, "You do not have write permissions to restore", target)
+			continue
+		}
+		if perms, exists := writePerms(parent, path.Base(target)); exists && !checkOverlap(perms, vfs.CurrentUser.GroupPerms) {
+			vfs.deny("restore", target, "You do not have write permissions for", target)
+			continue
+		}
+		if !vfs.restoreSnapshot(snapshot, target) {
+			vfs.fail(target, "is not in snapshot", name)
+			continue
+		}
+		vfs.logMutation(journalRecord{Op: "restore", Path: name, To: target})
+		fmt.Println("Restored", target, "from snapshot", name)
+	}
+}
+
+// writePerms returns the write permissions of the file or directory name in
+// dir, and whether there is one.
+func writePerms(dir *Directory, name string) ([]int, bool) {
+	if file, exists := dir.Files[name]; exists {
+		return file.WritePermission, true
+	}
+	if sub, exists := dir.SubDirs[name]; exists {
+		return sub.WritePermission, true
+	}
+	return nil, false
+}
+
+// restoreSnapshot replaces target, or the whole tree if target is empty,
+// with its copy in snapshot. It reports whether the snapshot had target.
+// The live audit log is kept whatever target covers.
+func (vfs *VFS) restoreSnapshot(snapshot *Snapshot, target string) bool {
+	log := vfs.pruneAuditLog(vfs.Root)
+	defer func() {
+		if old := vfs.pruneAuditLog(vfs.Root); old != nil {
+			vfs.releaseDir(old)
+		}
+		if log != nil {
+			dirPath, name := path.Split(auditLogDir)
+			vfs.mkdirAll(dirPath).SubDirs[name] = log
+		}
+	}()
+	if target == "" {
+		root := vfs.copyDir(snapshot.Root, "/", "")
+		vfs.releaseDir(vfs.Root)
+		currentPath := vfs.CurrentDir.Path
+		vfs.Root = root
+		vfs.vaultKeys = nil
+		vfs.CurrentDir = vfs.Root
+		if dir := vfs.findDirectoryByPath(currentPath); dir != nil {
+			vfs.CurrentDir = dir
+		}
+		return true
+	}
+
+	dirPath, name := path.Split(target)
+	source := findIn(snapshot.Root, dirPath)
+	if source == nil {
+		return false
+	}
+	dest := vfs.mkdirAll(dirPath)
+	if file, exists := source.Files[name]; exists {
+		if sub, exists := dest.SubDirs[name]; exists {
+			vfs.releaseDir(sub)
+			delete(dest.SubDirs, name)
+		}
+		if old, exists := dest.Files[name]; exists {
+			vfs.releaseFile(old)
+		}
+		dest.Files[name] = vfs.copyFile(file, name)
+		return true
+	}
+	if sub, exists := source.SubDirs[name]; exists {
+		if old, exists := dest.Files[name]; exists {
+			vfs.releaseFile(old)
+			delete(dest.Files, name)
+		}
+		if old, exists := dest.SubDirs[name]; exists {
+			if vfs.CurrentDir == old || strings.HasPrefix(vfs.CurrentDir.Path, old.Path+"/") {
+				vfs.CurrentDir = dest
+			}
+			delete(vfs.vaultKeys, old)
+			vfs.releaseDir(old)
+		}
+		dest.SubDirs[name] = vfs.copyDir(sub, name, dest.Path)
+		return true
+	}
+	return false
+}
+
+// snapshotDiff lists the files added, deleted and modified between two
+// snapshots, either of which may be "current" for the live tree.
+func (vfs *VFS) snapshotDiff(from string, to string) {
+	fromRoot, ok := vfs.snapshotRoot(from)
+	if !ok {
+		vfs.fail("Snapshot", from, "does not exist")
+		return
+	}
+	toRoot, ok := vfs.snapshotRoot(to)
+	if !ok {
+		vfs.fail("Snapshot", to, "does not exist")
+		return
+	}
+	before, after := filesByPath(fromRoot), filesByPath(toRoot)
+	paths := sortedKeys(before)
+	for filePath := range after {
+		if _, exists := before[filePath]; !exists {
+			paths = append(paths, filePath)
+		}
+	}
+	slices.Sort(paths)
+	for _, filePath := range paths {
+		old, hadIt := before[filePath]
+		updated, hasIt := after[filePath]
+		switch {
+		case !hadIt:
+			fmt.Println("A", filePath)
+		case !hasIt:
+			fmt.Println("D", filePath)
+		case old.Size != updated.Size || !slices.Equal(old.Blocks, updated.Blocks):
+			fmt.Println("M", filePath)
+		}
+	}
+}
+
+func (vfs *VFS) snapshotRoot(name string) (*Directory, bool) {
+	if name == "current" {
+		return vfs.Root, true
+	}
+	snapshot, exists := vfs.Snapshots[name]
+	if !exists {
+		return nil, false
+	}
+	return snapshot.Root, true
+}
+
+func filesByPath(root *Directory) map[string]*File {
+	files := make(map[string]*File)
+	var walk func(dir *Directory, dirPath string)
+	walk = func(dir *Directory, dirPath string) {
+		for name, file := range dir.Files {
+			files[joinPath(dirPath, name)] = file
+		}
+		for name, sub := range dir.SubDirs {
+			if subPath := joinPath(dirPath, name); subPath != auditLogDir {
+				walk(sub, subPath)
+			}
+		}
+	}
+	walk(root, "/")
+	return files
+}
+
+// findIn looks up dirPath in the tree under root without permission checks.
+func findIn(root *Directory, dirPath string) *Directory {
+	current := root
+	for _, part := range strings.Split(dirPath, "/") {
+		if part == "" {
+			continue
+		}
+		next, exists := current.SubDirs[part]
+		if !exists {
+			return nil
+		}
+		current = next
+	}
+	return current
+}
+
+// roots lists the trees whose files hold references to chunks: the tree
+// itself, every snapshot and everything in the trash.
+func (state *HelperVFS) roots() []*Directory {
+	roots := []*Directory{state.Root}
+	for _, name := range sortedKeys(state.Snapshots) {
+		roots = append(roots, state.Snapshots[name].Root)
+	}
+	for _, user := range sortedKeys(state.Trash) {
+		for _, entry := range state.Trash[user] {
+			roots = append(roots, entry.root())
+		}
+	}
+	return roots
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// treeOptions are the flags of the tree command.
+type treeOptions struct {
+	maxDepth int // 0 for no limit
+	dirsOnly bool
+	all      bool
+}
+
+// tree draws the hierarchy under target and counts what it showed.
+func (vfs *VFS) tree(target string, options treeOptions) {
+	dir, file, err := vfs.lookup(target)
+	if err != nil {
+		vfs.fail("tree:", err)
+		return
+	}
+	if file != nil {
+		fmt.Println(target)
+		fmt.Println()
+		fmt.Println("0 directories, 1 file")
+		return
+	}
+	dirs, files := 0, 0
+	var draw func(dir *Directory, prefix string, depth int)
+	draw = func(dir *Directory, prefix string, depth int) {
+		if options.maxDepth > 0 && depth >= options.maxDepth {
+			return
+		}
+		var nodes []findNode
+		fileNames, dirNames := entries(dir)
+		if !options.dirsOnly {
+			for _, name := range fileNames {
+				nodes = append(nodes, findNode{name: name, file: dir.Files[name], dir: dir})
+			}
+		}
+		for _, name := range dirNames {
+			nodes = append(nodes, findNode{name: name, dir: dir.SubDirs[name]})
+		}
+		if !options.all {
+			nodes = slices.DeleteFunc(nodes, func(node findNode) bool { return strings.HasPrefix(node.name, ".") })
+		}
+		slices.SortStableFunc(nodes, func(a findNode, b findNode) int { return strings.Compare(a.name, b.name) })
+		for i, node := range nodes {
+			branch, indent := "├── ", "│   "
+			if i == len(nodes)-1 {
+				branch, indent = "└── ", "    "
+			}
+			name, sub := node.name, node.dir
+			if !node.isDir() {
+				files++
+				fmt.Println(prefix + branch + name)
+				continue
+			}
+			dirs++
+			switch {
+			case !checkOverlap(sub.ReadPermission, vfs.CurrentUser.GroupPerms):
+				fmt.Println(prefix + branch + name + "/  [permission denied]")
+			case vfs.isLocked(sub):
+				fmt.Println(prefix + branch + name + "/  [locked]")
+			default:
+				fmt.Println(prefix + branch + name + "/")
+				draw(sub, prefix+indent, depth+1)
+			}
+		}
+	}
+	fmt.Println(target)
+	if !checkOverlap(dir.ReadPermission, vfs.CurrentUser.GroupPerms) {
+		vfs.fail("tree:", target+": Permission denied")
+		return
+	}
+	draw(dir, "", 0)
+	fmt.Println()
+	fmt.Printf("%d %s, %d %s\n", dirs, plural(dirs, "directory", "directories"), files, plural(files, "file", "files"))
+}
+
+func plural(n int, one string, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
+
+// formatSize prints a size in bytes, or the way ls -h does when human is set.
+func formatSize(size int, human bool) string {
+	if human {
+		return humanSize(size)
+	}
+	return strconv.Itoa(size)
+}
+
+// du prints the total size of the files under each directory below target,
+// deepest first, ending with target itself. With summarize only the total
+// for target is printed.
+func (vfs *VFS) du(target string, summarize bool, human bool) {
+	dir, file, err := vfs.lookup(target)
+	if err != nil {
+		vfs.fail("du:", err)
+		return
+	}
+	if file != nil {
+		fmt.Printf("%s\t%s\n", formatSize(file.Size, human), target)
+		return
+	}
+	var total func(dir *Directory, name string, depth int) int
+	total = func(dir *Directory, name string, depth int) int {
+		if !checkOverlap(dir.ReadPermission, vfs.CurrentUser.GroupPerms) {
+			vfs.fail("du: cannot read directory", name+": Permission denied")
+			return 0
+		}
+		size := 0
+		files, dirs := entries(dir)
+		for _, fileName := range files {
+			size += dir.Files[fileName].Size
+		}
+		for _, subName := range dirs {
+			size += total(dir.SubDirs[subName], strings.TrimSuffix(name, "/")+"/"+subName, depth+1)
+		}
+		if !summarize || depth == 0 {
+			fmt.Printf("%s\t%s\n", formatSize(size, human), name)
+		}
+		return size
+	}
+	total(dir, target, 0)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Store reads and writes the persisted state of a VFS in one on-disk format.
+type Store interface {
+	Save(filename string, state *HelperVFS) error
+	Load(filename string) (*HelperVFS, error)
+}
+
+const defaultStore = "gob"
+
+var stores = map[string]Store{
+	"gob":  gobStore{},
+	"json": jsonStore{},
+	"page": pageStore{},
+}
+
+func storeNames() string {
+	names := make([]string, 0, len(stores))
+	for name := range stores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func getStore(name string) (Store, error) {
+	store, ok := stores[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown store %q, expected one of: %s", name, storeNames())
+	}
+	return store, nil
+}
+
+// detectStore guesses which store wrote filename from its first bytes.
+func detectStore(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	head, err := bufio.NewReader(file).Peek(superSlotSize + len(pageMagic))
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read file: %w", err)
+	}
+	switch {
+	case isEnvelope(head):
+		// Encrypted images are always written by one of the stores that
+		// write the whole file at once, and either of them reads both.
+		return "gob", nil
+	case bytes.HasPrefix(head, []byte(pageMagic)),
+		len(head) > superSlotSize && bytes.HasPrefix(head[superSlotSize:], []byte(pageMagic)):
+		return "page", nil
+	case bytes.HasPrefix(bytes.TrimLeft(head, " \t\r\n"), []byte("{")):
+		return "json", nil
+	default:
+		return "gob", nil
+	}
+}
+
+// gobStore writes the whole image as one checksummed gob snapshot.
+type gobStore struct{}
+
+func (gobStore) Save(filename string, state *HelperVFS) error {
+	return saveImageBytes(filename, state, func(w io.Writer) error {
+		return encodeImage(w, state)
+	})
+}
+
+func (gobStore) Load(filename string) (*HelperVFS, error) {
+	return loadImageBytes(filename)
+}
+
+// jsonStore writes an indented JSON document, which is slower and larger
+// than gob but can be read and diffed by people.
+type jsonStore struct{}
+
+type jsonImage struct {
+	Format  string
+	Version uint32
+	Image   *HelperVFS
+}
+
+func (jsonStore) Save(filename string, state *HelperVFS) error {
+	return saveImageBytes(filename, state, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		image := jsonImage{Format: "vfs-json", Version: imageVersion, Image: state}
+		if err := encoder.Encode(image); err != nil {
+			return fmt.Errorf("failed to encode data: %w", err)
+		}
+		return nil
+	})
+}
+
+func (jsonStore) Load(filename string) (*HelperVFS, error) {
+	return loadImageBytes(filename)
+}
+
+func decodeJSONImage(data []byte) (*HelperVFS, error) {
+	var image jsonImage
+	if err := json.Unmarshal(data, &image); err != nil {
+		return nil, fmt.Errorf("failed to decode data: %w", err)
+	}
+	if image.Format != "vfs-json" || image.Image == nil {
+		return nil, fmt.Errorf("not a vfs JSON image")
+	}
+	if err := migrateImage(image.Image, image.Version); err != nil {
+		return nil, err
+	}
+	image.Image.blobStore().recount(image.Image.roots()...)
+	return image.Image, nil
+}
+
+// saveImageBytes writes the image produced by encode to filename, sealed
+// with the image key if it has one.
+func saveImageBytes(filename string, state *HelperVFS, encode func(w io.Writer) error) error {
+	if err := state.inlineBlobs(); err != nil {
+		return err
+	}
+	if state.key == nil {
+		return writeFileAtomic(filename, encode)
+	}
+	var plaintext bytes.Buffer
+	if err := encode(&plaintext); err != nil {
+		return err
+	}
+	sealed, err := state.key.sealEnvelope(plaintext.Bytes())
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, func(w io.Writer) error {
+		_, err := w.Write(sealed)
+		return err
+	})
+}
+
+// loadImageBytes reads an image written by gobStore or jsonStore, asking
+// for the passphrase if it is encrypted.
+func loadImageBytes(filename string) (*HelperVFS, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	var key *sealKey
+	if isEnvelope(data) {
+		passphrase, err := imagePassphrase(false)
+		if err != nil {
+			return nil, err
+		}
+		if data, key, err = openEnvelope(data, passphrase); err != nil {
+			return nil, err
+		}
+	}
+
+	var state *HelperVFS
+	if bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte("{")) {
+		state, err = decodeJSONImage(data)
+		if state != nil {
+			state.store = "json"
+		}
+	} else {
+		state, err = decodeImage(data)
+		if state != nil {
+			state.store = "gob"
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	state.key = key
+	return state, nil
+}
+
+// convertImage rewrites the image at source in the format of the named
+// store at dest.
+func convertImage(source string, dest string, to string) error {
+	from, err := detectStore(source)
+	if err != nil {
+		return err
+	}
+	state, err := stores[from].Load(source)
+	if err != nil {
+		return err
+	}
+	store, err := getStore(to)
+	if err != nil {
+		return err
+	}
+	return store.Save(dest, state)
+}
@@ -0,0 +1,742 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// textFlags holds the options of a text command: the flags that were given
+// and the values of those that take one.
+type textFlags struct {
+	set    map[byte]bool
+	values map[byte]string
+}
+
+func (flags textFlags) has(flag byte) bool {
+	return flags.set[flag]
+}
+
+// number returns the value of flag as a number, or fallback if it was not
+// given.
+func (flags textFlags) number(flag byte, fallback int) (int, error) {
+	value, given := flags.values[flag]
+	if !given {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid number %q for -%c", value, flag)
+	}
+	return n, nil
+}
+
+// parseTextFlags reads the flags at the start of args. Flags in boolFlags
+// stand alone and may be combined, as in -in; those in valueFlags take the
+// rest of the argument or the next one as their value. A bare number such as
+// -5 is taken as -n 5 when n is a value flag. It returns the flags and the
+// remaining operands.
+func parseTextFlags(args []string, boolFlags string, valueFlags string) (textFlags, []string, error) {
+	flags := textFlags{set: make(map[byte]bool), values: make(map[byte]string)}
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		if arg[1] >= '0' && arg[1] <= '9' && strings.Contains(valueFlags, "n") {
+			flags.set['n'], flags.values['n'] = true, arg[1:]
+			continue
+		}
+		for i := 1; i < len(arg); i++ {
+			flag := arg[i]
+			switch {
+			case strings.IndexByte(boolFlags, flag) >= 0:
+				flags.set[flag] = true
+			case strings.IndexByte(valueFlags, flag) >= 0:
+				value := arg[i+1:]
+				if value == "" {
+					if len(args) == 0 {
+						return flags, nil, fmt.Errorf("missing value for -%c", flag)
+					}
+					value, args = args[0], args[1:]
+				}
+				flags.set[flag], flags.values[flag] = true, value
+				i = len(arg)
+			default:
+				return flags, nil, fmt.Errorf("unknown option -%c", flag)
+			}
+		}
+	}
+	return flags, args, nil
+}
+
+// splitDestination takes a trailing ">> <file>" off args and returns the
+// file it names, if any.
+func splitDestination(args []string) ([]string, string) {
+	if len(args) >= 2 && args[len(args)-2] == ">>" {
+		return args[:len(args)-2], args[len(args)-1]
+	}
+	return args, ""
+}
+
+// writeOutput prints the output of a command, or stores it in destination
+// if one was given.
+func (vfs *VFS) writeOutput(destination string, output []byte) {
+	if destination == "" {
+		os.Stdout.Write(output)
+		return
+	}
+	vfs.atPath(destination, func(name string) {
+		vfs.storeOutput(name, output)
+	})
+}
+
+// capture runs fn and returns what it printed, for feeding one stage of a
+// pipeline into the next.
+func capture(fn func()) []byte {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error creating pipe:", err)
+		fn()
+		return nil
+	}
+	saved := os.Stdout
+	os.Stdout = writer
+	output := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(reader)
+		output <- data
+	}()
+	fn()
+	writer.Close()
+	os.Stdout = saved
+	data := <-output
+	reader.Close()
+	return data
+}
+
+// textInput is one file, or the standard input, a text command reads.
+type textInput struct {
+	name    string
+	content []byte
+}
+
+// textInputs reads targets, or the output piped into the command if there
+// are none. "-" also names the piped input.
+func (vfs *VFS) textInputs(command string, targets []string) ([]textInput, bool) {
+	if len(targets) == 0 {
+		targets = []string{"-"}
+	}
+	var inputs []textInput
+	for _, target := range targets {
+		if target == "-" {
+			if !vfs.piped {
+				vfs.fail(command + ": no input, nothing was piped into it")
+				return nil, false
+			}
+			inputs = append(inputs, textInput{name: "(standard input)", content: vfs.stdin})
+			continue
+		}
+		_, file := vfs.readableFile(target)
+		if file == nil {
+			return nil, false
+		}
+		content, err := vfs.readFile(file)
+		if err != nil {
+			vfs.fail("Error reading", target+":", err)
+			return nil, false
+		}
+		inputs = append(inputs, textInput{name: target, content: content})
+	}
+	return inputs, true
+}
+
+// textLines splits content into lines without their "\n".
+func textLines(content []byte) []string {
+	if len(content) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+func joinLines(lines []string) []byte {
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// searchFiles expands the directories among targets into the files under
+// them that the current user may read, for grep -r.
+func (vfs *VFS) searchFiles(targets []string) []string {
+	var files []string
+	var walk func(dir *Directory, prefix string)
+	walk = func(dir *Directory, prefix string) {
+		for _, name := range sortedKeys(dir.Files) {
+			if checkOverlap(dir.Files[name].ReadPermission, vfs.CurrentUser.GroupPerms) {
+				files = append(files, joinPath(prefix, name))
+			}
+		}
+		for _, name := range sortedKeys(dir.SubDirs) {
+			sub := dir.SubDirs[name]
+			if checkOverlap(sub.ReadPermission, vfs.CurrentUser.GroupPerms) && !vfs.isLocked(sub) {
+				walk(sub, joinPath(prefix, name))
+			}
+		}
+	}
+	for _, target := range targets {
+		dir, file, err := vfs.lookup(target)
+		switch {
+		case err != nil:
+			vfs.fail(err)
+		case file != nil:
+			files = append(files, target)
+		default:
+			walk(dir, target)
+		}
+	}
+	return files
+}
+
+// grep prints the lines of targets that match pattern. Names are shown when
+// more than one file is searched, and line numbers with -n. Status is 1 when
+// nothing matched.
+func (vfs *VFS) grep(pattern string, targets []string, flags textFlags, destination string) {
+	if flags.has('i') {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		vfs.fail("grep: invalid pattern:", err)
+		return
+	}
+	if flags.has('r') {
+		if len(targets) == 0 {
+			targets = []string{"."}
+		}
+		if targets = vfs.searchFiles(targets); vfs.Status != 0 || len(targets) == 0 {
+			vfs.Status = 1
+			return
+		}
+	}
+	inputs, ok := vfs.textInputs("grep", targets)
+	if !ok {
+		return
+	}
+	var out []string
+	for _, input := range inputs {
+		for n, line := range textLines(input.content) {
+			if re.MatchString(line) == flags.has('v') {
+				continue
+			}
+			if flags.has('n') {
+				line = strconv.Itoa(n+1) + ":" + line
+			}
+			if len(inputs) > 1 || flags.has('r') {
+				line = input.name + ":" + line
+			}
+			out = append(out, line)
+		}
+	}
+	vfs.writeOutput(destination, joinLines(out))
+	if len(out) == 0 {
+		vfs.Status = 1
+	}
+}
+
+// headTail prints the first or, with tail, last lines of each target, 10
+// unless -n says otherwise. tail -n +N starts at line N instead.
+func (vfs *VFS) headTail(command string, targets []string, flags textFlags, destination string) {
+	fromStart := false
+	if value := flags.values['n']; command == "tail" && strings.HasPrefix(value, "+") {
+		flags.values['n'], fromStart = value[1:], true
+	}
+	count, err := flags.number('n', 10)
+	if err != nil {
+		vfs.fail(command+":", err)
+		return
+	}
+	inputs, ok := vfs.textInputs(command, targets)
+	if !ok {
+		return
+	}
+	var out []string
+	for i, input := range inputs {
+		if len(inputs) > 1 {
+			if i > 0 {
+				out = append(out, "")
+			}
+			out = append(out, "==> "+input.name+" <==")
+		}
+		lines := textLines(input.content)
+		switch {
+		case command == "head":
+			lines = lines[:min(count, len(lines))]
+		case fromStart:
+			lines = lines[min(max(count-1, 0), len(lines)):]
+		default:
+			lines = lines[max(len(lines)-count, 0):]
+		}
+		out = append(out, lines...)
+	}
+	vfs.writeOutput(destination, joinLines(out))
+}
+
+// wc prints the lines, words and bytes in each target, or only those asked
+// for with -l, -w and -c.
+func (vfs *VFS) wc(targets []string, flags textFlags, destination string) {
+	inputs, ok := vfs.textInputs("wc", targets)
+	if !ok {
+		return
+	}
+	all := !flags.has('l') && !flags.has('w') && !flags.has('c')
+	var out []string
+	var total [3]int
+	report := func(counts [3]int, name string) {
+		var fields []string
+		for i, flag := range []byte{'l', 'w', 'c'} {
+			if all || flags.has(flag) {
+				fields = append(fields, fmt.Sprintf("%7d", counts[i]))
+			}
+		}
+		if name != "" {
+			fields = append(fields, name)
+		}
+		out = append(out, strings.Join(fields, " "))
+	}
+	for _, input := range inputs {
+		counts := [3]int{bytes.Count(input.content, []byte("\n")), len(bytes.Fields(input.content)), len(input.content)}
+		for i := range total {
+			total[i] += counts[i]
+		}
+		name := input.name
+		if len(targets) == 0 {
+			name = ""
+		}
+		report(counts, name)
+	}
+	if len(inputs) > 1 {
+		report(total, "total")
+	}
+	vfs.writeOutput(destination, joinLines(out))
+}
+
+// sortKey returns the part of line sort compares: the whole line, or with
+// -k the fields from the one given on, split on -t or on blanks.
+func sortKey(line string, field int, separator string) string {
+	if field <= 1 {
+		return line
+	}
+	var fields []string
+	if separator == "" {
+		fields = strings.Fields(line)
+	} else {
+		fields = strings.Split(line, separator)
+	}
+	if field > len(fields) {
+		return ""
+	}
+	if separator == "" {
+		separator = " "
+	}
+	return strings.Join(fields[field-1:], separator)
+}
+
+// leadingNumber reads the number at the start of key for sort -n, which is
+// zero if there is none.
+func leadingNumber(key string) float64 {
+	key = strings.TrimSpace(key)
+	end := 0
+	for end < len(key) && (key[end] >= '0' && key[end] <= '9' || key[end] == '.' || (end == 0 && key[end] == '-')) {
+		end++
+	}
+	n, _ := strconv.ParseFloat(key[:end], 64)
+	return n
+}
+
+// sortLines sorts the lines of targets, by -k field, numerically with -n,
+// in reverse with -r, and keeping only the first of equal keys with -u.
+func (vfs *VFS) sortLines(targets []string, flags textFlags, destination string) {
+	field, err := flags.number('k', 1)
+	if err != nil {
+		vfs.fail("sort:", err)
+		return
+	}
+	separator := flags.values['t']
+	inputs, ok := vfs.textInputs("sort", targets)
+	if !ok {
+		return
+	}
+	var lines []string
+	for _, input := range inputs {
+		lines = append(lines, textLines(input.content)...)
+	}
+	compareKeys := func(a string, b string) int {
+		if flags.has('n') {
+			x, y := leadingNumber(a), leadingNumber(b)
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+		return strings.Compare(a, b)
+	}
+	compare := func(a string, b string) int {
+		result := compareKeys(sortKey(a, field, separator), sortKey(b, field, separator))
+		if result == 0 && !flags.has('u') {
+			result = strings.Compare(a, b)
+		}
+		if flags.has('r') {
+			result = -result
+		}
+		return result
+	}
+	slices.SortStableFunc(lines, compare)
+	if flags.has('u') {
+		lines = slices.CompactFunc(lines, func(a string, b string) bool { return compare(a, b) == 0 })
+	}
+	vfs.writeOutput(destination, joinLines(lines))
+}
+
+// uniq drops repeated adjacent lines. -c prefixes each with how often it
+// occurred, and -d keeps only the repeated ones.
+func (vfs *VFS) uniq(targets []string, flags textFlags, destination string) {
+	inputs, ok := vfs.textInputs("uniq", targets)
+	if !ok {
+		return
+	}
+	var lines, out []string
+	for _, input := range inputs {
+		lines = append(lines, textLines(input.content)...)
+	}
+	for i := 0; i < len(lines); {
+		j := i + 1
+		for j < len(lines) && lines[j] == lines[i] {
+			j++
+		}
+		if !flags.has('d') || j-i > 1 {
+			if flags.has('c') {
+				out = append(out, fmt.Sprintf("%7d %s", j-i, lines[i]))
+			} else {
+				out = append(out, lines[i])
+			}
+		}
+		i = j
+	}
+	vfs.writeOutput(destination, joinLines(out))
+}
+
+// parseRanges reads a cut list such as 1,3-5,7- into inclusive 1-based
+// ranges, an open end being 0.
+func parseRanges(list string) ([][2]int, error) {
+	var ranges [][2]int
+	for _, part := range strings.Split(list, ",") {
+		low, high, isRange := strings.Cut(part, "-")
+		var r [2]int
+		var err error
+		if low == "" {
+			r[0] = 1
+		} else if r[0], err = strconv.Atoi(low); err != nil || r[0] < 1 {
+			return nil, fmt.Errorf("invalid list %q", list)
+		}
+		switch {
+		case !isRange:
+			r[1] = r[0]
+		case high == "":
+			r[1] = 0
+		default:
+			if r[1], err = strconv.Atoi(high); err != nil || r[1] < r[0] {
+				return nil, fmt.Errorf("invalid list %q", list)
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+func inRanges(n int, ranges [][2]int) bool {
+	for _, r := range ranges {
+		if n >= r[0] && (r[1] == 0 || n <= r[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// cut prints the -f fields, split on -d or tabs, or the -c characters of
+// each line. Lines without the delimiter are printed whole.
+func (vfs *VFS) cut(targets []string, flags textFlags, destination string) {
+	list, byChars := flags.values['c'], flags.has('c')
+	if !byChars {
+		list = flags.values['f']
+	}
+	ranges, err := parseRanges(list)
+	if err != nil {
+		vfs.fail("cut:", err)
+		return
+	}
+	delimiter := "\t"
+	if value, given := flags.values['d']; given {
+		if utf8.RuneCountInString(value) != 1 {
+			vfs.fail("cut: the delimiter must be a single character")
+			return
+		}
+		delimiter = value
+	}
+	inputs, ok := vfs.textInputs("cut", targets)
+	if !ok {
+		return
+	}
+	var out []string
+	for _, input := range inputs {
+		for _, line := range textLines(input.content) {
+			var parts []string
+			joiner := delimiter
+			if byChars {
+				parts, joiner = strings.Split(line, ""), ""
+			} else if !strings.Contains(line, delimiter) {
+				out = append(out, line)
+				continue
+			} else {
+				parts = strings.Split(line, delimiter)
+			}
+			var kept []string
+			for i, part := range parts {
+				if inRanges(i+1, ranges) {
+					kept = append(kept, part)
+				}
+			}
+			out = append(out, strings.Join(kept, joiner))
+		}
+	}
+	vfs.writeOutput(destination, joinLines(out))
+}
+
+// expandSet turns a tr set such as a-z or \n into the characters it stands
+// for.
+func expandSet(set string) []rune {
+	var chars []rune
+	runes := []rune(set)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		if c == '\\' && i+1 < len(runes) {
+			i++
+			switch runes[i] {
+			case 'n':
+				c = '\n'
+			case 't':
+				c = '\t'
+			default:
+				c = runes[i]
+			}
+		}
+		if i+2 < len(runes) && runes[i+1] == '-' && runes[i+2] >= c {
+			for r := c; r <= runes[i+2]; r++ {
+				chars = append(chars, r)
+			}
+			i += 2
+			continue
+		}
+		chars = append(chars, c)
+	}
+	return chars
+}
+
+// tr translates the characters of its input in set1 to those in set2, or
+// deletes them with -d. With -s, runs of a character in the last set given
+// are squeezed to one.
+func (vfs *VFS) tr(sets []string, flags textFlags, destination string) {
+	inputs, ok := vfs.textInputs("tr", nil)
+	if !ok {
+		return
+	}
+	from := expandSet(sets[0])
+	var to []rune
+	if len(sets) > 1 {
+		to = expandSet(sets[1])
+	}
+	squeeze := from
+	if len(to) > 0 {
+		squeeze = to
+	}
+	var out strings.Builder
+	var last rune = -1
+	for _, c := range string(inputs[0].content) {
+		if i := slices.Index(from, c); i >= 0 {
+			if flags.has('d') {
+				continue
+			}
+			if len(to) > 0 {
+				c = to[min(i, len(to)-1)]
+			}
+		}
+		if flags.has('s') && c == last && slices.Contains(squeeze, c) {
+			continue
+		}
+		out.WriteRune(c)
+		last = c
+	}
+	vfs.writeOutput(destination, []byte(out.String()))
+}
+
+// substitution is a parsed sed s command.
+type substitution struct {
+	re          *regexp.Regexp
+	replacement string
+	global      bool
+	occurrence  int
+}
+
+// parseSubstitution reads an s/regex/replacement/flags command. Any
+// character may stand in for /, and the flags are g, i and a number picking
+// which match to replace.
+func parseSubstitution(script string) (substitution, error) {
+	if len(script) < 2 || script[0] != 's' {
+		return substitution{}, fmt.Errorf("only s/regex/replacement/ is supported")
+	}
+	delimiter := script[1]
+	var parts []string
+	var part strings.Builder
+	for i := 2; i < len(script); i++ {
+		switch {
+		case script[i] == '\\' && i+1 < len(script) && script[i+1] == delimiter:
+			part.WriteByte(delimiter)
+			i++
+		case script[i] == delimiter && len(parts) < 2:
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteByte(script[i])
+		}
+	}
+	if len(parts) != 2 {
+		return substitution{}, fmt.Errorf("unterminated s command")
+	}
+	sub := substitution{occurrence: 1}
+	pattern := parts[0]
+	for _, flag := range part.String() {
+		switch {
+		case flag == 'g':
+			sub.global = true
+		case flag == 'i':
+			pattern = "(?i)" + pattern
+		case flag >= '1' && flag <= '9':
+			sub.occurrence = int(flag - '0')
+		default:
+			return substitution{}, fmt.Errorf("unknown flag %q in s command", flag)
+		}
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return substitution{}, fmt.Errorf("invalid regex: %w", err)
+	}
+	sub.re = re
+	sub.replacement = sedTemplate(parts[1])
+	return sub, nil
+}
+
+// sedTemplate turns a sed replacement, where & is the match and \1 a group,
+// into a regexp template.
+func sedTemplate(replacement string) string {
+	var template strings.Builder
+	for i := 0; i < len(replacement); i++ {
+		c := replacement[i]
+		switch {
+		case c == '&':
+			template.WriteString("${0}")
+		case c == '$':
+			template.WriteString("$$")
+		case c == '\\' && i+1 < len(replacement):
+			i++
+			next := replacement[i]
+			switch {
+			case next >= '0' && next <= '9':
+				template.WriteString("${" + string(next) + "}")
+			case next == 'n':
+				template.WriteByte('\n')
+			case next == 't':
+				template.WriteByte('\t')
+			default:
+				template.WriteByte(next)
+			}
+		default:
+			template.WriteByte(c)
+		}
+	}
+	return template.String()
+}
+
+func (sub substitution) apply(line string) string {
+	var out []byte
+	last := 0
+	for n, match := range sub.re.FindAllStringSubmatchIndex(line, -1) {
+		if n+1 < sub.occurrence || (n+1 > sub.occurrence && !sub.global) {
+			continue
+		}
+		out = append(out, line[last:match[0]]...)
+		out = sub.re.ExpandString(out, sub.replacement, line, match)
+		last = match[1]
+	}
+	return string(append(out, line[last:]...))
+}
+
+// sed applies an s command to every line of targets. With -i the files are
+// changed in place instead of printed.
+func (vfs *VFS) sed(script string, targets []string, flags textFlags, destination string) {
+	sub, err := parseSubstitution(script)
+	if err != nil {
+		vfs.fail("sed:", err)
+		return
+	}
+	if flags.has('i') && (len(targets) == 0 || slices.Contains(targets, "-")) {
+		vfs.fail("sed: -i needs files to edit, not the standard input")
+		return
+	}
+	inputs, ok := vfs.textInputs("sed", targets)
+	if !ok {
+		return
+	}
+	var out []string
+	for _, input := range inputs {
+		lines := textLines(input.content)
+		for i, line := range lines {
+			lines[i] = sub.apply(line)
+		}
+		if !flags.has('i') {
+			out = append(out, lines...)
+			continue
+		}
+		dir, file, err := vfs.lookup(input.name)
+		if err != nil || file == nil {
+			vfs.fail("sed: cannot edit", input.name, "in place")
+			continue
+		}
+		if !checkOverlap(file.WritePermission, vfs.CurrentUser.GroupPerms) {
+			vfs.deny("write", joinPath(dir.Path, file.Name), "You do not have write permissions for", input.name)
+			continue
+		}
+		edited := joinLines(lines)
+		if len(input.content) > 0 && input.content[len(input.content)-1] != '\n' {
+			edited = bytes.TrimSuffix(edited, []byte("\n"))
+		}
+		if !vfs.writable(dir, file.Name, len(edited)) {
+			continue
+		}
+		if _, err := vfs.storeFile(dir, file.Name, edited); err != nil {
+			vfs.fail("Error writing", input.name+":", err)
+		}
+	}
+	if !flags.has('i') {
+		vfs.writeOutput(destination, joinLines(out))
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTextCommands(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"grep an fruit.txt", "banana,3\nmango,12\n"},
+		{"grep -i -n APPLE fruit.txt", "1:apple,5\n5:apple,5\n"},
+		{"grep -v a fruit.txt", "cherry,20\n"},
+		{"head -n 2 fruit.txt", "apple,5\nbanana,3\n"},
+		{"tail -n 2 fruit.txt", "mango,12\napple,5\n"},
+		{"tail -n +4 fruit.txt", "mango,12\napple,5\n"},
+		{"wc -l fruit.txt", "      5 fruit.txt\n"},
+		{"sort fruit.txt", "apple,5\napple,5\nbanana,3\ncherry,20\nmango,12\n"},
+		{"sort -u -r fruit.txt", "mango,12\ncherry,20\nbanana,3\napple,5\n"},
+		{"sort -n -t , -k 2 fruit.txt", "banana,3\napple,5\napple,5\nmango,12\ncherry,20\n"},
+		{"sort fruit.txt | uniq -c", "      2 apple,5\n      1 banana,3\n      1 cherry,20\n      1 mango,12\n"},
+		{"sort fruit.txt | uniq -d", "apple,5\n"},
+		{"cut -d , -f 2 fruit.txt", "5\n3\n20\n12\n5\n"},
+		{"cut -c 1-3,5- fruit.txt", "appe,5\nbanna,3\nchery,20\nmano,12\nappe,5\n"},
+		{"head -n 1 fruit.txt | tr a-z A-Z", "APPLE,5\n"},
+		{"head -n 1 fruit.txt | tr -d p", "ale,5\n"},
+		{"head -n 1 fruit.txt | tr -s p", "aple,5\n"},
+		{"sed s/a/A/ fruit.txt", "Apple,5\nbAnana,3\ncherry,20\nmAngo,12\nApple,5\n"},
+		{"sed s/a/A/g fruit.txt", "Apple,5\nbAnAnA,3\ncherry,20\nmAngo,12\nApple,5\n"},
+		{"sed s/a/A/2 fruit.txt", "apple,5\nbanAna,3\ncherry,20\nmango,12\napple,5\n"},
+		{`sed 's/([a-z]*),([0-9]*)/\2:\1/' fruit.txt`, "5:apple\n3:banana\n20:cherry\n12:mango\n5:apple\n"},
+		{"sed 's:,:&&:' fruit.txt | head -n 1", "apple,,5\n"},
+	}
+	vfs := newTestVFS(t)
+	writeTestFile(t, vfs, "/t/fruit.txt", "apple,5\nbanana,3\ncherry,20\nmango,12\napple,5\n")
+	run(vfs, "cd /t")
+	for _, test := range tests {
+		t.Run(test.line, func(t *testing.T) {
+			if got := run(vfs, test.line); got != test.want {
+				t.Errorf("printed %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSedInPlace(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		line     string
+		want     string
+		failures bool
+	}{
+		{"edits the file", "a\nb\n", "sed -i s/a/x/ f.txt", "x\nb\n", false},
+		{"keeps a missing newline", "a\nb", "sed -i s/b/y/ f.txt", "a\ny", false},
+		{"refuses the standard input", "a\n", "cat f.txt | sed -i s/a/x/", "a\n", true},
+		{"refuses a missing file", "a\n", "sed -i s/a/x/ nothing.txt", "a\n", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vfs := newTestVFS(t)
+			writeTestFile(t, vfs, "/t/f.txt", test.content)
+			run(vfs, "cd /t")
+			run(vfs, test.line)
+			if (vfs.Status != 0) != test.failures {
+				t.Errorf("sed exited with status %d", vfs.Status)
+			}
+			if got, _ := readTestFile(t, vfs, "/t/f.txt"); got != test.want {
+				t.Errorf("f.txt holds %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Timestamps follow the usual meanings: UpdatedAt is when the contents last
+// changed, ChangedAt when the contents or any other metadata did, and
+// AccessedAt when a command last read them. Access times are saved with the
+// image but not journaled, so a crash may lose the latest of them.
+
+const statTimeFormat = "2006-01-02 15:04:05.000000000 -0700"
+
+// dateLayouts are the forms touch -d accepts, tried in order.
+var dateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+func (file *File) modified(t time.Time) {
+	file.UpdatedAt, file.ChangedAt = t, t
+}
+
+func (dir *Directory) modified(t time.Time) {
+	dir.UpdatedAt, dir.ChangedAt = t, t
+}
+
+// accessed records that a command read file.
+func (vfs *VFS) accessed(file *File) {
+	file.AccessedAt = time.Now()
+}
+
+// parseStamp reads the [[CC]YY]MMDDhhmm[.ss] form of touch -t, in local time.
+func parseStamp(stamp string) (time.Time, error) {
+	invalid := fmt.Errorf("invalid date format %q, expected [[CC]YY]MMDDhhmm[.ss]", stamp)
+	seconds := 0
+	if rest, secs, found := strings.Cut(stamp, "."); found {
+		n, err := strconv.Atoi(secs)
+		if err != nil || len(secs) != 2 || n > 60 {
+			return time.Time{}, invalid
+		}
+		stamp, seconds = rest, n
+	}
+	for _, c := range stamp {
+		if c < '0' || c > '9' {
+			return time.Time{}, invalid
+		}
+	}
+	year := time.Now().Year()
+	switch len(stamp) {
+	case 8:
+	case 10:
+		// Two digit years are 1969 to 2068, as POSIX has it.
+		year, _ = strconv.Atoi(stamp[:2])
+		if year < 69 {
+			year += 2000
+		} else {
+			year += 1900
+		}
+		stamp = stamp[2:]
+	case 12:
+		year, _ = strconv.Atoi(stamp[:4])
+		stamp = stamp[4:]
+	default:
+		return time.Time{}, invalid
+	}
+	field := func(i int) int {
+		n, _ := strconv.Atoi(stamp[i : i+2])
+		return n
+	}
+	month, day, hour, minute := field(0), field(2), field(4), field(6)
+	t := time.Date(year, time.Month(month), day, hour, minute, seconds, 0, time.Local)
+	if t.Month() != time.Month(month) || t.Day() != day || hour > 23 || minute > 59 {
+		return time.Time{}, invalid
+	}
+	return t, nil
+}
+
+// parseDate reads the date given to touch -d, in local time unless it says
+// otherwise. "now" is the current time and @N is N seconds after the epoch.
+func parseDate(date string) (time.Time, error) {
+	if date == "now" {
+		return time.Now(), nil
+	}
+	if seconds, found := strings.CutPrefix(date, "@"); found {
+		n, err := strconv.ParseInt(seconds, 10, 64)
+		if err == nil {
+			return time.Unix(n, 0), nil
+		}
+	}
+	for _, layout := range dateLayouts {
+		if t, err := time.ParseInLocation(layout, date, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q, expected a form such as 2006-01-02 15:04:05", date)
+}
+
+// setTimes sets the access and modification times of the file or directory
+// at target to t, as touch does for things that already exist.
+func (vfs *VFS) setTimes(target string, t time.Time) {
+	dir, file, err := vfs.lookup(target)
+	if err != nil {
+		vfs.fail(err)
+		return
+	}
+	abs, write := dir.Path, dir.WritePermission
+	if file != nil {
+		abs, write = joinPath(dir.Path, file.Name), file.WritePermission
+	}
+	if !checkOverlap(write, vfs.CurrentUser.GroupPerms) {
+		vfs.deny("utime", abs, "You do not have write permissions to change the times of", target)
+		return
+	}
+	vfs.applyTimes(abs, t, time.Now())
+	vfs.logMutation(journalRecord{Op: "utime", Path: abs, Content: t.Format(time.RFC3339Nano)})
+}
+
+// applyTimes sets the access and modification times of the file or
+// directory at target to t, and its change time to now.
+func (vfs *VFS) applyTimes(target string, t time.Time, now time.Time) {
+	if file := vfs.findFileByPath(target); file != nil {
+		file.AccessedAt, file.UpdatedAt, file.ChangedAt = t, t, now
+	} else if dir := vfs.findDirectoryByPath(target); dir != nil && dir.Path == path.Clean(target) {
+		dir.AccessedAt, dir.UpdatedAt, dir.ChangedAt = t, t, now
+	}
+}
+
+// changed records that the metadata of the file or directory at target
+// changed at t.
+func (vfs *VFS) changed(target string, t time.Time) {
+	if file := vfs.findFileByPath(target); file != nil {
+		file.ChangedAt = t
+	} else if dir := vfs.findDirectoryByPath(target); dir != nil && dir.Path == path.Clean(target) {
+		dir.ChangedAt = t
+	}
+}
+
+// parentModified records that an entry was added to or removed from the
+// directory holding target at t.
+func (vfs *VFS) parentModified(target string, t time.Time) {
+	if dir := vfs.findDirectoryByPath(path.Dir(path.Clean(target))); dir != nil {
+		dir.modified(t)
+	}
+}
+
+// stampRecord keeps the timestamps of directories, and the change times of
+// what a record renames or changes the permissions of, in step with the
+// tree. Writes set their own.
+func (vfs *VFS) stampRecord(rec journalRecord) {
+	switch rec.Op {
+	case "create", "mkdir", "delete", "trash", "untrash":
+		vfs.parentModified(rec.Path, rec.Time)
+	case "copy":
+		vfs.parentModified(rec.To, rec.Time)
+	case "rename":
+		vfs.parentModified(rec.Path, rec.Time)
+		vfs.parentModified(rec.To, rec.Time)
+		vfs.changed(rec.To, rec.Time)
+	case "chmod", "compress":
+		vfs.changed(rec.Path, rec.Time)
+	}
+}
+
+// touchFile creates the file name in the current directory, or sets the
+// times of the file or directory already there to t. A zero t means now.
+func (vfs *VFS) touchFile(name string, t time.Time) {
+	if _, _, err := vfs.lookup(name); err != nil {
+		vfs.touch(name)
+		if _, created := vfs.CurrentDir.Files[name]; !created || t.IsZero() {
+			return
+		}
+	}
+	if t.IsZero() {
+		t = time.Now()
+	}
+	vfs.setTimes(name, t)
+}
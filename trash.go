@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// trashRetentionEnv names the variable that sets how long removed files stay
+// in the trash, as a duration such as 72h. Zero keeps them until the trash
+// is emptied.
+const (
+	trashRetentionEnv     = "TRASH_RETENTION"
+	defaultTrashRetention = 30 * 24 * time.Hour
+)
+
+// TrashEntry is a file or directory rm moved to the trash of the user who
+// removed it. It keeps its chunks until it is purged.
+type TrashEntry struct {
+	ID        int
+	Path      string
+	Owner     string
+	DeletedAt time.Time
+	File      *File
+	Dir       *Directory
+}
+
+// root returns a directory holding the entry, for walking its files.
+func (entry *TrashEntry) root() *Directory {
+	if entry.Dir != nil {
+		return entry.Dir
+	}
+	return &Directory{Files: map[string]*File{entry.File.Name: entry.File}}
+}
+
+func (vfs *VFS) roots() []*Directory {
+	state := HelperVFS{Root: vfs.Root, Snapshots: vfs.Snapshots, Trash: vfs.Trash}
+	return state.roots()
+}
+
+func (vfs *VFS) trashRetention() time.Duration {
+	value, set := vfs.Env[trashRetentionEnv]
+	if !set {
+		return defaultTrashRetention
+	}
+	retention, err := time.ParseDuration(value)
+	if err != nil || retention < 0 {
+		return defaultTrashRetention
+	}
+	return retention
+}
+
+// detach takes the file or directory at target out of the tree. Vaults in a
+// directory are locked first, so that their contents only leave the tree
+// sealed.
+func (vfs *VFS) detach(target string) (*File, *Directory) {
+	dirPath, name := path.Split(target)
+	parent := vfs.findDirectoryByPath(dirPath)
+	if parent == nil {
+		return nil, nil
+	}
+	if file, exists := parent.Files[name]; exists {
+		delete(parent.Files, name)
+		return file, nil
+	}
+	dir, exists := parent.SubDirs[name]
+	if !exists {
+		return nil, nil
+	}
+	for vault := range vfs.vaultKeys {
+		if vault == dir || strings.HasPrefix(vault.Path, dir.Path+"/") {
+			if err := vfs.lockVault(vault); err != nil {
+				fmt.Fprintln(os.Stderr, "Error sealing", vault.Path+":", err)
+			}
+		}
+	}
+	if vfs.CurrentDir == dir || strings.HasPrefix(vfs.CurrentDir.Path, dir.Path+"/") {
+		vfs.CurrentDir = parent
+	}
+	delete(parent.SubDirs, name)
+	return nil, dir
+}
+
+// attach puts a file or directory back into the tree at target.
+func (vfs *VFS) attach(target string, file *File, dir *Directory) {
+	dirPath, name := path.Split(target)
+	parent := vfs.mkdirAll(dirPath)
+	if file != nil {
+		file.Name = name
+		parent.Files[name] = file
+		return
+	}
+	repath(dir, name, parent.Path)
+	parent.SubDirs[name] = dir
+}
+
+// repath renames dir and points it and everything below it at its new
+// place in the tree.
+func repath(dir *Directory, name string, parentPath string) {
+	dir.Name = name
+	dir.Parent = parentPath
+	dir.Path = joinPath(parentPath, name)
+	for subName, sub := range dir.SubDirs {
+		repath(sub, subName, dir.Path)
+	}
+}
+
+func (vfs *VFS) nextTrashID(user string) int {
+	id := 1
+	for _, entry := range vfs.Trash[user] {
+		id = max(id, entry.ID+1)
+	}
+	return id
+}
+
+// moveToTrash detaches target and adds it to the trash of user under id.
+func (vfs *VFS) moveToTrash(user string, id int, target string, deletedAt time.Time) bool {
+	file, dir := vfs.detach(target)
+	if file == nil && dir == nil {
+		return false
+	}
+	entry := &TrashEntry{ID: id, Path: target, DeletedAt: deletedAt, File: file, Dir: dir}
+	if file != nil {
+		entry.Owner = file.Owner
+	} else {
+		entry.Owner = dir.Owner
+	}
+	if vfs.Trash == nil {
+		vfs.Trash = make(map[string][]*TrashEntry)
+	}
+	vfs.Trash[user] = append(vfs.Trash[user], entry)
+	return true
+}
+
+// trashRemove moves the file or directory at target to the current user's
+// trash.
+func (vfs *VFS) trashRemove(target string) {
+	vfs.purgeTrash()
+	user := vfs.userName()
+	id := vfs.nextTrashID(user)
+	if !vfs.moveToTrash(user, id, target, time.Now()) {
+		return
+	}
+	vfs.setUndo(vfs.undoTrash(user, id))
+	vfs.logMutation(journalRecord{Op: "trash", Path: target, Content: user, Size: id})
+}
+
+func (vfs *VFS) findTrash(user string, id int) (int, *TrashEntry) {
+	for i, entry := range vfs.Trash[user] {
+		if entry.ID == id {
+			return i, entry
+		}
+	}
+	return -1, nil
+}
+
+// restoreFromTrash puts entry id of the trash of user back at target.
+func (vfs *VFS) restoreFromTrash(user string, id int, target string) {
+	i, entry := vfs.findTrash(user, id)
+	if entry == nil {
+		return
+	}
+	vfs.Trash[user] = append(vfs.Trash[user][:i], vfs.Trash[user][i+1:]...)
+	vfs.attach(target, entry.File, entry.Dir)
+}
+
+// missingDirs returns the directories that have to be made again for
+// dirPath to exist, outermost first, and the nearest one that still does.
+func (vfs *VFS) missingDirs(dirPath string) ([]string, *Directory) {
+	var missing []string
+	dirPath = path.Clean(dirPath)
+	for {
+		if dir := vfs.findDirectoryByPath(dirPath); dir != nil {
+			return missing, dir
+		}
+		missing = append([]string{dirPath}, missing...)
+		dirPath = path.Dir(dirPath)
+	}
+}
+
+// checkRestore reports why entry cannot be put back at target, if it
+// cannot. When the directories on the way to target are gone, it is the
+// nearest one left that they would be made in.
+func (vfs *VFS) checkRestore(target string) error {
+	if target == "/" {
+		return fmt.Errorf("cannot restore over /")
+	}
+	dirPath, name := path.Split(target)
+	missing, parent := vfs.missingDirs(dirPath)
+	if len(missing) > 0 {
+		if _, isFile := parent.Files[path.Base(missing[0])]; isFile {
+			return fmt.Errorf("%s is a file", missing[0])
+		}
+	}
+	if !checkOverlap(parent.WritePermission, vfs.CurrentUser.GroupPerms) {
+		return fmt.Errorf("you do not have write permissions for %s", parent.Path)
+	}
+	if vfs.isLocked(parent) {
+		return fmt.Errorf("%s is a locked vault", parent.Path)
+	}
+	if len(missing) == 0 {
+		_, isFile := parent.Files[name]
+		_, isDir := parent.SubDirs[name]
+		if isFile || isDir {
+			return fmt.Errorf("%s already exists", target)
+		}
+	}
+	return nil
+}
+
+// restoreCharges is what putting entry back at target adds, including the
+// directories on the way to it that are made again for the current user.
+func (vfs *VFS) restoreCharges(target string, entry *TrashEntry) []quotaCharge {
+	var charges []quotaCharge
+	missing, _ := vfs.missingDirs(path.Dir(target))
+	for _, dirPath := range missing {
+		charges = append(charges, quotaCharge{path.Dir(dirPath), vfs.userName(), quotaUsage{0, 1}})
+	}
+	added := copyCharges(entry.File, entry.Dir, nil)
+	for _, owner := range sortedKeys(added) {
+		charges = append(charges, quotaCharge{path.Dir(target), owner, added[owner]})
+	}
+	return charges
+}
+
+func (vfs *VFS) trashRestore(id int, target string) {
+	user := vfs.userName()
+	_, entry := vfs.findTrash(user, id)
+	if entry == nil {
+		vfs.fail("No entry", id, "in the trash")
+		return
+	}
+	if target == "" {
+		target = entry.Path
+	} else if !strings.HasPrefix(target, "/") {
+		target = joinPath(vfs.CurrentDir.Path, target)
+	}
+	target = path.Clean(target)
+	if err := vfs.checkRestore(target); err != nil {
+		vfs.deny("untrash", target, "Cannot restore", id, "to", target+":", err)
+		return
+	}
+	if !vfs.withinQuotas(vfs.restoreCharges(target, entry)) {
+		return
+	}
+	vfs.restoreFromTrash(user, id, target)
+	vfs.logMutation(journalRecord{Op: "untrash", Path: target, Content: user, Size: id})
+	fmt.Println("Restored", target)
+}
+
+// undoTrash restores what rm just moved to the trash, if it is still there.
+func (vfs *VFS) undoTrash(user string, id int) *undoAction {
+	_, entry := vfs.findTrash(user, id)
+	return &undoAction{
+		description: "rm " + entry.Path,
+		undo: func() error {
+			if _, current := vfs.findTrash(user, id); current != entry {
+				return fmt.Errorf("it is no longer in the trash")
+			}
+			if err := vfs.checkRestore(entry.Path); err != nil {
+				return err
+			}
+			if !vfs.withinQuotas(vfs.restoreCharges(entry.Path, entry)) {
+				return fmt.Errorf("it would go over a quota")
+			}
+			vfs.restoreFromTrash(user, id, entry.Path)
+			vfs.logMutation(journalRecord{Op: "untrash", Path: entry.Path, Content: user, Size: id})
+			return nil
+		},
+	}
+}
+
+// dropTrash purges entry id from the trash of user, or everything in it if
+// id is 0.
+func (vfs *VFS) dropTrash(user string, id int) {
+	kept := vfs.Trash[user][:0]
+	for _, entry := range vfs.Trash[user] {
+		if id != 0 && entry.ID != id {
+			kept = append(kept, entry)
+			continue
+		}
+		walkFiles(entry.root(), vfs.releaseFile)
+	}
+	if len(kept) == 0 {
+		delete(vfs.Trash, user)
+	} else {
+		vfs.Trash[user] = kept
+	}
+}
+
+func (vfs *VFS) trashEmpty(id int) {
+	user := vfs.userName()
+	if id != 0 {
+		if _, entry := vfs.findTrash(user, id); entry == nil {
+			vfs.fail("No entry", id, "in the trash")
+			return
+		}
+	}
+	vfs.dropTrash(user, id)
+	vfs.logMutation(journalRecord{Op: "purge", Content: user, Size: id})
+	fmt.Println("Emptied trash")
+}
+
+// purgeTrash drops everything that has been in any trash for longer than
+// the retention period.
+func (vfs *VFS) purgeTrash() {
+	retention := vfs.trashRetention()
+	if retention == 0 {
+		return
+	}
+	for _, user := range sortedKeys(vfs.Trash) {
+		var expired []int
+		for _, entry := range vfs.Trash[user] {
+			if time.Since(entry.DeletedAt) > retention {
+				expired = append(expired, entry.ID)
+			}
+		}
+		for _, id := range expired {
+			vfs.dropTrash(user, id)
+			vfs.logMutation(journalRecord{Op: "purge", Content: user, Size: id})
+		}
+	}
+}
+
+func (vfs *VFS) trashList() {
+	vfs.purgeTrash()
+	for _, entry := range vfs.Trash[vfs.userName()] {
+		kind := "file"
+		if entry.Dir != nil {
+			kind = "dir"
+		}
+		fmt.Printf("%4d  %s  %-10s %-4s %s\n", entry.ID, entry.DeletedAt.Local().Format("2006-01-02 15:04:05"), ownerName(entry.Owner), kind, entry.Path)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRmInsideVaultKeepsTrashSealed(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "image.gob")
+	vfs, err := openImage(imagePath, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vfs.closeJournal()
+	commands := GetCommands(vfs, GetUsage())
+	vfs.CommandMap = commands
+
+	executeLine(vfs, commands, "mkdir /safe")
+	vfs.vaultCreate("/safe", "vault key")
+	executeLine(vfs, commands, "echo /safe/s.txt topsecretcontent")
+	executeLine(vfs, commands, "rm /safe/s.txt")
+	if vfs.Status == 0 {
+		t.Error("rm inside an unlocked vault moved the file to the trash")
+	}
+	if len(vfs.Trash) != 0 {
+		t.Errorf("trash holds %v", vfs.Trash)
+	}
+
+	executeLine(vfs, commands, "vault lock /safe")
+	if err := vfs.save(); err != nil {
+		t.Fatal(err)
+	}
+	image, err := os.ReadFile(imagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(image, []byte("topsecretcontent")) {
+		t.Error("the saved image holds the vault's contents in the clear")
+	}
+}
+
+func TestRestoreIntoMissingDirectory(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   string // run as admin once bob's file is in the trash
+		perms   []int  // the write permission of /pub
+		want    bool   // whether the file comes back
+		wantOut string // what restore prints
+	}{
+		{"parent recreated", "rm -r -f /pub/sub.d", []int{1, -1}, true, "Restored /pub/sub.d/f.txt"},
+		{"ancestor not writable", "rm -r -f /pub/sub.d", []int{0}, false, "you do not have write permissions for /pub"},
+		{"ancestor over its inode quota", "rm -r -f /pub/sub.d; setquota -d /pub 0 0 0 1", []int{1, -1}, false, "Disk quota exceeded"},
+		{"a file in the way", "rm -r -f /pub/sub.d; echo /pub/sub.d x", []int{1, -1}, false, "/pub/sub.d is a file"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vfs := newTestVFS(t)
+			admin := vfs.CurrentUser
+			bob := &User{Name: "bob", GroupPerms: []int{1, -1}}
+			vfs.Users[bob.Name] = bob
+			writeTestFile(t, vfs, "/pub/sub.d/f.txt", "contents")
+			vfs.CurrentUser = bob
+			run(vfs, "rm /pub/sub.d/f.txt")
+			vfs.CurrentUser = admin
+			run(vfs, test.setup)
+			vfs.findDirectoryByPath("/pub").WritePermission = test.perms
+
+			vfs.CurrentUser = bob
+			output := run(vfs, "trash restore 1")
+			if !strings.Contains(output, test.wantOut) {
+				t.Errorf("restore printed %q, want it to mention %q", output, test.wantOut)
+			}
+			content, restored := readTestFile(t, vfs, "/pub/sub.d/f.txt")
+			if restored != test.want || (restored && content != "contents") {
+				t.Errorf("restored: %v with %q, want %v", restored, content, test.want)
+			}
+			if sub := vfs.findDirectoryByPath("/pub/sub.d"); !test.want && sub != nil {
+				t.Error("a refused restore made /pub/sub.d")
+			}
+		})
+	}
+}
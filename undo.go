@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"slices"
+)
+
+// undoAction reverses the last destructive command. Only one is kept, and
+// only for the rest of the session: discard gives up whatever it held on to
+// when it is replaced.
+type undoAction struct {
+	description string
+	undo        func() error
+	discard     func()
+}
+
+// setUndo makes action the one undo runs, dropping the previous one.
+func (vfs *VFS) setUndo(action *undoAction) {
+	vfs.dropUndo()
+	vfs.lastUndo = action
+}
+
+func (vfs *VFS) dropUndo() {
+	if vfs.lastUndo != nil && vfs.lastUndo.discard != nil {
+		vfs.lastUndo.discard()
+	}
+	vfs.lastUndo = nil
+}
+
+func (vfs *VFS) undo() {
+	action := vfs.lastUndo
+	if action == nil {
+		vfs.fail("Nothing to undo")
+		return
+	}
+	if err := action.undo(); err != nil {
+		vfs.fail("Cannot undo", action.description+":", err)
+		return
+	}
+	vfs.lastUndo = nil
+	fmt.Println("Undid", action.description)
+}
+
+// undoRemove puts back a file rm took out of dir. The file keeps its chunks
+// until the undo is dropped.
+func (vfs *VFS) undoRemove(dir *Directory, file *File) *undoAction {
+	filePath := joinPath(dir.Path, file.Name)
+	return &undoAction{
+		description: "rm " + filePath,
+		undo: func() error {
+			if vfs.findDirectoryByPath(dir.Path) != dir {
+				return fmt.Errorf("%s no longer exists", dir.Path)
+			}
+			if _, exists := dir.Files[file.Name]; exists {
+				return fmt.Errorf("%s already exists", filePath)
+			}
+			if !vfs.chargeable(dir.Path, file.Owner, file.Size, 1) {
+				return fmt.Errorf("it would go over a quota")
+			}
+			dir.Files[file.Name] = file
+			vfs.logFileCreate(dir, file)
+			vfs.logFileWrite(dir, file)
+			vfs.logFileChmod(dir, file)
+			return nil
+		},
+		discard: func() { vfs.releaseFile(file) },
+	}
+}
+
+// undoOverwrite brings back the contents command, echo or revert, replaced,
+// holding on to their chunks until the undo is dropped.
+func (vfs *VFS) undoOverwrite(command string, dir *Directory, file *File) *undoAction {
+	filePath := joinPath(dir.Path, file.Name)
+	size, blocks := file.Size, slices.Clone(file.Blocks)
+	for _, hash := range blocks {
+		vfs.blobs.retain(hash)
+	}
+	release := func() {
+		for _, hash := range blocks {
+			vfs.blobs.release(hash)
+		}
+	}
+	return &undoAction{
+		description: command + " " + filePath,
+		undo: func() error {
+			if vfs.findFileByPath(filePath) != file {
+				return fmt.Errorf("%s no longer exists", filePath)
+			}
+			vfs.keepVersion(file, vfs.userName())
+			vfs.replaceContents(file, size, blocks)
+			vfs.logFileWrite(dir, file)
+			return nil
+		},
+		discard: release,
+	}
+}
+
+// undoMove moves a file mv moved to to back to from.
+func (vfs *VFS) undoMove(from string, to string) *undoAction {
+	return &undoAction{
+		description: "mv " + from + " " + to,
+		undo: func() error {
+			file := vfs.findFileByPath(to)
+			if file == nil {
+				return fmt.Errorf("%s no longer exists", to)
+			}
+			dirPath, name := path.Split(from)
+			source := vfs.findDirectoryByPath(dirPath)
+			if source == nil {
+				return fmt.Errorf("%s no longer exists", dirPath)
+			}
+			if _, exists := source.Files[name]; exists {
+				return fmt.Errorf("%s already exists", from)
+			}
+			dest := vfs.findDirectoryByPath(path.Dir(to))
+			delete(dest.Files, file.Name)
+			file.Name = name
+			source.Files[name] = file
+			vfs.logMutation(journalRecord{Op: "rename", Path: to, To: from})
+			return nil
+		},
+	}
+}
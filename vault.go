@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// vaultContents is what a vault seals: its entries and the chunks of every
+// file below it, which stay out of the image's own blob store.
+type vaultContents struct {
+	Files   map[string]*File
+	SubDirs map[string]*Directory
+	Blobs   map[string][]byte
+}
+
+// resolveVault finds the vault directory at target, locked or not.
+func (vfs *VFS) resolveVault(target string) (*Directory, error) {
+	target = strings.TrimRight(target, "/")
+	dirPath, name := path.Split(target)
+	parent, err := vfs.resolveDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	dir, exists := parent.SubDirs[name]
+	if !exists {
+		return nil, fmt.Errorf("directory %s does not exist", target)
+	}
+	if dir.Vault == nil {
+		return nil, fmt.Errorf("%s is not a vault", dir.Path)
+	}
+	return dir, nil
+}
+
+func (vfs *VFS) isLocked(dir *Directory) bool {
+	return dir.Vault != nil && vfs.vaultKeys[dir] == nil
+}
+
+// unlockedVault returns the unlocked vault that dirPath is inside of, if
+// any.
+func (vfs *VFS) unlockedVault(dirPath string) *Directory {
+	for vault := range vfs.vaultKeys {
+		if strings.HasPrefix(dirPath, vault.Path+"/") {
+			return vault
+		}
+	}
+	return nil
+}
+
+func (vfs *VFS) vaultCreate(target string, key string) {
+	dir, err := vfs.resolveDir(target)
+	if err != nil {
+		vfs.fail(err)
+		return
+	}
+	switch {
+	case dir == vfs.Root:
+		vfs.fail("The root directory cannot be a vault")
+		return
+	case dir.Vault != nil:
+		vfs.fail(dir.Path, "is already a vault")
+		return
+	case vfs.unlockedVault(dir.Path) != nil || containsVault(dir):
+		vfs.fail("Vaults cannot be nested")
+		return
+	case !checkOverlap(dir.WritePermission, vfs.CurrentUser.GroupPerms):
+		vfs.deny("vault-create", dir.Path, "You do not have write permissions for", dir.Path)
+		return
+	}
+	if key == "" {
+		if key, err = readNewSecret("Key for "+dir.Path+": ", true); err != nil {
+			vfs.fail(err)
+			return
+		}
+	}
+	vaultKey, err := newSealKey(key)
+	if err != nil {
+		vfs.fail(err)
+		return
+	}
+
+	dir.Vault = &Vault{Salt: vaultKey.salt, Iterations: vaultKey.iterations}
+	if vfs.vaultKeys == nil {
+		vfs.vaultKeys = make(map[*Directory]*sealKey)
+	}
+	vfs.vaultKeys[dir] = vaultKey
+	if err := vfs.sealVault(dir); err != nil {
+		vfs.fail("Error sealing", dir.Path+":", err)
+		return
+	}
+	vfs.audit(journalRecord{Op: "vault-create", Path: dir.Path}, false)
+	// The image and its backup may still hold the contents in the clear.
+	if !vfs.ReadOnly {
+		if err := vfs.save(); err != nil {
+			vfs.fail("Error saving", vfs.ImagePath+":", err)
+			return
+		}
+		os.Remove(vfs.ImagePath + ".bak")
+	}
+	fmt.Println("Vault created at", dir.Path, "(unlocked)")
+}
+
+func (vfs *VFS) vaultUnlock(target string, key string) {
+	dir, err := vfs.resolveVault(target)
+	if err != nil {
+		vfs.fail(err)
+		return
+	}
+	if !vfs.isLocked(dir) {
+		vfs.fail(dir.Path, "is already unlocked")
+		return
+	}
+	if !checkOverlap(dir.ReadPermission, vfs.CurrentUser.GroupPerms) {
+		vfs.fail("You do not have read permissions for", dir.Path)
+		return
+	}
+	if key == "" {
+		if key, err = readSecret("Key for " + dir.Path + ": "); err != nil {
+			vfs.fail(err)
+			return
+		}
+	}
+	vaultKey, err := deriveKey(key, dir.Vault.Salt, dir.Vault.Iterations)
+	if err != nil {
+		vfs.fail(err)
+		return
+	}
+	plaintext, err := vaultKey.open(dir.Vault.Sealed, nil)
+	if err != nil {
+		vfs.fail("Cannot unlock", dir.Path+":", err)
+		return
+	}
+	var contents vaultContents
+	if err := gob.NewDecoder(bytes.NewReader(plaintext)).Decode(&contents); err != nil {
+		vfs.fail("Cannot unlock", dir.Path+":", err)
+		return
+	}
+
+	dir.Files, dir.SubDirs = contents.Files, contents.SubDirs
+	if dir.Files == nil {
+		dir.Files = make(map[string]*File)
+	}
+	if dir.SubDirs == nil {
+		dir.SubDirs = make(map[string]*Directory)
+	}
+	walkFiles(dir, func(file *File) {
+		for _, hash := range fileHashes(file) {
+			if hash != "" && !vfs.blobs.has(hash) {
+				vfs.blobs.data[hash] = contents.Blobs[hash]
+			}
+			vfs.blobs.retain(hash)
+		}
+	})
+	if vfs.vaultKeys == nil {
+		vfs.vaultKeys = make(map[*Directory]*sealKey)
+	}
+	vfs.vaultKeys[dir] = vaultKey
+	vfs.quotaCounts = nil
+	fmt.Println("Unlocked", dir.Path)
+}
+
+func (vfs *VFS) vaultLock(target string) {
+	dir, err := vfs.resolveVault(target)
+	if err != nil {
+		vfs.fail(err)
+		return
+	}
+	if vfs.isLocked(dir) {
+		vfs.fail(dir.Path, "is already locked")
+		return
+	}
+	if err := vfs.lockVault(dir); err != nil {
+		vfs.fail("Error sealing", dir.Path+":", err)
+		return
+	}
+	fmt.Println("Locked", dir.Path)
+}
+
+// lockVault seals an unlocked vault and forgets its contents and key.
+func (vfs *VFS) lockVault(dir *Directory) error {
+	if err := vfs.sealVault(dir); err != nil {
+		return err
+	}
+	vfs.releaseDir(dir)
+	dir.Files = make(map[string]*File)
+	dir.SubDirs = make(map[string]*Directory)
+	delete(vfs.vaultKeys, dir)
+	vfs.quotaCounts = nil
+	if vfs.CurrentDir == dir || strings.HasPrefix(vfs.CurrentDir.Path, dir.Path+"/") {
+		if parent := vfs.findDirectoryByPath(dir.Parent); parent != nil {
+			vfs.CurrentDir = parent
+		}
+	}
+	return nil
+}
+
+func (vfs *VFS) vaultList() {
+	var walk func(dir *Directory)
+	walk = func(dir *Directory) {
+		if dir.Vault != nil {
+			state := "unlocked"
+			if vfs.isLocked(dir) {
+				state = "locked"
+			}
+			fmt.Printf("%-10s %s\n", state, dir.Path)
+		}
+		for _, name := range sortedKeys(dir.SubDirs) {
+			walk(dir.SubDirs[name])
+		}
+	}
+	walk(vfs.Root)
+}
+
+// sealVault encrypts the current contents of an unlocked vault into its
+// Sealed field and journals the result.
+func (vfs *VFS) sealVault(dir *Directory) error {
+	if err := vfs.resealVault(dir); err != nil {
+		return err
+	}
+	vault, err := json.Marshal(dir.Vault)
+	if err != nil {
+		return err
+	}
+	vfs.logMutation(journalRecord{Op: "vault", Path: dir.Path, Data: vault})
+	return nil
+}
+
+func (vfs *VFS) resealVault(dir *Directory) error {
+	key := vfs.vaultKeys[dir]
+	if key == nil {
+		return fmt.Errorf("%s is locked", dir.Path)
+	}
+	contents := vaultContents{Files: dir.Files, SubDirs: dir.SubDirs, Blobs: make(map[string][]byte)}
+	var err error
+	walkFiles(dir, func(file *File) {
+		for _, hash := range fileHashes(file) {
+			if _, done := contents.Blobs[hash]; hash == "" || done || err != nil {
+				continue
+			}
+			contents.Blobs[hash], err = vfs.blobs.get(hash)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	var plaintext bytes.Buffer
+	if err := gob.NewEncoder(&plaintext).Encode(&contents); err != nil {
+		return fmt.Errorf("failed to encode vault: %w", err)
+	}
+	sealed, err := key.seal(plaintext.Bytes(), nil)
+	if err != nil {
+		return err
+	}
+	dir.Vault.Sealed = sealed
+	return nil
+}
+
+// resealVaults brings the sealed form of every unlocked vault up to date
+// before the image is saved.
+func (vfs *VFS) resealVaults() error {
+	for dir := range vfs.vaultKeys {
+		if err := vfs.resealVault(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// journalVaults journals a change under an unlocked vault as a new sealed
+// copy of the vault, so that nothing inside it reaches the journal in the
+// clear. It reports whether rec was taken care of that way; changes that
+// also touch something outside the vault are saved with the next command
+// instead.
+func (vfs *VFS) journalVaults(rec journalRecord) bool {
+	var vaults []*Directory
+	outside := false
+	for _, recPath := range []string{rec.Path, rec.To} {
+		if recPath == "" {
+			continue
+		}
+		if vault := vfs.unlockedVault(recPath); vault != nil {
+			if !slices.Contains(vaults, vault) {
+				vaults = append(vaults, vault)
+			}
+		} else {
+			outside = true
+		}
+	}
+	if len(vaults) == 0 {
+		return false
+	}
+	for _, vault := range vaults {
+		if err := vfs.sealVault(vault); err != nil {
+			fmt.Fprintln(os.Stderr, "Error sealing", vault.Path+":", err)
+		}
+	}
+	if outside {
+		vfs.checkpointNow = true
+	}
+	return true
+}
+
+// applyVault restores the sealed state of a vault from the journal.
+func (vfs *VFS) applyVault(rec journalRecord) {
+	dir := vfs.findDirectoryByPath(rec.Path)
+	if dir == nil || dir == vfs.Root {
+		return
+	}
+	var vault Vault
+	if err := json.Unmarshal(rec.Data, &vault); err != nil {
+		fmt.Fprintln(os.Stderr, "Error replaying vault", rec.Path+":", err)
+		return
+	}
+	if vfs.vaultKeys[dir] == nil {
+		vfs.releaseDir(dir)
+		dir.Files = make(map[string]*File)
+		dir.SubDirs = make(map[string]*Directory)
+	}
+	dir.Vault = &vault
+}
+
+func containsVault(dir *Directory) bool {
+	for _, sub := range dir.SubDirs {
+		if sub.Vault != nil || containsVault(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// sealedTree returns the tree under dir as it is saved: the same, except
+// that vaults are left empty because their contents are in Vault.Sealed.
+func sealedTree(dir *Directory) *Directory {
+	saved := *dir
+	if dir.Vault != nil {
+		saved.Files = make(map[string]*File)
+		saved.SubDirs = make(map[string]*Directory)
+		return &saved
+	}
+	saved.SubDirs = make(map[string]*Directory, len(dir.SubDirs))
+	for name, sub := range dir.SubDirs {
+		saved.SubDirs[name] = sealedTree(sub)
+	}
+	return &saved
+}
@@ -0,0 +1,1364 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A repository keeps its history in a vcsDirName directory at the top of the
+// tree it tracks, laid out like git's:
+//
+//	HEAD                 "ref: refs/heads/<branch>" or a commit hash
+//	index                the staged files, one "<mode> <hash>\t<path>" a line
+//	refs/heads/<branch>  the commit the branch points at
+//	objects/xx/yyyy...   blobs, trees and commits, named by their hash
+//	MERGE_HEAD           the commit being merged while conflicts are open
+const (
+	vcsDirName    = ".vcs"
+	defaultBranch = "main"
+	modeFile      = "100644"
+	modeExec      = "100755"
+	modeTree      = "040000"
+)
+
+var branchNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+var (
+	errQuota   = errors.New("disk quota exceeded")
+	errRefused = errors.New("the work tree cannot be changed")
+)
+
+// vcsEntry is a tracked file: the hash of its contents and whether it is
+// executable.
+type vcsEntry struct {
+	Hash       string
+	Executable bool
+}
+
+func (entry vcsEntry) mode() string {
+	if entry.Executable {
+		return modeExec
+	}
+	return modeFile
+}
+
+type vcsCommit struct {
+	Tree    string
+	Parents []string
+	Author  string
+	Time    time.Time
+	Message string
+}
+
+// repo is the repository whose work tree is root.
+type repo struct {
+	vfs  *VFS
+	root *Directory
+	meta *Directory
+}
+
+// findRepo looks for the repository the current directory is in.
+func (vfs *VFS) findRepo() (*repo, error) {
+	for dir := vfs.CurrentDir; dir != nil; dir = vfs.findDirectoryByPath(dir.Parent) {
+		if meta, exists := dir.SubDirs[vcsDirName]; exists {
+			return &repo{vfs: vfs, root: dir, meta: meta}, nil
+		}
+		if dir.Parent == "" {
+			break
+		}
+	}
+	return nil, fmt.Errorf("not a repository (or any of the parent directories): %s", vcsDirName)
+}
+
+// writableRepo is findRepo for commands that change the work tree.
+func (vfs *VFS) writableRepo() *repo {
+	r, err := vfs.findRepo()
+	if err != nil {
+		vfs.fail(err)
+		return nil
+	}
+	for _, dir := range []*Directory{r.root, r.meta} {
+		if !checkOverlap(dir.WritePermission, vfs.CurrentUser.GroupPerms) {
+			vfs.deny("vcs", dir.Path, "You do not have write permissions for", dir.Path)
+			return nil
+		}
+	}
+	return r
+}
+
+func (r *repo) readMeta(name string) ([]byte, bool) {
+	file := r.vfs.findFileByPath(joinPath(r.meta.Path, name))
+	if file == nil {
+		return nil, false
+	}
+	content, err := r.vfs.readFile(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading", name+":", err)
+		return nil, false
+	}
+	return content, true
+}
+
+// writeMeta writes a file of the repository's own, charging it against the
+// quotas like any other.
+func (r *repo) writeMeta(name string, data []byte) error {
+	dirPath, fileName := path.Split(joinPath(r.meta.Path, name))
+	dir := r.vfs.mkdirAll(dirPath)
+	if !r.vfs.writable(dir, fileName, len(data)) {
+		return errQuota
+	}
+	_, err := r.vfs.storeFile(dir, fileName, data)
+	return err
+}
+
+func (r *repo) removeMeta(name string) {
+	if file, _ := r.vfs.detach(joinPath(r.meta.Path, name)); file != nil {
+		r.vfs.releaseFile(file)
+		r.vfs.logMutation(journalRecord{Op: "delete", Path: joinPath(r.meta.Path, name)})
+	}
+}
+
+func hashObject(kind string, data []byte) string {
+	sum := sha256.New()
+	fmt.Fprintf(sum, "%s %d\x00", kind, len(data))
+	sum.Write(data)
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+func objectName(hash string) string {
+	return "objects/" + hash[:2] + "/" + hash[2:]
+}
+
+func shortHash(hash string) string {
+	return hash[:min(7, len(hash))]
+}
+
+// writeObject stores data as an object of the given kind and returns its
+// hash. Objects never change, so one that exists is not written again.
+func (r *repo) writeObject(kind string, data []byte) (string, error) {
+	hash := hashObject(kind, data)
+	if _, exists := r.readMeta(objectName(hash)); exists {
+		return hash, nil
+	}
+	object := append([]byte(fmt.Sprintf("%s %d\x00", kind, len(data))), data...)
+	return hash, r.writeMeta(objectName(hash), object)
+}
+
+func (r *repo) readObject(hash string, kind string) ([]byte, error) {
+	if len(hash) < 4 {
+		return nil, fmt.Errorf("invalid object name %q", hash)
+	}
+	object, exists := r.readMeta(objectName(hash))
+	if !exists {
+		return nil, fmt.Errorf("object %s is missing", shortHash(hash))
+	}
+	header, data, found := bytes.Cut(object, []byte{0})
+	if !found || !strings.HasPrefix(string(header), kind+" ") {
+		return nil, fmt.Errorf("object %s is not a %s", shortHash(hash), kind)
+	}
+	return data, nil
+}
+
+// writeTree stores the files in entries as tree objects, one per directory,
+// and returns the hash of the top one.
+func (r *repo) writeTree(entries map[string]vcsEntry) (string, error) {
+	files := make(map[string]vcsEntry)
+	subtrees := make(map[string]map[string]vcsEntry)
+	for filePath, entry := range entries {
+		first, rest, nested := strings.Cut(filePath, "/")
+		if !nested {
+			files[first] = entry
+			continue
+		}
+		if subtrees[first] == nil {
+			subtrees[first] = make(map[string]vcsEntry)
+		}
+		subtrees[first][rest] = entry
+	}
+	lines := make(map[string]string)
+	for name, entry := range files {
+		lines[name] = fmt.Sprintf("%s blob %s\t%s\n", entry.mode(), entry.Hash, name)
+	}
+	for name, sub := range subtrees {
+		hash, err := r.writeTree(sub)
+		if err != nil {
+			return "", err
+		}
+		lines[name] = fmt.Sprintf("%s tree %s\t%s\n", modeTree, hash, name)
+	}
+	var tree strings.Builder
+	for _, name := range sortedKeys(lines) {
+		tree.WriteString(lines[name])
+	}
+	return r.writeObject("tree", []byte(tree.String()))
+}
+
+// readTree flattens the tree at hash into out, keyed by path under prefix.
+func (r *repo) readTree(hash string, prefix string, out map[string]vcsEntry) error {
+	data, err := r.readObject(hash, "tree")
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		fields, name, ok := strings.Cut(line, "\t")
+		parts := strings.Fields(fields)
+		if !ok || len(parts) != 3 {
+			return fmt.Errorf("tree %s is corrupt", shortHash(hash))
+		}
+		filePath := name
+		if prefix != "" {
+			filePath = prefix + "/" + name
+		}
+		if parts[1] == "tree" {
+			if err := r.readTree(parts[2], filePath, out); err != nil {
+				return err
+			}
+			continue
+		}
+		out[filePath] = vcsEntry{Hash: parts[2], Executable: parts[0] == modeExec}
+	}
+	return nil
+}
+
+func (r *repo) writeCommit(commit vcsCommit) (string, error) {
+	var data strings.Builder
+	fmt.Fprintf(&data, "tree %s\n", commit.Tree)
+	for _, parent := range commit.Parents {
+		fmt.Fprintf(&data, "parent %s\n", parent)
+	}
+	fmt.Fprintf(&data, "author %s %d\n\n%s\n", commit.Author, commit.Time.Unix(), commit.Message)
+	return r.writeObject("commit", []byte(data.String()))
+}
+
+func (r *repo) readCommit(hash string) (vcsCommit, error) {
+	data, err := r.readObject(hash, "commit")
+	if err != nil {
+		return vcsCommit{}, err
+	}
+	headers, message, _ := strings.Cut(string(data), "\n\n")
+	commit := vcsCommit{Message: strings.TrimSuffix(message, "\n")}
+	for _, line := range strings.Split(headers, "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "tree":
+			commit.Tree = value
+		case "parent":
+			commit.Parents = append(commit.Parents, value)
+		case "author":
+			if at := strings.LastIndex(value, " "); at >= 0 {
+				seconds, _ := strconv.ParseInt(value[at+1:], 10, 64)
+				commit.Author, commit.Time = value[:at], time.Unix(seconds, 0)
+			}
+		}
+	}
+	return commit, nil
+}
+
+// commitFiles returns the files recorded in commit hash, or none for the
+// empty hash of a branch without commits.
+func (r *repo) commitFiles(hash string) (map[string]vcsEntry, error) {
+	files := make(map[string]vcsEntry)
+	if hash == "" {
+		return files, nil
+	}
+	commit, err := r.readCommit(hash)
+	if err != nil {
+		return nil, err
+	}
+	return files, r.readTree(commit.Tree, "", files)
+}
+
+// head returns the branch HEAD is on, empty when it is detached, and the
+// commit it points at, empty on a branch without commits.
+func (r *repo) head() (string, string) {
+	content, _ := r.readMeta("HEAD")
+	ref := strings.TrimSpace(string(content))
+	if branch, ok := strings.CutPrefix(ref, "ref: refs/heads/"); ok {
+		return branch, r.branchHash(branch)
+	}
+	return "", ref
+}
+
+func (r *repo) branchHash(branch string) string {
+	content, _ := r.readMeta("refs/heads/" + branch)
+	return strings.TrimSpace(string(content))
+}
+
+func (r *repo) branchExists(branch string) bool {
+	_, exists := r.readMeta("refs/heads/" + branch)
+	return exists
+}
+
+// advance points whatever HEAD is on at hash.
+func (r *repo) advance(hash string) error {
+	if branch, _ := r.head(); branch != "" {
+		return r.writeMeta("refs/heads/"+branch, []byte(hash+"\n"))
+	}
+	return r.writeMeta("HEAD", []byte(hash+"\n"))
+}
+
+// resolve turns a branch name, HEAD or a commit hash, possibly shortened,
+// into a commit hash.
+func (r *repo) resolve(rev string) (string, error) {
+	if rev == "HEAD" {
+		if _, hash := r.head(); hash != "" {
+			return hash, nil
+		}
+		return "", fmt.Errorf("HEAD has no commits yet")
+	}
+	if r.branchExists(rev) {
+		return r.branchHash(rev), nil
+	}
+	if len(rev) >= 4 && len(rev) <= sha256.Size*2 {
+		if objects := r.vfs.findDirectoryByPath(joinPath(r.meta.Path, "objects/"+rev[:2])); objects != nil {
+			var found []string
+			for name := range objects.Files {
+				if strings.HasPrefix(rev[:2]+name, rev) {
+					found = append(found, rev[:2]+name)
+				}
+			}
+			if len(found) > 1 {
+				return "", fmt.Errorf("%s is ambiguous", rev)
+			}
+			if len(found) == 1 {
+				if _, err := r.readCommit(found[0]); err != nil {
+					return "", err
+				}
+				return found[0], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("unknown revision %s", rev)
+}
+
+func (r *repo) readIndex() map[string]vcsEntry {
+	index := make(map[string]vcsEntry)
+	content, _ := r.readMeta("index")
+	for _, line := range strings.Split(string(content), "\n") {
+		fields, filePath, ok := strings.Cut(line, "\t")
+		mode, hash, _ := strings.Cut(fields, " ")
+		if ok {
+			index[filePath] = vcsEntry{Hash: hash, Executable: mode == modeExec}
+		}
+	}
+	return index
+}
+
+func (r *repo) writeIndex(index map[string]vcsEntry) error {
+	var data strings.Builder
+	for _, filePath := range sortedKeys(index) {
+		fmt.Fprintf(&data, "%s %s\t%s\n", index[filePath].mode(), index[filePath].Hash, filePath)
+	}
+	return r.writeMeta("index", []byte(data.String()))
+}
+
+// workTree returns the files under the repository, keyed by their path in
+// it. The repository's own directory and vaults are left out: objects are
+// kept in the clear, so nothing inside a vault may be tracked.
+func (r *repo) workTree() map[string]*File {
+	files := make(map[string]*File)
+	var walk func(dir *Directory, prefix string)
+	walk = func(dir *Directory, prefix string) {
+		for name, file := range dir.Files {
+			files[prefix+name] = file
+		}
+		for name, sub := range dir.SubDirs {
+			if (dir == r.root && name == vcsDirName) || sub.Vault != nil {
+				continue
+			}
+			walk(sub, prefix+name+"/")
+		}
+	}
+	walk(r.root, "")
+	return files
+}
+
+func (r *repo) fileEntry(file *File) (vcsEntry, []byte, error) {
+	content, err := r.vfs.readFile(file)
+	if err != nil {
+		return vcsEntry{}, nil, err
+	}
+	return vcsEntry{Hash: hashObject("blob", content), Executable: file.Executable}, content, nil
+}
+
+// changes compares two sets of files and returns the paths that were added,
+// modified and deleted going from before to after.
+func changes(before map[string]vcsEntry, after map[string]vcsEntry) (added []string, modified []string, deleted []string) {
+	for _, filePath := range sortedKeys(after) {
+		old, existed := before[filePath]
+		switch {
+		case !existed:
+			added = append(added, filePath)
+		case old != after[filePath]:
+			modified = append(modified, filePath)
+		}
+	}
+	for _, filePath := range sortedKeys(before) {
+		if _, exists := after[filePath]; !exists {
+			deleted = append(deleted, filePath)
+		}
+	}
+	return added, modified, deleted
+}
+
+// workEntries hashes the work tree, as it would be staged.
+func (r *repo) workEntries() (map[string]vcsEntry, error) {
+	entries := make(map[string]vcsEntry)
+	for filePath, file := range r.workTree() {
+		entry, _, err := r.fileEntry(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filePath, err)
+		}
+		entries[filePath] = entry
+	}
+	return entries, nil
+}
+
+// trackedChanges reports whether any tracked file differs between HEAD, the
+// index and the work tree.
+func (r *repo) trackedChanges(headFiles map[string]vcsEntry, index map[string]vcsEntry) (bool, error) {
+	added, modified, deleted := changes(headFiles, index)
+	if len(added)+len(modified)+len(deleted) > 0 {
+		return true, nil
+	}
+	work, err := r.workEntries()
+	if err != nil {
+		return false, err
+	}
+	for filePath, entry := range index {
+		if work[filePath] != entry {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// relPath turns target, relative to the current directory, into a path in
+// the repository.
+func (r *repo) relPath(target string) (string, error) {
+	if !strings.HasPrefix(target, "/") {
+		target = joinPath(r.vfs.CurrentDir.Path, target)
+	}
+	target = path.Clean(target)
+	switch {
+	case target == r.root.Path:
+		return "", nil
+	case r.root.Path == "/":
+		return strings.TrimPrefix(target, "/"), nil
+	case strings.HasPrefix(target, r.root.Path+"/"):
+		return strings.TrimPrefix(target, r.root.Path+"/"), nil
+	}
+	return "", fmt.Errorf("%s is outside the repository at %s", target, r.root.Path)
+}
+
+func underPath(filePath string, prefix string) bool {
+	return prefix == "" || filePath == prefix || strings.HasPrefix(filePath, prefix+"/")
+}
+
+// workChange is what a checkout or merge does to one file of the work
+// tree: write content to it, or remove it when remove is set.
+type workChange struct {
+	content    []byte
+	executable bool
+	remove     bool
+}
+
+// checkoutChange reads the contents of entry to write them to the work tree.
+func (r *repo) checkoutChange(entry vcsEntry) (workChange, error) {
+	content, err := r.readObject(entry.Hash, "blob")
+	if err != nil {
+		return workChange{}, err
+	}
+	return workChange{content: content, executable: entry.Executable}, nil
+}
+
+// checkWorkChanges reports whether the current user may make all of
+// changes, as echo and rm would let them: writing to each file or, for a
+// new one, to the nearest directory that exists, and removing each file,
+// all within the quotas. It prints why when they may not.
+func (r *repo) checkWorkChanges(changes map[string]workChange) bool {
+	vfs := r.vfs
+	var charges []quotaCharge
+	created := make(map[string]bool)
+	for _, filePath := range sortedKeys(changes) {
+		change := changes[filePath]
+		target := joinPath(r.root.Path, filePath)
+		dirPath, name := path.Dir(target), path.Base(target)
+		dir := vfs.findDirectoryByPath(dirPath)
+		var file *File
+		if dir != nil {
+			file = dir.Files[name]
+		}
+		if file != nil && !checkOverlap(file.WritePermission, vfs.CurrentUser.GroupPerms) {
+			vfs.deny("vcs", target, "You do not have write permissions for", target)
+			return false
+		}
+		if change.remove {
+			if file != nil {
+				charges = append(charges, quotaCharge{dir.Path, file.Owner, quotaUsage{-file.Size, -1}})
+			}
+			continue
+		}
+		if file != nil {
+			charges = append(charges, quotaCharge{dir.Path, file.Owner, quotaUsage{len(change.content) - file.Size, 0}})
+			continue
+		}
+		// Missing directories are made on the way, as the current user.
+		for dir == nil {
+			if !created[dirPath] {
+				created[dirPath] = true
+				charges = append(charges, quotaCharge{path.Dir(dirPath), vfs.userName(), quotaUsage{0, 1}})
+			}
+			dirPath = path.Dir(dirPath)
+			dir = vfs.findDirectoryByPath(dirPath)
+		}
+		switch {
+		case dir.Path == dirPath && dir.SubDirs[name] != nil:
+			vfs.fail("vcs:", target, "is a directory")
+			return false
+		case dir.Vault != nil || vfs.unlockedVault(dir.Path) != nil:
+			vfs.fail("vcs: will not write", target, "into a vault")
+			return false
+		case !checkOverlap(dir.WritePermission, vfs.CurrentUser.GroupPerms):
+			vfs.deny("vcs", target, "You do not have write permissions for", dir.Path)
+			return false
+		}
+		charges = append(charges, quotaCharge{joinPath(r.root.Path, path.Dir(filePath)), vfs.userName(), quotaUsage{len(change.content), 1}})
+	}
+	return vfs.withinQuotas(charges)
+}
+
+// applyWorkChanges makes changes to the work tree, which checkWorkChanges
+// has let through.
+func (r *repo) applyWorkChanges(changes map[string]workChange) error {
+	for _, filePath := range sortedKeys(changes) {
+		if changes[filePath].remove {
+			r.removeWorkFile(filePath)
+		}
+	}
+	for _, filePath := range sortedKeys(changes) {
+		if change := changes[filePath]; !change.remove {
+			if err := r.writeWorkFile(filePath, change.content, change.executable); err != nil {
+				return fmt.Errorf("%s: %w", filePath, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *repo) writeWorkFile(filePath string, content []byte, executable bool) error {
+	dirPath, name := path.Split(joinPath(r.root.Path, filePath))
+	dir := r.vfs.mkdirAll(dirPath)
+	if _, isDir := dir.SubDirs[name]; isDir {
+		return fmt.Errorf("%s is a directory", filePath)
+	}
+	file, err := r.vfs.storeFile(dir, name, content)
+	if err != nil {
+		return err
+	}
+	if file.Executable != executable {
+		file.Executable = executable
+		r.vfs.logFileChmod(dir, file)
+	}
+	return nil
+}
+
+func (r *repo) removeWorkFile(filePath string) {
+	target := joinPath(r.root.Path, filePath)
+	if file, _ := r.vfs.detach(target); file != nil {
+		r.vfs.releaseFile(file)
+		r.vfs.logMutation(journalRecord{Op: "delete", Path: target})
+	}
+}
+
+// switchFiles changes the work tree and the index from the files in from to
+// those in to. Nothing is changed unless all of it is allowed.
+func (r *repo) switchFiles(from map[string]vcsEntry, to map[string]vcsEntry) error {
+	changes := make(map[string]workChange)
+	for filePath := range from {
+		if _, kept := to[filePath]; !kept {
+			changes[filePath] = workChange{remove: true}
+		}
+	}
+	for _, filePath := range sortedKeys(to) {
+		if from[filePath] != to[filePath] || r.vfs.findFileByPath(joinPath(r.root.Path, filePath)) == nil {
+			change, err := r.checkoutChange(to[filePath])
+			if err != nil {
+				return fmt.Errorf("%s: %w", filePath, err)
+			}
+			changes[filePath] = change
+		}
+	}
+	if !r.checkWorkChanges(changes) {
+		return errRefused
+	}
+	if err := r.applyWorkChanges(changes); err != nil {
+		return err
+	}
+	return r.writeIndex(to)
+}
+
+// untrackedInTheWay lists the untracked files that switching to the files
+// in to would overwrite.
+func (r *repo) untrackedInTheWay(index map[string]vcsEntry, to map[string]vcsEntry) ([]string, error) {
+	work, err := r.workEntries()
+	if err != nil {
+		return nil, err
+	}
+	var inTheWay []string
+	for _, filePath := range sortedKeys(to) {
+		_, tracked := index[filePath]
+		if current, exists := work[filePath]; exists && !tracked && current != to[filePath] {
+			inTheWay = append(inTheWay, filePath)
+		}
+	}
+	return inTheWay, nil
+}
+
+func (vfs *VFS) vcsInit() {
+	if _, exists := vfs.CurrentDir.SubDirs[vcsDirName]; exists {
+		vfs.fail("Already a repository:", vfs.CurrentDir.Path)
+		return
+	}
+	if !checkOverlap(vfs.CurrentDir.WritePermission, vfs.CurrentUser.GroupPerms) {
+		vfs.deny("vcs", vfs.CurrentDir.Path, "You do not have write permissions for", vfs.CurrentDir.Path)
+		return
+	}
+	meta := vfs.mkdirAll(joinPath(vfs.CurrentDir.Path, vcsDirName))
+	vfs.mkdirAll(joinPath(meta.Path, "objects"))
+	vfs.mkdirAll(joinPath(meta.Path, "refs/heads"))
+	r := &repo{vfs: vfs, root: vfs.CurrentDir, meta: meta}
+	if err := r.writeMeta("HEAD", []byte("ref: refs/heads/"+defaultBranch+"\n")); err != nil {
+		vfs.fail("Error initializing repository:", err)
+		return
+	}
+	fmt.Println("Initialized empty repository in", meta.Path)
+}
+
+// vcsAdd stages the files under each of targets as they are in the work
+// tree, including their removal.
+func (vfs *VFS) vcsAdd(targets []string) {
+	r := vfs.writableRepo()
+	if r == nil {
+		return
+	}
+	index := r.readIndex()
+	work := r.workTree()
+	for _, target := range targets {
+		prefix, err := r.relPath(target)
+		if err != nil {
+			vfs.fail(err)
+			return
+		}
+		matched := false
+		for _, filePath := range sortedKeys(work) {
+			if !underPath(filePath, prefix) {
+				continue
+			}
+			matched = true
+			file := work[filePath]
+			if !checkOverlap(file.ReadPermission, vfs.CurrentUser.GroupPerms) {
+				vfs.fail("You do not have read permissions for", filePath)
+				continue
+			}
+			entry, content, err := r.fileEntry(file)
+			if err == nil {
+				_, err = r.writeObject("blob", content)
+			}
+			if err != nil {
+				vfs.fail("Error adding", filePath+":", err)
+				return
+			}
+			index[filePath] = entry
+		}
+		for filePath := range index {
+			if _, exists := work[filePath]; !exists && underPath(filePath, prefix) {
+				matched = true
+				delete(index, filePath)
+			}
+		}
+		if !matched {
+			vfs.fail("Pathspec", target, "did not match any files")
+		}
+	}
+	if err := r.writeIndex(index); err != nil {
+		vfs.fail("Error writing index:", err)
+	}
+}
+
+func (vfs *VFS) vcsCommit(message string) {
+	r := vfs.writableRepo()
+	if r == nil {
+		return
+	}
+	branch, parent := r.head()
+	mergeHead, merging := r.readMeta("MERGE_HEAD")
+	if message == "" && merging {
+		content, _ := r.readMeta("MERGE_MSG")
+		message = strings.TrimSpace(string(content))
+	}
+	if message == "" {
+		vfs.fail("A commit message is required, use -m <message>")
+		return
+	}
+	index := r.readIndex()
+	headFiles, err := r.commitFiles(parent)
+	if err != nil {
+		vfs.fail("Error reading HEAD:", err)
+		return
+	}
+	added, modified, deleted := changes(headFiles, index)
+	if len(added)+len(modified)+len(deleted) == 0 && !merging {
+		vfs.fail("Nothing to commit")
+		return
+	}
+	tree, err := r.writeTree(index)
+	if err != nil {
+		vfs.fail("Error writing tree:", err)
+		return
+	}
+	commit := vcsCommit{Tree: tree, Author: vfs.userName(), Time: time.Now(), Message: message}
+	if parent != "" {
+		commit.Parents = append(commit.Parents, parent)
+	}
+	if merging {
+		commit.Parents = append(commit.Parents, strings.TrimSpace(string(mergeHead)))
+	}
+	hash, err := r.writeCommit(commit)
+	if err == nil {
+		err = r.advance(hash)
+	}
+	if err != nil {
+		vfs.fail("Error writing commit:", err)
+		return
+	}
+	r.removeMeta("MERGE_HEAD")
+	r.removeMeta("MERGE_MSG")
+	if branch == "" {
+		branch = "detached HEAD"
+	}
+	fmt.Printf("[%s %s] %s\n", branch, shortHash(hash), firstLine(message))
+	fmt.Printf(" %d added, %d modified, %d deleted\n", len(added), len(modified), len(deleted))
+}
+
+func firstLine(text string) string {
+	line, _, _ := strings.Cut(text, "\n")
+	return line
+}
+
+func (vfs *VFS) vcsLog() {
+	r, err := vfs.findRepo()
+	if err != nil {
+		vfs.fail(err)
+		return
+	}
+	_, hash := r.head()
+	for hash != "" {
+		commit, err := r.readCommit(hash)
+		if err != nil {
+			vfs.fail(err)
+			return
+		}
+		fmt.Println("commit", hash)
+		if len(commit.Parents) > 1 {
+			short := make([]string, len(commit.Parents))
+			for i, parent := range commit.Parents {
+				short[i] = shortHash(parent)
+			}
+			fmt.Println("Merge:", strings.Join(short, " "))
+		}
+		fmt.Println("Author:", commit.Author)
+		fmt.Println("Date:  ", commit.Time.Local().Format("Mon Jan 2 15:04:05 2006"))
+		fmt.Println()
+		for _, line := range strings.Split(commit.Message, "\n") {
+			fmt.Println("    " + line)
+		}
+		fmt.Println()
+		hash = ""
+		if len(commit.Parents) > 0 {
+			hash = commit.Parents[0]
+		}
+	}
+}
+
+func (vfs *VFS) vcsStatus() {
+	r, err := vfs.findRepo()
+	if err != nil {
+		vfs.fail(err)
+		return
+	}
+	branch, hash := r.head()
+	if branch != "" {
+		fmt.Println("On branch", branch)
+	} else {
+		fmt.Println("HEAD detached at", shortHash(hash))
+	}
+	if mergeHead, merging := r.readMeta("MERGE_HEAD"); merging {
+		fmt.Println("Merging", shortHash(strings.TrimSpace(string(mergeHead)))+"; fix conflicts, add the files and commit")
+	}
+	headFiles, err := r.commitFiles(hash)
+	if err != nil {
+		vfs.fail("Error reading HEAD:", err)
+		return
+	}
+	index := r.readIndex()
+	work, err := r.workEntries()
+	if err != nil {
+		vfs.fail("Error reading work tree:", err)
+		return
+	}
+
+	printChanges := func(title string, added []string, modified []string, deleted []string) {
+		if len(added)+len(modified)+len(deleted) == 0 {
+			return
+		}
+		fmt.Println(title)
+		for _, filePath := range added {
+			fmt.Println("  new file:  ", filePath)
+		}
+		for _, filePath := range modified {
+			fmt.Println("  modified:  ", filePath)
+		}
+		for _, filePath := range deleted {
+			fmt.Println("  deleted:   ", filePath)
+		}
+	}
+	added, modified, deleted := changes(headFiles, index)
+	printChanges("Changes to be committed:", added, modified, deleted)
+
+	tracked := make(map[string]vcsEntry)
+	var untracked []string
+	for _, filePath := range sortedKeys(work) {
+		if _, exists := index[filePath]; exists {
+			tracked[filePath] = work[filePath]
+		} else {
+			untracked = append(untracked, filePath)
+		}
+	}
+	_, modified, deleted = changes(index, tracked)
+	printChanges("Changes not staged for commit:", nil, modified, deleted)
+	if len(untracked) > 0 {
+		fmt.Println("Untracked files:")
+		for _, filePath := range untracked {
+			fmt.Println("  " + filePath)
+		}
+	}
+}
+
+// vcsDiff prints the changes in the work tree that are not staged, or with
+// staged the changes staged since HEAD, limited to targets if any are
+// given.
+func (vfs *VFS) vcsDiff(staged bool, targets []string) {
+	r, err := vfs.findRepo()
+	if err != nil {
+		vfs.fail(err)
+		return
+	}
+	var prefixes []string
+	for _, target := range targets {
+		prefix, err := r.relPath(target)
+		if err != nil {
+			vfs.fail(err)
+			return
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	selected := func(filePath string) bool {
+		if len(prefixes) == 0 {
+			return true
+		}
+		for _, prefix := range prefixes {
+			if underPath(filePath, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	index := r.readIndex()
+	before, after := index, make(map[string]vcsEntry)
+	read := func(filePath string, entry vcsEntry, fromWork bool) (string, error) {
+		if fromWork {
+			content, err := vfs.readFile(vfs.findFileByPath(joinPath(r.root.Path, filePath)))
+			return string(content), err
+		}
+		content, err := r.readObject(entry.Hash, "blob")
+		return string(content), err
+	}
+	if staged {
+		_, hash := r.head()
+		if before, err = r.commitFiles(hash); err != nil {
+			vfs.fail("Error reading HEAD:", err)
+			return
+		}
+		after = index
+	} else {
+		work, err := r.workEntries()
+		if err != nil {
+			vfs.fail("Error reading work tree:", err)
+			return
+		}
+		for filePath := range index {
+			if entry, exists := work[filePath]; exists {
+				after[filePath] = entry
+			}
+		}
+	}
+
+	added, modified, deleted := changes(before, after)
+	paths := append(append(added, modified...), deleted...)
+	for _, filePath := range sortedKeys(setOf(paths)) {
+		if !selected(filePath) {
+			continue
+		}
+		var oldText, newText string
+		from, to := "a/"+filePath, "b/"+filePath
+		if entry, existed := before[filePath]; existed {
+			if oldText, err = read(filePath, entry, false); err != nil {
+				vfs.fail("Error reading", filePath+":", err)
+				return
+			}
+		} else {
+			from = "/dev/null"
+		}
+		if entry, exists := after[filePath]; exists {
+			if newText, err = read(filePath, entry, !staged); err != nil {
+				vfs.fail("Error reading", filePath+":", err)
+				return
+			}
+		} else {
+			to = "/dev/null"
+		}
+		if before[filePath].Executable != after[filePath].Executable && oldText == newText {
+			fmt.Printf("mode change %s: %s -> %s\n", filePath, before[filePath].mode(), after[filePath].mode())
+			continue
+		}
+		writeUnified(os.Stdout, from, to, diffHunks(diffLines(splitLines(oldText), splitLines(newText)), 3))
+	}
+}
+
+func setOf(items []string) map[string]bool {
+	set := make(map[string]bool, len(items))
+	for _, item := range items {
+		set[item] = true
+	}
+	return set
+}
+
+func (vfs *VFS) vcsBranchList() {
+	r, err := vfs.findRepo()
+	if err != nil {
+		vfs.fail(err)
+		return
+	}
+	current, hash := r.head()
+	names := make(map[string]bool)
+	if heads := vfs.findDirectoryByPath(joinPath(r.meta.Path, "refs/heads")); heads != nil {
+		for name := range heads.Files {
+			names[name] = true
+		}
+	}
+	if current != "" {
+		names[current] = true
+	}
+	for _, name := range sortedKeys(names) {
+		marker := " "
+		if name == current {
+			marker = "*"
+		}
+		fmt.Println(marker, name)
+	}
+	if current == "" {
+		fmt.Println("* (HEAD detached at " + shortHash(hash) + ")")
+	}
+}
+
+// vcsBranchCreate starts a branch at start, or at HEAD if start is empty.
+func (vfs *VFS) vcsBranchCreate(name string, start string) {
+	r := vfs.writableRepo()
+	if r == nil {
+		return
+	}
+	_, hash := r.head()
+	if start != "" {
+		var err error
+		if hash, err = r.resolve(start); err != nil {
+			vfs.fail(err)
+			return
+		}
+	}
+	r.createBranch(name, hash)
+}
+
+func (vfs *VFS) vcsBranchDelete(name string) {
+	r := vfs.writableRepo()
+	if r == nil {
+		return
+	}
+	if current, _ := r.head(); name == current {
+		vfs.fail("Cannot delete the branch you are on:", name)
+		return
+	}
+	if !r.branchExists(name) {
+		vfs.fail("Branch", name, "does not exist")
+		return
+	}
+	r.removeMeta("refs/heads/" + name)
+	fmt.Println("Deleted branch", name)
+}
+
+func (r *repo) createBranch(name string, hash string) bool {
+	switch {
+	case !branchNamePattern.MatchString(name):
+		r.vfs.fail("Invalid branch name:", name)
+		return false
+	case r.branchExists(name):
+		r.vfs.fail("Branch", name, "already exists")
+		return false
+	case hash == "":
+		r.vfs.fail("Cannot create a branch before the first commit")
+		return false
+	}
+	if err := r.writeMeta("refs/heads/"+name, []byte(hash+"\n")); err != nil {
+		r.vfs.fail("Error creating branch:", err)
+		return false
+	}
+	return true
+}
+
+// vcsCheckout switches the work tree to a branch or commit, or with create
+// starts a new branch at HEAD.
+func (vfs *VFS) vcsCheckout(rev string, create bool) {
+	r := vfs.writableRepo()
+	if r == nil {
+		return
+	}
+	if _, merging := r.readMeta("MERGE_HEAD"); merging {
+		vfs.fail("Cannot switch branches during a merge, commit it first")
+		return
+	}
+	current, hash := r.head()
+	if create {
+		if hash != "" && !r.createBranch(rev, hash) {
+			return
+		}
+		if hash == "" && !branchNamePattern.MatchString(rev) {
+			vfs.fail("Invalid branch name:", rev)
+			return
+		}
+		if err := r.writeMeta("HEAD", []byte("ref: refs/heads/"+rev+"\n")); err != nil {
+			vfs.fail("Error switching branch:", err)
+			return
+		}
+		fmt.Println("Switched to a new branch", rev)
+		return
+	}
+
+	target, err := r.resolve(rev)
+	if err != nil {
+		vfs.fail(err)
+		return
+	}
+	from, err := r.commitFiles(hash)
+	var to map[string]vcsEntry
+	if err == nil {
+		to, err = r.commitFiles(target)
+	}
+	if err != nil {
+		vfs.fail("Error reading commit:", err)
+		return
+	}
+	index := r.readIndex()
+	if dirty, err := r.trackedChanges(from, index); err != nil || dirty {
+		vfs.fail("Your local changes would be overwritten by checkout, commit them first")
+		return
+	}
+	if inTheWay, err := r.untrackedInTheWay(index, to); err != nil || len(inTheWay) > 0 {
+		vfs.fail("Untracked files would be overwritten by checkout:", strings.Join(inTheWay, " "))
+		return
+	}
+	if err := r.switchFiles(from, to); err != nil {
+		vfs.fail("Error checking out", rev+":", err)
+		return
+	}
+	head := "ref: refs/heads/" + rev
+	if !r.branchExists(rev) {
+		head = target
+	}
+	if err := r.writeMeta("HEAD", []byte(head+"\n")); err != nil {
+		vfs.fail("Error switching branch:", err)
+		return
+	}
+	if rev == current {
+		fmt.Println("Already on", rev)
+	} else if r.branchExists(rev) {
+		fmt.Println("Switched to branch", rev)
+	} else {
+		fmt.Println("HEAD is now at", shortHash(target))
+	}
+}
+
+// ancestors returns every commit reachable from hash, including itself.
+func (r *repo) ancestors(hash string) (map[string]bool, error) {
+	seen := make(map[string]bool)
+	queue := []string{hash}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		if next == "" || seen[next] {
+			continue
+		}
+		seen[next] = true
+		commit, err := r.readCommit(next)
+		if err != nil {
+			return nil, err
+		}
+		queue = append(queue, commit.Parents...)
+	}
+	return seen, nil
+}
+
+// mergeBase finds the closest commit that both ours and theirs descend from.
+func (r *repo) mergeBase(ours string, theirs string) (string, error) {
+	ourAncestors, err := r.ancestors(ours)
+	if err != nil {
+		return "", err
+	}
+	seen := make(map[string]bool)
+	queue := []string{theirs}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		if seen[next] {
+			continue
+		}
+		seen[next] = true
+		if ourAncestors[next] {
+			return next, nil
+		}
+		commit, err := r.readCommit(next)
+		if err != nil {
+			return "", err
+		}
+		queue = append(queue, commit.Parents...)
+	}
+	return "", nil
+}
+
+// vcsMerge merges branch into the current one. Files both sides changed are
+// merged line by line; what cannot be is left with conflict markers for the
+// user to resolve and commit.
+func (vfs *VFS) vcsMerge(rev string) {
+	r := vfs.writableRepo()
+	if r == nil {
+		return
+	}
+	if _, merging := r.readMeta("MERGE_HEAD"); merging {
+		vfs.fail("A merge is already in progress, commit it first")
+		return
+	}
+	current, ours := r.head()
+	theirs, err := r.resolve(rev)
+	if err != nil {
+		vfs.fail(err)
+		return
+	}
+	ourFiles, err := r.commitFiles(ours)
+	if err != nil {
+		vfs.fail("Error reading HEAD:", err)
+		return
+	}
+	index := r.readIndex()
+	if dirty, err := r.trackedChanges(ourFiles, index); err != nil || dirty {
+		vfs.fail("Your local changes would be overwritten by merge, commit them first")
+		return
+	}
+	theirFiles, err := r.commitFiles(theirs)
+	if err != nil {
+		vfs.fail("Error reading", rev+":", err)
+		return
+	}
+	ourAncestors, err := r.ancestors(ours)
+	if err != nil {
+		vfs.fail("Error reading history:", err)
+		return
+	}
+	if ourAncestors[theirs] {
+		fmt.Println("Already up to date")
+		return
+	}
+	if inTheWay, err := r.untrackedInTheWay(index, theirFiles); err != nil || len(inTheWay) > 0 {
+		vfs.fail("Untracked files would be overwritten by merge:", strings.Join(inTheWay, " "))
+		return
+	}
+
+	base, err := r.mergeBase(ours, theirs)
+	if err != nil {
+		vfs.fail("Error reading history:", err)
+		return
+	}
+	if base == ours {
+		err := r.switchFiles(ourFiles, theirFiles)
+		if err == nil {
+			err = r.advance(theirs)
+		}
+		if err != nil {
+			vfs.fail("Error merging", rev+":", err)
+			return
+		}
+		fmt.Println("Fast-forward to", shortHash(theirs))
+		return
+	}
+	baseFiles, err := r.commitFiles(base)
+	if err != nil {
+		vfs.fail("Error reading history:", err)
+		return
+	}
+
+	if current == "" {
+		current = "HEAD"
+	}
+	// Work out the whole merge before touching anything, so that it is
+	// either refused or made in full.
+	merged := make(map[string]vcsEntry)
+	changes := make(map[string]workChange)
+	blobs := make(map[string][]byte)
+	var conflicted []string
+	paths := setOf(append(append(sortedKeys(baseFiles), sortedKeys(ourFiles)...), sortedKeys(theirFiles)...))
+	for _, filePath := range sortedKeys(paths) {
+		old, inBase := baseFiles[filePath]
+		mine, inOurs := ourFiles[filePath]
+		other, inTheirs := theirFiles[filePath]
+		switch {
+		case inOurs == inTheirs && mine == other:
+			if inOurs {
+				merged[filePath] = mine
+			}
+		case inBase == inOurs && old == mine:
+			if !inTheirs {
+				changes[filePath] = workChange{remove: true}
+				continue
+			}
+			change, err := r.checkoutChange(other)
+			if err != nil {
+				vfs.fail("Error merging", filePath+":", err)
+				return
+			}
+			changes[filePath] = change
+			merged[filePath] = other
+		case inBase == inTheirs && old == other:
+			if inOurs {
+				merged[filePath] = mine
+			}
+		case !inOurs || !inTheirs:
+			// Changed on one side and deleted on the other: keep the
+			// changed file for the user to decide.
+			conflicted = append(conflicted, filePath)
+			if inOurs {
+				merged[filePath] = mine
+				continue
+			}
+			change, err := r.checkoutChange(other)
+			if err != nil {
+				vfs.fail("Error merging", filePath+":", err)
+				return
+			}
+			changes[filePath] = change
+		default:
+			text, clean, err := r.mergeFile(old, mine, other, inBase, current, rev)
+			if err != nil {
+				vfs.fail("Error merging", filePath+":", err)
+				return
+			}
+			executable := mine.Executable || other.Executable
+			changes[filePath] = workChange{content: text, executable: executable}
+			if !clean {
+				conflicted = append(conflicted, filePath)
+				merged[filePath] = mine
+				continue
+			}
+			hash := hashObject("blob", text)
+			blobs[hash] = text
+			merged[filePath] = vcsEntry{Hash: hash, Executable: executable}
+		}
+	}
+	if !r.checkWorkChanges(changes) {
+		return
+	}
+
+	message := fmt.Sprintf("Merge %s into %s", rev, current)
+	for _, hash := range sortedKeys(blobs) {
+		if _, err := r.writeObject("blob", blobs[hash]); err != nil {
+			vfs.fail("Error merging:", err)
+			return
+		}
+	}
+	if err := r.applyWorkChanges(changes); err != nil {
+		// The work tree is part way merged: leave the merge open, so that
+		// the user can see what happened and finish it.
+		r.writeMeta("MERGE_HEAD", []byte(theirs+"\n"))
+		r.writeMeta("MERGE_MSG", []byte(message+"\n"))
+		vfs.fail("Error merging", rev+":", err, "- fix the work tree, add the files and commit")
+		return
+	}
+	if err := r.writeIndex(merged); err != nil {
+		vfs.fail("Error writing index:", err)
+		return
+	}
+	if len(conflicted) > 0 {
+		r.writeMeta("MERGE_HEAD", []byte(theirs+"\n"))
+		r.writeMeta("MERGE_MSG", []byte(message+"\n"))
+		for _, filePath := range conflicted {
+			fmt.Println("CONFLICT:", filePath)
+		}
+		vfs.fail("Automatic merge failed; fix the conflicts, add the files and commit")
+		return
+	}
+	tree, err := r.writeTree(merged)
+	var hash string
+	if err == nil {
+		hash, err = r.writeCommit(vcsCommit{Tree: tree, Parents: []string{ours, theirs}, Author: vfs.userName(), Time: time.Now(), Message: message})
+	}
+	if err == nil {
+		err = r.advance(hash)
+	}
+	if err != nil {
+		vfs.fail("Error writing merge commit:", err)
+		return
+	}
+	fmt.Printf("Merged %s into %s as %s\n", rev, current, shortHash(hash))
+}
+
+// mergeFile merges the changes to one file, returning the result and
+// whether it merged without conflicts.
+func (r *repo) mergeFile(base vcsEntry, ours vcsEntry, theirs vcsEntry, inBase bool, oursLabel string, theirsLabel string) ([]byte, bool, error) {
+	var baseText []byte
+	var err error
+	if inBase {
+		if baseText, err = r.readObject(base.Hash, "blob"); err != nil {
+			return nil, false, err
+		}
+	}
+	ourText, err := r.readObject(ours.Hash, "blob")
+	if err != nil {
+		return nil, false, err
+	}
+	theirText, err := r.readObject(theirs.Hash, "blob")
+	if err != nil {
+		return nil, false, err
+	}
+	lines, conflicts := merge3(splitLines(string(baseText)), splitLines(string(ourText)), splitLines(string(theirText)), oursLabel, theirsLabel)
+	return []byte(strings.Join(lines, "")), conflicts == 0, nil
+}
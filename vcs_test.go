@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const mergeBase = "1\n2\n3\n4\n5\n"
+
+func TestVcsMerge(t *testing.T) {
+	tests := []struct {
+		name        string
+		theirs      func(t *testing.T, vfs *VFS)
+		ours        func(t *testing.T, vfs *VFS)
+		wantOutput  string
+		wantContent string // "" when a.txt should be gone
+		conflict    bool
+	}{
+		{
+			name:        "fast-forward",
+			theirs:      func(t *testing.T, vfs *VFS) { writeTestFile(t, vfs, "/r/a.txt", "1\n2\nthree\n4\n5\n") },
+			wantOutput:  "Fast-forward",
+			wantContent: "1\n2\nthree\n4\n5\n",
+		},
+		{
+			name:        "clean three-way",
+			theirs:      func(t *testing.T, vfs *VFS) { writeTestFile(t, vfs, "/r/a.txt", "one\n2\n3\n4\n5\n") },
+			ours:        func(t *testing.T, vfs *VFS) { writeTestFile(t, vfs, "/r/a.txt", "1\n2\n3\n4\nfive\n") },
+			wantOutput:  "Merged other into main",
+			wantContent: "one\n2\n3\n4\nfive\n",
+		},
+		{
+			name:        "conflicting lines",
+			theirs:      func(t *testing.T, vfs *VFS) { writeTestFile(t, vfs, "/r/a.txt", "1\n2\ntheirs\n4\n5\n") },
+			ours:        func(t *testing.T, vfs *VFS) { writeTestFile(t, vfs, "/r/a.txt", "1\n2\nours\n4\n5\n") },
+			wantOutput:  "CONFLICT: a.txt",
+			wantContent: "1\n2\n<<<<<<< main\nours\n=======\ntheirs\n>>>>>>> other\n4\n5\n",
+			conflict:    true,
+		},
+		{
+			name:        "modified by us, deleted by them",
+			theirs:      func(t *testing.T, vfs *VFS) { run(vfs, "rm -f a.txt") },
+			ours:        func(t *testing.T, vfs *VFS) { writeTestFile(t, vfs, "/r/a.txt", "1\n2\nours\n4\n5\n") },
+			wantOutput:  "CONFLICT: a.txt",
+			wantContent: "1\n2\nours\n4\n5\n",
+			conflict:    true,
+		},
+		{
+			name:        "deleted by us, modified by them",
+			theirs:      func(t *testing.T, vfs *VFS) { writeTestFile(t, vfs, "/r/a.txt", "1\n2\ntheirs\n4\n5\n") },
+			ours:        func(t *testing.T, vfs *VFS) { run(vfs, "rm -f a.txt") },
+			wantOutput:  "CONFLICT: a.txt",
+			wantContent: "1\n2\ntheirs\n4\n5\n",
+			conflict:    true,
+		},
+		{
+			name:       "deleted by them",
+			theirs:     func(t *testing.T, vfs *VFS) { run(vfs, "rm -f a.txt") },
+			ours:       func(t *testing.T, vfs *VFS) { writeTestFile(t, vfs, "/r/b.txt", "b\n") },
+			wantOutput: "Merged other into main",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vfs := newTestVFS(t)
+			writeTestFile(t, vfs, "/r/a.txt", mergeBase)
+			run(vfs, "cd /r; vcs init; vcs add .; vcs commit -m base; vcs checkout -b other")
+			test.theirs(t, vfs)
+			run(vfs, "vcs add .; vcs commit -m theirs; vcs checkout main")
+			if test.ours != nil {
+				test.ours(t, vfs)
+				run(vfs, "vcs add .; vcs commit -m ours")
+			}
+
+			output := run(vfs, "vcs merge other")
+			if !strings.Contains(output, test.wantOutput) {
+				t.Errorf("merge printed %q, want it to mention %q", output, test.wantOutput)
+			}
+			content, exists := readTestFile(t, vfs, "/r/a.txt")
+			if test.wantContent == "" && exists {
+				t.Errorf("a.txt still holds %q, want it deleted", content)
+			} else if content != test.wantContent {
+				t.Errorf("a.txt holds %q, want %q", content, test.wantContent)
+			}
+			if _, merging := readTestFile(t, vfs, "/r/.vcs/MERGE_HEAD"); merging != test.conflict {
+				t.Errorf("merge left MERGE_HEAD: %v, want %v", merging, test.conflict)
+			}
+			if (vfs.Status != 0) != test.conflict {
+				t.Errorf("merge exited with status %d", vfs.Status)
+			}
+		})
+	}
+}
+
+func TestVcsMergeRefusedChangesNothing(t *testing.T) {
+	vfs := newTestVFS(t)
+	writeTestFile(t, vfs, "/r/a.txt", mergeBase)
+	writeTestFile(t, vfs, "/r/b.txt", mergeBase)
+	run(vfs, "cd /r; vcs init; vcs add .; vcs commit -m base; vcs checkout -b other")
+	writeTestFile(t, vfs, "/r/a.txt", "one\n2\n3\n4\n5\n")
+	writeTestFile(t, vfs, "/r/b.txt", "one\n2\n3\n4\n5\n")
+	run(vfs, "vcs add .; vcs commit -m theirs; vcs checkout main")
+	writeTestFile(t, vfs, "/r/c.txt", "c\n")
+	run(vfs, "vcs add .; vcs commit -m ours")
+	vfs.findFileByPath("/r/b.txt").WritePermission = nil
+
+	r, err := vfs.findRepo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, before := r.head()
+	run(vfs, "vcs merge other")
+	if vfs.Status == 0 {
+		t.Error("merge over a file the user cannot write succeeded")
+	}
+	if content, _ := readTestFile(t, vfs, "/r/a.txt"); content != mergeBase {
+		t.Errorf("a.txt was changed to %q", content)
+	}
+	if _, after := r.head(); after != before {
+		t.Errorf("HEAD moved from %s to %s", before, after)
+	}
+	if _, merging := readTestFile(t, vfs, "/r/.vcs/MERGE_HEAD"); merging {
+		t.Error("a refused merge left MERGE_HEAD behind")
+	}
+}